@@ -0,0 +1,334 @@
+package cli
+
+// Runs the client from a script instead of a person, so it can be used in
+// pipelines and tests. Scripts are the same lines that would be typed into the
+// CLI, with /expect and /sleep added to wait for the room
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"p2psystem/client"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit statuses returned by RunBatch
+const (
+	ExitOK = 0;
+	// ExitFailed is returned when a command or message fails
+	ExitFailed = 1;
+	// ExitUsage is returned for lines that can't be parsed or have the wrong
+	// arguments
+	ExitUsage = 2;
+	// ExitTimeout is returned when something being waited for doesn't happen
+	ExitTimeout = 3;
+	// ExitDisconnected is returned when the current connection closes while
+	// it's being waited on
+	ExitDisconnected = 4;
+)
+
+const (
+	// BatchTimeout is how long a script waits for a connection or an /expect
+	// that doesn't give its own timeout
+	BatchTimeout = 10 * time.Second;
+	// batchBacklog is the number of unmatched events kept for /expect
+	batchBacklog = 1000;
+)
+
+// BatchError is returned by a command to choose the exit status a script
+// stops with
+type BatchError struct{
+	Code int;
+	Err error;
+}
+
+func (err *BatchError) Error() (string){
+	return err.Err.Error();
+}
+
+// batchState is what's been seen on the session while a script runs
+type batchState struct{
+	lock sync.Mutex;
+	changed chan bool;		// Has a value whenever something new is seen
+	// events are the messages and announcements not yet matched by /expect
+	events []client.Event;
+	connected map[*client.ClientConnection]bool;
+	disconnected map[*client.ClientConnection]bool;
+}
+
+// batchLine formats an event the way scripts print and match it, without
+// timestamps so the output of a run can be compared with another
+func batchLine(event client.Event) (string){
+	switch event.Type{
+	case client.EventConnect:{
+		return fmt.Sprintf("Connected to %s", event.Addr);
+	}
+	case client.EventMessage:{
+		return fmt.Sprintf("%s: %s", event.Nickname, event.Text);
+	}
+	case client.EventDirectMessage:{
+		return fmt.Sprintf("%s -> you: %s", event.Nickname, event.Text);
+	}
+	case client.EventAnnouncement:{
+		return fmt.Sprintf("Server: %s", event.Text);
+	}
+	case client.EventKick:{
+		return fmt.Sprintf("Kicked: %s", event.Text);
+	}
+	case client.EventDisconnect:{
+		return fmt.Sprintf("Disconnected from %s", event.Addr);
+	}
+	}
+	return "";
+}
+
+// recordEvent prints event and keeps it for /expect
+func recordEvent(state *CLIState, event client.Event){
+	batch := state.batch;
+	line := batchLine(event);
+	if (state.json != nil){
+		state.json.writeEvent(event);
+	}
+	if (line == ""){
+		return;
+	}
+	if (state.json == nil){
+		fmt.Fprintln(state.Out, line);
+	}
+
+	batch.lock.Lock();
+	switch event.Type{
+	case client.EventConnect:{
+		batch.connected[event.Connection] = true;
+	}
+	case client.EventDisconnect:{
+		batch.disconnected[event.Connection] = true;
+	}
+	default:{
+		batch.events = append(batch.events, event);
+		if (len(batch.events) > batchBacklog){
+			batch.events = batch.events[len(batch.events) - batchBacklog:];
+		}
+	}
+	}
+	batch.lock.Unlock();
+
+	select {
+	case batch.changed <- true:
+	default:
+	}
+}
+
+// waitBatch waits until check returns true or an error, giving up after
+// timeout. check is called with the lock held
+func waitBatch(batch *batchState, timeout time.Duration, check func() (bool, error)) (error){
+	deadline := time.NewTimer(timeout);
+	defer deadline.Stop();
+	for {
+		batch.lock.Lock();
+		done, err := check();
+		batch.lock.Unlock();
+		if (err != nil){
+			return err;
+		}
+		if (done){
+			return nil;
+		}
+
+		select {
+		case <- batch.changed:
+		case <- deadline.C:{
+			return &BatchError{Code: ExitTimeout, Err: fmt.Errorf("timed out after %s", timeout)};
+		}
+		}
+	}
+}
+
+// exitCode returns the exit status for an error from a command
+func exitCode(err error) (int){
+	var batchErr *BatchError;
+	if (errors.As(err, &batchErr)){
+		return batchErr.Code;
+	}
+	return ExitFailed;
+}
+
+// parseTimeout returns the duration in args[index] or BatchTimeout if there
+// isn't one
+func parseTimeout(args []string, index int) (time.Duration, error){
+	if (len(args) <= index){
+		return BatchTimeout, nil;
+	}
+	timeout, err := time.ParseDuration(args[index]);
+	if ((err != nil) || (timeout <= 0)){
+		return 0, &BatchError{Code: ExitUsage, Err: fmt.Errorf("invalid timeout %q, expected something like 5s", args[index])};
+	}
+	return timeout, nil;
+}
+
+func expectCommand(state *CLIState, args []string) (error){
+	if (state.batch == nil){
+		return fmt.Errorf("/expect only works in scripts");
+	}
+	pattern, err := regexp.Compile(args[0]);
+	if (err != nil){
+		return &BatchError{Code: ExitUsage, Err: fmt.Errorf("invalid pattern: %s", err)};
+	}
+	timeout, err := parseTimeout(args, 1);
+	if (err != nil){
+		return err;
+	}
+
+	batch := state.batch;
+	current := client.GetCurrentConnection(state.Session);
+	err = waitBatch(batch, timeout, func() (bool, error){
+		for index, event := range batch.events{
+			if (pattern.MatchString(batchLine(event))){
+				// Later lines only match what arrives after this
+				batch.events = batch.events[index + 1:];
+				return true, nil;
+			}
+		}
+		if ((current == nil) || batch.disconnected[current]){
+			return false, &BatchError{Code: ExitDisconnected, Err: fmt.Errorf("disconnected while waiting for %q", args[0])};
+		}
+		return false, nil;
+	});
+	if (err != nil){
+		return err;
+	}
+	return nil;
+}
+
+func sleepCommand(state *CLIState, args []string) (error){
+	duration, err := time.ParseDuration(args[0]);
+	if ((err != nil) || (duration < 0)){
+		return &BatchError{Code: ExitUsage, Err: fmt.Errorf("invalid duration %q, expected something like 500ms", args[0])};
+	}
+	time.Sleep(duration);
+	return nil;
+}
+
+// batchCommands adds the commands that only make sense in scripts to registry
+func batchCommands(registry *CommandRegistry){
+	RegisterCommand(registry, Command{
+		Name: "expect",
+		MinArgs: 1,
+		MaxArgs: 2,
+		Usage: "<pattern> [timeout]",
+		Description: "Waits for a message or announcement matching the regular expression",
+		Handler: expectCommand,
+	});
+	RegisterCommand(registry, Command{
+		Name: "sleep",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Usage: "<duration>",
+		Description: "Waits for the given time, e.g. 500ms",
+		Handler: sleepCommand,
+	});
+}
+
+/**
+RunBatch runs the lines in script as if they were typed into the CLI and
+returns the exit status. Events are printed to stdout without timestamps or
+escape codes, or as JSON lines if options.Output is OutputJSON, and the first
+line that fails stops the script, with the error written to stderr or as an
+"error" event. /connect waits for the handshake to finish, and scripts can
+also use /expect and /sleep. Blank lines and lines starting with # are skipped
+*/
+func RunBatch(session *client.ClientSession, script io.Reader, options CLIOptions) (int){
+	registry := options.Commands;
+	if (registry == nil){
+		var err error;
+		registry, err = DefaultCommands();
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Unable to start the CLI: %s\n", err);
+			return ExitFailed;
+		}
+	}
+	batchCommands(registry);
+
+	batch := &batchState{
+		changed: make(chan bool, 1),
+		events: []client.Event{},
+		connected: map[*client.ClientConnection]bool{},
+		disconnected: map[*client.ClientConnection]bool{},
+	};
+	state := &CLIState{
+		Session: session,
+		LogLevel: options.LogLevel,
+		Commands: registry,
+		Out: os.Stdout,
+		batch: batch,
+	};
+	if (options.Output == OutputJSON){
+		state.json = newJSONOutput(os.Stdout);
+		state.Out = state.json;
+	}
+	client.AddHandler(session, client.EventHandlerFunc(func(event client.Event){
+		recordEvent(state, event);
+	}));
+
+	fail := func(lineNumber int, code int, err error) (int){
+		err = fmt.Errorf("line %d: %s", lineNumber, err);
+		if (state.json != nil){
+			state.json.writeError(client.GetCurrentConnection(session), err);
+		} else {
+			fmt.Fprintf(os.Stderr, "%s\n", err);
+		}
+		return code;
+	};
+
+	scanner := bufio.NewScanner(script);
+	lineNumber := 0;
+	for (!state.quit && scanner.Scan()){
+		lineNumber++;
+		line := strings.TrimRight(scanner.Text(), "\r");
+		if ((strings.TrimSpace(line) == "") || strings.HasPrefix(line, "#")){
+			continue;
+		}
+
+		parseResult, err := ParseLine(registry, line);
+		if (err != nil){
+			return fail(lineNumber, ExitUsage, err);
+		}
+
+		if (parseResult.Command == nil){
+			err = client.SendMessage(client.GetCurrentConnection(session), parseResult.Message);
+			if (err != nil){
+				return fail(lineNumber, ExitFailed, err);
+			}
+			continue;
+		}
+
+		previous := client.GetCurrentConnection(session);
+		err = parseResult.Command.Handler(state, parseResult.Args);
+		if (err != nil){
+			return fail(lineNumber, exitCode(err), err);
+		}
+
+		// Don't run the next line until the new connection is ready for it
+		current := client.GetCurrentConnection(session);
+		if ((current != nil) && (current != previous)){
+			err = waitBatch(batch, BatchTimeout, func() (bool, error){
+				if (batch.disconnected[current]){
+					return false, &BatchError{Code: ExitDisconnected, Err: fmt.Errorf("disconnected before the handshake finished")};
+				}
+				return batch.connected[current], nil;
+			});
+			if (err != nil){
+				return fail(lineNumber, exitCode(err), err);
+			}
+		}
+	}
+	if (scanner.Err() != nil){
+		return fail(lineNumber, ExitFailed, scanner.Err());
+	}
+	return ExitOK;
+}
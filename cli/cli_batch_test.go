@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"p2psystem/client"
+	"p2psystem/server"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// discardLogger drops everything logged to it
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil));
+
+// startRoom starts a server listening on a mem:// address named after the
+// test and returns it with the address
+func startRoom(t *testing.T) (*server.ServerRoom, string){
+	t.Helper();
+	addr := "mem://" + t.Name();
+	room, err := server.New(server.ServerOptions{
+		Listen: server.ListenAddrs{addr},
+		Logger: discardLogger,
+	});
+	if (err != nil){
+		t.Fatalf("unable to create server: %s", err);
+	}
+	_, err = server.Start(room);
+	if (err != nil){
+		t.Fatalf("unable to start server: %s", err);
+	}
+	t.Cleanup(func(){
+		server.Stop(room);
+	});
+	return room, addr;
+}
+
+// newSession returns a session called batch with an empty config
+func newSession(t *testing.T) (*client.ClientSession){
+	t.Helper();
+	session := client.NewSession(discardLogger);
+	session.Nickname = "batch";
+	client.LoadConfig(session, t.TempDir());
+	t.Cleanup(func(){
+		client.DisconnectAll(session);
+	});
+	return session;
+}
+
+// runScript runs script with RunBatch on a new session and returns the exit
+// status with what was written to stdout and stderr
+func runScript(t *testing.T, script string) (int, string, string){
+	t.Helper();
+	return runSession(t, newSession(t), script);
+}
+
+// runSession is runScript on an existing session
+func runSession(t *testing.T, session *client.ClientSession, script string) (int, string, string){
+	t.Helper();
+	stdoutRead, stdoutWrite, err := os.Pipe();
+	if (err != nil){
+		t.Fatalf("unable to make a pipe: %s", err);
+	}
+	stderrRead, stderrWrite, err := os.Pipe();
+	if (err != nil){
+		t.Fatalf("unable to make a pipe: %s", err);
+	}
+	stdout, stderr := os.Stdout, os.Stderr;
+	os.Stdout, os.Stderr = stdoutWrite, stderrWrite;
+
+	readPipe := func(pipe *os.File) (<-chan string){
+		output := make(chan string, 1);
+		go func(){
+			data, _ := io.ReadAll(pipe);
+			pipe.Close();
+			output <- string(data);
+		}();
+		return output;
+	};
+	stdoutOutput, stderrOutput := readPipe(stdoutRead), readPipe(stderrRead);
+
+	code := RunBatch(session, strings.NewReader(script), CLIOptions{});
+	// Events that arrive once the script has finished can't be written to the
+	// pipes after they're closed, so take the session down first
+	client.DisconnectAll(session);
+
+	os.Stdout, os.Stderr = stdout, stderr;
+	stdoutWrite.Close();
+	stderrWrite.Close();
+	return code, <- stdoutOutput, <- stderrOutput;
+}
+
+func TestBatchSendsScriptToRoom(t *testing.T){
+	_, addr := startRoom(t);
+	script, err := os.ReadFile("../tests/cli/wackychars.in");
+	if (err != nil){
+		t.Fatalf("unable to read the script: %s", err);
+	}
+	lines := strings.Split(strings.TrimRight(string(script), "\n"), "\n");
+	last := lines[len(lines) - 1];
+
+	// The messages come straight after /connect, so they only reach the room
+	// if the script waits for the handshake
+	code, stdout, stderr := runScript(t, "/connect " + addr + "\n" + string(script) +
+		"/expect '^batch: " + regexp.QuoteMeta(last) + "$' 5s\n");
+	if (code != ExitOK){
+		t.Fatalf("exited with %d: %s", code, stderr);
+	}
+
+	output := strings.Split(stdout, "\n");
+	connected := -1;
+	received := 0;
+	for index, line := range output{
+		if (line == "Connected to " + addr){
+			connected = index;
+		}
+		if ((received < len(lines)) && (line == "batch: " + lines[received])){
+			if ((connected == -1) || (index < connected)){
+				t.Errorf("%q was printed before the connection", line);
+			}
+			received++;
+		}
+	}
+	if (connected == -1){
+		t.Errorf("the connection wasn't printed:\n%s", stdout);
+	}
+	if (received != len(lines)){
+		t.Errorf("received %d of %d lines:\n%s", received, len(lines), stdout);
+	}
+	if (strings.Contains(stdout, "\x1b")){
+		t.Errorf("output has escape codes:\n%q", stdout);
+	}
+}
+
+func TestBatchExitCodes(t *testing.T){
+	_, addr := startRoom(t);
+	tests := []struct{
+		name string;
+		script string;
+		code int;
+		stderr string;
+	}{
+		{"comments and blank lines", "# nothing to do\n\n   \n", ExitOK, ""},
+		{"expect timeout", "/connect " + addr + "\n/expect 'never sent' 100ms\n", ExitTimeout, "line 2: timed out after 100ms"},
+		{"expect matches", "/connect " + addr + "\nhello there\n/expect '^batch: hello' 5s\n", ExitOK, ""},
+		{"expect only matches later lines", "/connect " + addr + "\nonce\n/expect 'once' 5s\n/expect 'once' 100ms\n",
+			ExitTimeout, "line 4: timed out"},
+		{"failed connect", "/connect mem://nowhere\n", ExitFailed, "line 1: Unable to connect"},
+		{"message without a room", "hello\n", ExitFailed, "line 1: "},
+		{"unknown command", "# first\n/nonsense\n", ExitUsage, "line 2: "},
+		{"missing argument", "/expect\n", ExitUsage, "line 1: "},
+		{"bad pattern", "/expect '('\n", ExitUsage, "line 1: invalid pattern"},
+		{"bad timeout", "/expect hello soon\n", ExitUsage, "line 1: invalid timeout"},
+		{"bad duration", "/sleep forever\n", ExitUsage, "line 1: invalid duration"},
+		{"stops at the first failure", "/sleep forever\n/connect mem://nowhere\n", ExitUsage, "line 1: "},
+	};
+	for _, test := range tests{
+		code, _, stderr := runScript(t, test.script);
+		if (code != test.code){
+			t.Errorf("%s: exited with %d, expected %d: %s", test.name, code, test.code, stderr);
+		}
+		if (!strings.HasPrefix(stderr, test.stderr)){
+			t.Errorf("%s: printed %q, expected it to start with %q", test.name, stderr, test.stderr);
+		}
+		if ((test.stderr == "") && (stderr != "")){
+			t.Errorf("%s: printed %q", test.name, stderr);
+		}
+	}
+}
+
+func TestBatchExpectStopsOnDisconnect(t *testing.T){
+	room, addr := startRoom(t);
+	session := newSession(t);
+	// Take the room down once the script is in it
+	events := client.Subscribe(session, 1024);
+	go func(){
+		for event := range events{
+			if (event.Type == client.EventConnect){
+				server.Stop(room);
+				return;
+			}
+		}
+	}();
+
+	code, _, stderr := runSession(t, session, "/connect " + addr + "\n/expect 'never sent' 10s\n");
+	if (code != ExitDisconnected){
+		t.Errorf("exited with %d, expected %d: %s", code, ExitDisconnected, stderr);
+	}
+}
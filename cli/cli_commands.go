@@ -0,0 +1,614 @@
+package cli
+
+// The slash commands the CLI understands. Each command is registered with its
+// name, aliases and the number of arguments it takes so that parsing, checking
+// the arguments and /help all come from the same place
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"p2psystem/client"
+	"p2psystem/common"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnyArgs is used as a command's MaxArgs when it takes any number of arguments
+const AnyArgs = -1;
+
+// exportUsage is the arguments /export takes
+const exportUsage = "<file> [format=text|json|html] [since=<time>] [until=<time>] [nick=<nicknames>]";
+
+// CommandHandler runs a command with the arguments it was given. A returned
+// error is printed to the user
+type CommandHandler func(state *CLIState, args []string) (error);
+
+// Command describes a slash command
+type Command struct{
+	Name string;		// Without the prefix
+	Aliases []string;
+	MinArgs int;
+	MaxArgs int;		// AnyArgs if there's no limit
+	Usage string;		// The arguments, e.g. "<address> [password]"
+	Description string;
+	Handler CommandHandler;
+	// Complete returns what argument arg, counting from 0, can be completed
+	// to with tab. Nil completes nicknames in the room
+	Complete func(state *CLIState, arg int) ([]string);
+	// Secret is the position, counting from 1, of an argument such as a
+	// password that's left out of the history file. 0 if there isn't one
+	Secret int;
+	// Rest makes the last argument the rest of the line exactly as it was
+	// typed, so quotes and spaces in a message are kept
+	Rest bool;
+}
+
+// CommandRegistry holds the commands the CLI can run. Names and aliases are
+// matched case-insensitively
+type CommandRegistry struct{
+	commands []*Command;
+	names map[string]*Command;
+}
+
+// NewRegistry returns a registry without any commands
+func NewRegistry() (*CommandRegistry){
+	return &CommandRegistry{
+		commands: []*Command{},
+		names: make(map[string]*Command),
+	};
+}
+
+// RegisterCommand adds command to the registry. It fails if the command's name
+// or one of its aliases is already taken
+func RegisterCommand(registry *CommandRegistry, command Command) (error){
+	if (command.Name == ""){
+		return fmt.Errorf("cliCommands: command name must not be blank");
+	}
+	if (command.Handler == nil){
+		return fmt.Errorf("cliCommands: /%s has no handler", command.Name);
+	}
+	if ((command.MaxArgs != AnyArgs) && (command.MaxArgs < command.MinArgs)){
+		return fmt.Errorf("cliCommands: /%s takes fewer than its minimum arguments", command.Name);
+	}
+	if (command.Rest && (command.MaxArgs < 1)){
+		return fmt.Errorf("cliCommands: /%s takes the rest of the line so needs a maximum number of arguments", command.Name);
+	}
+
+	names := append([]string{command.Name}, command.Aliases...);
+	for index, name := range names{
+		names[index] = strings.ToLower(name);
+		_, exists := registry.names[names[index]];
+		if (exists){
+			return fmt.Errorf("cliCommands: /%s is already registered", name);
+		}
+	}
+
+	registered := &command;
+	registry.commands = append(registry.commands, registered);
+	for _, name := range names{
+		registry.names[name] = registered;
+	}
+	return nil;
+}
+
+// LookupCommand returns the command with the given name or alias
+func LookupCommand(registry *CommandRegistry, name string) (*Command, bool){
+	command, exists := registry.names[strings.ToLower(name)];
+	return command, exists;
+}
+
+// GetCommands returns every registered command sorted by name
+func GetCommands(registry *CommandRegistry) ([]*Command){
+	commands := make([]*Command, len(registry.commands));
+	copy(commands, registry.commands);
+	sort.Slice(commands, func(i int, j int) (bool){
+		return commands[i].Name < commands[j].Name;
+	});
+	return commands;
+}
+
+// commandUsage returns how the command is typed, e.g. "/connect <address>"
+func commandUsage(command *Command) (string){
+	usage := CommandPrefix + command.Name;
+	if (command.Usage != ""){
+		usage += " " + command.Usage;
+	}
+	return usage;
+}
+
+// DefaultCommands returns a registry with the commands built into the CLI. It
+// only fails if two of the built in commands share a name
+func DefaultCommands() (*CommandRegistry, error){
+	registry := NewRegistry();
+	builtins := []Command{
+		{
+			Name: "help",
+			MaxArgs: 1,
+			Usage: "[command]",
+			Description: "Lists the commands or describes one of them",
+			Handler: helpCommand,
+			Complete: completeCommandNames,
+		},
+		{
+			Name: "quit",
+			Aliases: []string{"exit"},
+			Description: "Disconnects from every room and exits",
+			Handler: quitCommand,
+		},
+		{
+			Name: "connect",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Usage: "<address|alias> [password]",
+			Description: "Connects to a room by its address or saved alias",
+			Handler: connectCommand,
+			Complete: completeAliases,
+			Secret: 2,
+		},
+		{
+			Name: "nickname",
+			Aliases: []string{"nick"},
+			MinArgs: 1,
+			MaxArgs: 1,
+			Usage: "<nickname>",
+			Description: "Changes your nickname in the current room, quote it to use spaces",
+			Handler: nicknameCommand,
+		},
+		{
+			Name: "msg",
+			Aliases: []string{"whisper"},
+			MinArgs: 2,
+			MaxArgs: 2,
+			Usage: "<nickname> <message>",
+			Description: "Sends a message only to someone on the current room's server",
+			Handler: msgCommand,
+			Rest: true,
+		},
+		{
+			Name: "viewsaved",
+			Description: "Lists the saved rooms",
+			Handler: viewSavedCommand,
+		},
+		{
+			Name: "save",
+			MinArgs: 2,
+			MaxArgs: 3,
+			Usage: "<alias> <address> [password]",
+			Description: "Saves a room so it can be connected to by its alias",
+			Handler: saveCommand,
+			Complete: completeNothing,
+			Secret: 3,
+		},
+		{
+			Name: "unsave",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Usage: "<alias>",
+			Description: "Removes a saved room",
+			Handler: unsaveCommand,
+			Complete: completeAliases,
+		},
+		{
+			Name: "rename",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Usage: "<alias> <new alias>",
+			Description: "Changes the alias of a saved room",
+			Handler: renameCommand,
+			Complete: completeAliases,
+		},
+		{
+			Name: "autoconnect",
+			MinArgs: 2,
+			MaxArgs: 3,
+			Usage: "<alias> <on|off> [order]",
+			Description: "Sets whether a saved room is joined on start up and in what order, lowest first",
+			Handler: autoConnectCommand,
+			Complete: completeAliasThen("on", "off"),
+		},
+		{
+			Name: "roomnick",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Usage: "<alias> [nickname]",
+			Description: "Sets the nickname used in a saved room, or clears it to use the default",
+			Handler: roomNickCommand,
+			Complete: completeAliases,
+		},
+		{
+			Name: "setdefaultname",
+			MaxArgs: 1,
+			Usage: "[nickname]",
+			Description: "Changes the nickname used when joining rooms, or clears it",
+			Handler: setDefaultNameCommand,
+		},
+		{
+			Name: "discover",
+			MaxArgs: 3,
+			Usage: "[save <number> <alias>]",
+			Description: "Lists rooms found on the local network or saves one of them",
+			Handler: discoverCommand,
+			Complete: completeWords("save"),
+		},
+		{
+			Name: "export",
+			MinArgs: 1,
+			MaxArgs: AnyArgs,
+			Usage: exportUsage,
+			Description: "Saves what's been said in the current room to a file, in the format its extension gives",
+			Handler: exportCommand,
+			Complete: completeNothing,
+		},
+		{
+			Name: "members",
+			Description: "Lists who's in the current room, or shows and hides the list in full screen mode",
+			Handler: membersCommand,
+		},
+		{
+			Name: "loglevel",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Usage: "<debug|info|warn|error>",
+			Description: "Changes how much is written to the log",
+			Handler: logLevelCommand,
+			Complete: completeWords("debug", "info", "warn", "error"),
+		},
+	};
+	for _, command := range builtins{
+		err := RegisterCommand(registry, command);
+		if (err != nil){
+			return nil, err;
+		}
+	}
+	return registry, nil;
+}
+
+// completeCommandNames completes the first argument to a command name
+func completeCommandNames(state *CLIState, arg int) ([]string){
+	if (arg != 0){
+		return []string{};
+	}
+	names := []string{};
+	for _, command := range state.Commands.commands{
+		names = append(names, command.Name);
+	}
+	return names;
+}
+
+// completeAliases completes the first argument to a saved room's alias
+func completeAliases(state *CLIState, arg int) ([]string){
+	if (arg != 0){
+		return []string{};
+	}
+	return client.GetSavedAliases(state.Session);
+}
+
+// completeAliasThen returns a Complete that completes the first argument to a
+// saved room's alias and the second to one of words
+func completeAliasThen(words ...string) (func(state *CLIState, arg int) ([]string)){
+	return func(state *CLIState, arg int) ([]string){
+		switch arg{
+		case 0:{
+			return client.GetSavedAliases(state.Session);
+		}
+		case 1:{
+			return words;
+		}
+		}
+		return []string{};
+	};
+}
+
+// completeNothing is for commands whose arguments can't be completed
+func completeNothing(state *CLIState, arg int) ([]string){
+	return []string{};
+}
+
+// completeWords returns a Complete that completes the first argument to one
+// of words
+func completeWords(words ...string) (func(state *CLIState, arg int) ([]string)){
+	return func(state *CLIState, arg int) ([]string){
+		if (arg != 0){
+			return []string{};
+		}
+		return words;
+	};
+}
+
+func helpCommand(state *CLIState, args []string) (error){
+	if (len(args) == 1){
+		command, exists := LookupCommand(state.Commands, strings.TrimPrefix(args[0], CommandPrefix));
+		if (!exists){
+			return fmt.Errorf("Unknown command %s", args[0]);
+		}
+		fmt.Fprintf(state.Out, "%s\n", commandUsage(command));
+		if (len(command.Aliases) > 0){
+			fmt.Fprintf(state.Out, "  Also %s%s\n", CommandPrefix, strings.Join(command.Aliases, ", " + CommandPrefix));
+		}
+		fmt.Fprintf(state.Out, "  %s\n", command.Description);
+		return nil;
+	}
+
+	commands := GetCommands(state.Commands);
+	width := 0;
+	for _, command := range commands{
+		width = max(width, len(commandUsage(command)));
+	}
+	fmt.Fprint(state.Out, "Commands:\n");
+	for _, command := range commands{
+		fmt.Fprintf(state.Out, "  %-*s  %s\n", width, commandUsage(command), command.Description);
+	}
+	fmt.Fprintf(state.Out, "Anything else is sent as a message, start it with %s%s to send a message beginning with %s\n",
+		CommandPrefix, CommandPrefix, CommandPrefix);
+	return nil;
+}
+
+func quitCommand(state *CLIState, args []string) (error){
+	fmt.Fprint(state.Out, "Quitting\n");
+	state.quit = true;
+	return nil;
+}
+
+func connectCommand(state *CLIState, args []string) (error){
+	session := state.Session;
+	password := "";
+	if (len(args) > 1){
+		password = args[1];
+	}
+
+	aliasedAddr, err := client.GetSavedRoom(session, args[0]);
+	if (err != nil){
+		return fmt.Errorf("Unable to connect: %s", err);
+	}
+
+	if (aliasedAddr == ""){
+		fmt.Fprintf(state.Out, "Connecting to address\n");
+		_, err = client.Connect(session, args[0], password);
+	} else {
+		if (password == ""){
+			password = client.GetSavedRoomPassword(session, args[0]);
+		}
+		fmt.Fprintf(state.Out, "Connecting to alias %s, addr: %s\n", args[0], aliasedAddr);
+		_, err = client.Connect(session, aliasedAddr, password);
+	}
+	if (err != nil){
+		return fmt.Errorf("Unable to connect: %s", err);
+	}
+	return nil;
+}
+
+func nicknameCommand(state *CLIState, args []string) (error){
+	err := client.ChangeNickname(client.GetCurrentConnection(state.Session), args[0]);
+	if (err != nil){
+		return fmt.Errorf("Cannot change nickname: %s", err);
+	}
+	return nil;
+}
+
+func msgCommand(state *CLIState, args []string) (error){
+	message := args[1];
+	err := client.SendDirectMessage(client.GetCurrentConnection(state.Session), args[0], message);
+	if (err != nil){
+		return fmt.Errorf("Unable to send message: %s", err);
+	}
+	fmt.Fprintf(state.Out, "you -> %s %s : %s\n", args[0], time.Now().Format(time.Kitchen), message);
+	return nil;
+}
+
+func viewSavedCommand(state *CLIState, args []string) (error){
+	client.DisplaySavedAliases(state.Session, state.Out);
+	return nil;
+}
+
+func saveCommand(state *CLIState, args []string) (error){
+	password := "";
+	if (len(args) > 2){
+		password = args[2];
+	}
+	err := client.SaveRoom(state.Session, args[0], args[1], password);
+	if (err != nil){
+		return fmt.Errorf("Unable to save room: %s", err);
+	}
+	fmt.Fprintf(state.Out, "Saved %s as %s\n", args[1], args[0]);
+	return nil;
+}
+
+func unsaveCommand(state *CLIState, args []string) (error){
+	err := client.UnsaveRoom(state.Session, args[0]);
+	if (err != nil){
+		return fmt.Errorf("Unable to remove room: %s", err);
+	}
+	fmt.Fprintf(state.Out, "Removed %s\n", args[0]);
+	return nil;
+}
+
+func renameCommand(state *CLIState, args []string) (error){
+	err := client.RenameRoom(state.Session, args[0], args[1]);
+	if (err != nil){
+		return fmt.Errorf("Unable to rename room: %s", err);
+	}
+	fmt.Fprintf(state.Out, "Renamed %s to %s\n", args[0], args[1]);
+	return nil;
+}
+
+func autoConnectCommand(state *CLIState, args []string) (error){
+	var enabled bool;
+	switch strings.ToLower(args[1]){
+	case "on":{
+		enabled = true;
+	}
+	case "off":{
+		enabled = false;
+	}
+	default:{
+		return fmt.Errorf("Usage: %sautoconnect <alias> <on|off> [order]", CommandPrefix);
+	}
+	}
+	if (len(args) > 2){
+		order, err := strconv.Atoi(args[2]);
+		if (err != nil){
+			return fmt.Errorf("The order must be a number, not %s", args[2]);
+		}
+		err = client.SetRoomJoinOrder(state.Session, args[0], order);
+		if (err != nil){
+			return fmt.Errorf("Unable to change room: %s", err);
+		}
+	}
+	err := client.SetRoomAutoConnect(state.Session, args[0], enabled);
+	if (err != nil){
+		return fmt.Errorf("Unable to change room: %s", err);
+	}
+	if (enabled){
+		fmt.Fprintf(state.Out, "%s will be joined on start up\n", args[0]);
+	} else {
+		fmt.Fprintf(state.Out, "%s won't be joined on start up\n", args[0]);
+	}
+	return nil;
+}
+
+func roomNickCommand(state *CLIState, args []string) (error){
+	name := "";
+	if (len(args) > 1){
+		name = args[1];
+	}
+	err := client.SetRoomNickname(state.Session, args[0], name);
+	if (err != nil){
+		return fmt.Errorf("Unable to change room: %s", err);
+	}
+	if (name == ""){
+		fmt.Fprintf(state.Out, "%s will use the default nickname\n", args[0]);
+	} else {
+		fmt.Fprintf(state.Out, "%s will use the nickname %s from the next time it's joined\n", args[0], name);
+	}
+	return nil;
+}
+
+func setDefaultNameCommand(state *CLIState, args []string) (error){
+	name := "";
+	if (len(args) > 0){
+		name = args[0];
+	}
+	err := client.SetDefaultName(state.Session, name);
+	if (err != nil){
+		return fmt.Errorf("Unable to set default nickname: %s", err);
+	}
+	if (name == ""){
+		fmt.Fprint(state.Out, "Default nickname cleared, servers will choose one\n");
+	} else {
+		fmt.Fprintf(state.Out, "Default nickname set to %s\n", name);
+	}
+	if (state.Session.Nickname != ""){
+		fmt.Fprintf(state.Out, "This session keeps using %s from the command line\n", state.Session.Nickname);
+	}
+	return nil;
+}
+
+func discoverCommand(state *CLIState, args []string) (error){
+	if (len(args) == 0){
+		state.discovered = client.DisplayDiscoveredRooms(state.Session, state.Out);
+		return nil;
+	}
+	if ((len(args) != 3) || !strings.EqualFold(args[0], "save")){
+		return fmt.Errorf("Usage: %sdiscover [save <number> <alias>]", CommandPrefix);
+	}
+
+	// The numbers are the ones that were shown, even if a room has since
+	// stopped advertising
+	rooms := state.discovered;
+	if (rooms == nil){
+		return fmt.Errorf("No rooms listed yet, run %sdiscover first", CommandPrefix);
+	}
+	index, err := strconv.Atoi(args[1]);
+	if ((err != nil) || (index < 0) || (index >= len(rooms))){
+		return fmt.Errorf("No discovered room numbered %s", args[1]);
+	}
+	err = client.SaveRoom(state.Session, args[2], rooms[index].Addr, "");
+	if (err != nil){
+		return fmt.Errorf("Unable to save room: %s", err);
+	}
+	fmt.Fprintf(state.Out, "Saved %s as %s\n", rooms[index].Addr, args[2]);
+	return nil;
+}
+
+func exportCommand(state *CLIState, args []string) (error){
+	connection := client.GetCurrentConnection(state.Session);
+	if (connection == nil){
+		return fmt.Errorf("Not connected to a room");
+	}
+	format := client.TranscriptFormat(args[0]);
+	filter := client.TranscriptFilter{};
+	now := time.Now();
+	for _, option := range args[1:]{
+		key, value, found := strings.Cut(option, "=");
+		if (!found){
+			return fmt.Errorf("Usage: %sexport %s", CommandPrefix, exportUsage);
+		}
+		switch strings.ToLower(key){
+		case "format":{
+			format = strings.ToLower(value);
+		}
+		case "since", "until":{
+			parsed, err := client.ParseTranscriptTime(value, now);
+			if (err != nil){
+				return fmt.Errorf("Invalid %s: %s", key, err);
+			}
+			if (strings.EqualFold(key, "since")){
+				filter.Since = parsed;
+			} else {
+				filter.Until = parsed;
+			}
+		}
+		case "nick":{
+			filter.Nicknames = append(filter.Nicknames, strings.Split(value, ",")...);
+		}
+		default:{
+			return fmt.Errorf("Unknown option %s, expected format, since, until or nick", key);
+		}
+		}
+	}
+
+	entries := client.FilterTranscript(client.GetTranscript(connection), filter);
+	var buffer bytes.Buffer;
+	err := client.ExportTranscript(&buffer, entries, format);
+	if (err != nil){
+		return fmt.Errorf("Unable to export: %s", err);
+	}
+	err = os.WriteFile(args[0], buffer.Bytes(), 0600);
+	if (err != nil){
+		return fmt.Errorf("Unable to export: %s", err);
+	}
+	fmt.Fprintf(state.Out, "Exported %d entries to %s\n", len(entries), args[0]);
+	return nil;
+}
+
+func membersCommand(state *CLIState, args []string) (error){
+	full, isFull := state.term.(*fullTerminal);
+	if (isFull){
+		full.toggleMembers();
+		return nil;
+	}
+
+	connection := client.GetCurrentConnection(state.Session);
+	if (!client.IsConnected(connection)){
+		return fmt.Errorf("Not connected to a room");
+	}
+	members := client.GetMembers(connection);
+	fmt.Fprintf(state.Out, "%d in the room: %s\n", len(members), strings.Join(members, ", "));
+	return nil;
+}
+
+func logLevelCommand(state *CLIState, args []string) (error){
+	if (state.LogLevel == nil){
+		return fmt.Errorf("The log level can't be changed from here");
+	}
+	level, err := common.ParseLogLevel(args[0]);
+	if (err != nil){
+		return err;
+	}
+	state.LogLevel.Set(level);
+	fmt.Fprintf(state.Out, "Log level set to %s\n", level);
+	return nil;
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"bytes"
+	"p2psystem/client"
+	"testing"
+)
+
+func TestDefaultCommandsRegister(t *testing.T){
+	registry, err := DefaultCommands();
+	if (err != nil){
+		t.Fatalf("built in commands clash: %s", err);
+	}
+	if (registry.names["help"] == nil){
+		t.Errorf("/help isn't registered");
+	}
+
+	err = RegisterCommand(registry, Command{Name: "HELP", Handler: helpCommand});
+	if (err == nil){
+		t.Errorf("expected a second /help to be refused");
+	}
+}
+
+func TestMsgKeepsTheMessageAsTyped(t *testing.T){
+	registry, err := DefaultCommands();
+	if (err != nil){
+		t.Fatalf("built in commands clash: %s", err);
+	}
+	tests := []struct{
+		line string;
+		nickname string;
+		message string;
+	}{
+		{"/msg bob it's fine", "bob", "it's fine"},
+		{"/msg bob   lots   of  spaces ", "bob", "lots   of  spaces "},
+		{"/whisper 'bob smith' \"quoted\" and \\escaped", "bob smith", "\"quoted\" and \\escaped"},
+	};
+	for _, test := range tests{
+		parseResult, err := ParseLine(registry, test.line);
+		if (err != nil){
+			t.Errorf("%q: %s", test.line, err);
+			continue;
+		}
+		if ((len(parseResult.Args) != 2) || (parseResult.Args[0] != test.nickname) || (parseResult.Args[1] != test.message)){
+			t.Errorf("%q: got %q, expected %q then %q", test.line, parseResult.Args, test.nickname, test.message);
+		}
+	}
+
+	_, err = ParseLine(registry, "/msg bob   ");
+	if (err == nil){
+		t.Errorf("expected /msg without a message to be refused");
+	}
+}
+
+func TestDiscoverSaveUsesTheListedNumbers(t *testing.T){
+	session := newSession(t);
+	state := &CLIState{Session: session, Out: &bytes.Buffer{}};
+	err := discoverCommand(state, []string{"save", "0", "home"});
+	if (err == nil){
+		t.Errorf("expected saving before /discover to be refused");
+	}
+
+	// Nothing is being heard any more, so the rooms have all expired since
+	// they were listed
+	state.discovered = []client.DiscoveredRoom{{Addr: "10.0.0.1:9000"}, {Addr: "10.0.0.2:9000"}};
+	err = discoverCommand(state, []string{"save", "1", "home"});
+	if (err != nil){
+		t.Fatalf("unable to save a listed room: %s", err);
+	}
+	addr, err := client.GetSavedRoom(session, "home");
+	if ((err != nil) || (addr != "10.0.0.2:9000")){
+		t.Errorf("saved %q, expected 10.0.0.2:9000", addr);
+	}
+	err = discoverCommand(state, []string{"save", "2", "work"});
+	if (err == nil){
+		t.Errorf("expected a number that wasn't listed to be refused");
+	}
+
+	err = discoverCommand(state, []string{});
+	if ((err != nil) || (len(state.discovered) != 0)){
+		t.Errorf("got %v and %d rooms from listing nothing", err, len(state.discovered));
+	}
+}
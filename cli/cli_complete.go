@@ -0,0 +1,163 @@
+package cli
+
+// Tab completion of commands, their arguments and nicknames in the room
+
+import (
+	"p2psystem/client"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// quoteArg quotes arg if it wouldn't be read back by SplitArgs as one argument
+func quoteArg(arg string) (string){
+	if ((arg != "") && !strings.ContainsAny(arg, " \t\"'\\")){
+		return arg;
+	}
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(arg) + "\"";
+}
+
+// wordStart returns where the word ending at the end of text starts. Quotes
+// are followed so a quoted argument with spaces in it is one word
+func wordStart(text []rune) (int){
+	start := 0;
+	var quote rune = 0;
+	escaped := false;
+	for index, char := range text{
+		switch {
+		case escaped:{
+			escaped = false;
+		}
+		case ((char == '\\') && (quote != '\'')):{
+			escaped = true;
+		}
+		case (quote != 0):{
+			if (char == quote){
+				quote = 0;
+			}
+		}
+		case ((char == '"') || (char == '\'')):{
+			quote = char;
+		}
+		case unicode.IsSpace(char):{
+			start = index + 1;
+		}
+		}
+	}
+	return start;
+}
+
+// commonPrefix returns the longest prefix, ignoring case, that all of
+// candidates start with, as it's written in the first of them
+func commonPrefix(candidates []string) (string){
+	prefix := []rune(candidates[0]);
+	for _, candidate := range candidates[1:]{
+		runes := []rune(candidate);
+		length := 0;
+		for ((length < len(prefix)) && (length < len(runes)) &&
+			(unicode.ToLower(prefix[length]) == unicode.ToLower(runes[length]))){
+			length++;
+		}
+		prefix = prefix[:length];
+	}
+	return string(prefix);
+}
+
+// memberNames returns the nicknames in the current room
+func memberNames(state *CLIState) ([]string){
+	return client.GetMembers(client.GetCurrentConnection(state.Session));
+}
+
+// completeInput completes the word before the cursor. The first word of a
+// command completes to a command name, its arguments to whatever the command's
+// Complete returns and anything else to the nicknames in the room
+func completeInput(state *CLIState, input []rune, cursor int) ([]rune, int, []string){
+	before := input[:cursor];
+	start := wordStart(before);
+	word := string(before[start:]);
+	line := string(before);
+	isCommand := (strings.HasPrefix(line, CommandPrefix) && !strings.HasPrefix(line, CommandPrefix + CommandPrefix));
+
+	var options []string;
+	quote := false;
+	switch {
+	case (isCommand && (start == 0)):{
+		for name := range state.Commands.names{
+			options = append(options, CommandPrefix + name);
+		}
+	}
+	case isCommand:{
+		text := string(before[len([]rune(CommandPrefix)):]);
+		name, err := splitArgs(text, 2);
+		if ((err != nil) || (len(name) == 0)){
+			return input, cursor, nil;
+		}
+		command, exists := LookupCommand(state.Commands, name[0]);
+		if (!exists){
+			return input, cursor, nil;
+		}
+		if (command.Rest){
+			// The rest of the line is completed like a message since it's
+			// sent as it's typed
+			args, err := splitArgs(text, command.MaxArgs + 1);
+			if ((err == nil) && (len(args) == command.MaxArgs + 1)){
+				start = strings.LastIndexAny(line, " \t") + 1;
+				start = len([]rune(line[:start]));
+				word = string(before[start:]);
+				options = memberNames(state);
+				break;
+			}
+		}
+		args, err := SplitArgs(string(before[len([]rune(CommandPrefix)):start]));
+		if ((err != nil) || (len(args) == 0)){
+			return input, cursor, nil;
+		}
+		if (command.Complete != nil){
+			options = command.Complete(state, len(args) - 1);
+		} else {
+			options = memberNames(state);
+		}
+		quote = !(command.Rest && (len(args) == command.MaxArgs));
+		word = strings.TrimLeft(word, "\"'");
+	}
+	default:{
+		options = memberNames(state);
+	}
+	}
+
+	matches := []string{};
+	seen := map[string]bool{};
+	for _, option := range options{
+		if (!seen[option] && strings.HasPrefix(strings.ToLower(option), strings.ToLower(word))){
+			matches = append(matches, option);
+			seen[option] = true;
+		}
+	}
+	if (len(matches) == 0){
+		return input, cursor, nil;
+	}
+	sort.Strings(matches);
+
+	var replacement string;
+	if (len(matches) == 1){
+		replacement = matches[0];
+		if (quote){
+			replacement = quoteArg(replacement);
+		}
+		replacement += " ";
+	} else {
+		replacement = commonPrefix(matches);
+		if (len([]rune(replacement)) <= len([]rune(word))){
+			// Nothing more can be filled in so show what it could be instead
+			return input, cursor, matches;
+		}
+		if (quote && (quoteArg(replacement) != replacement)){
+			// Leave the quote open so the rest can still be typed or completed
+			quoted := quoteArg(replacement);
+			replacement = quoted[:len(quoted) - 1];
+		}
+	}
+
+	completed := append(append(append([]rune{}, input[:start]...), []rune(replacement)...), input[cursor:]...);
+	return completed, start + len([]rune(replacement)), matches;
+}
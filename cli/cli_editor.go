@@ -0,0 +1,244 @@
+package cli
+
+// Readline style editing of the line being typed, used by the full screen
+// interface and by line mode on a terminal
+
+import (
+	"bufio"
+	"unicode"
+)
+
+// completer returns the input with the word before the cursor completed and
+// the cursor's new position, along with every candidate if there was more
+// than one
+type completer func(input []rune, cursor int) ([]rune, int, []string);
+
+// lineEditor is the line being typed and where the cursor is in it
+type lineEditor struct{
+	input []rune;
+	cursor int;
+	history *inputHistory;
+	// browsing is how far back in the history the up arrow has gone, 0 while
+	// editing a new line. draft is that new line so the down arrow can get
+	// back to it
+	browsing int;
+	draft []rune;
+	complete completer;
+}
+
+// Control keys the editor understands
+const (
+	keyCtrlA = 1;
+	keyCtrlB = 2;
+	keyCtrlE = 5;
+	keyCtrlF = 6;
+	keyTab = 9;
+	keyCtrlK = 11;
+	keyCtrlN = 14;
+	keyCtrlP = 16;
+	keyCtrlW = 23;
+)
+
+// Keys that aren't characters are read as negative runes
+const (
+	keyUnknown rune = -(iota + 1);
+	keyUp;
+	keyDown;
+	keyLeft;
+	keyRight;
+	keyHome;
+	keyEnd;
+	keyDelete;
+	keyPageUp;
+	keyPageDown;
+)
+
+const (
+	keyCtrlC = 3;
+	keyCtrlD = 4;
+	keyCtrlL = 12;
+	keyEnter = '\r';
+	keyCtrlU = 21;
+	keyEscape = 27;
+	keyBackspace = 127;
+)
+
+func newLineEditor(history *inputHistory, complete completer) (*lineEditor){
+	return &lineEditor{input: []rune{}, history: history, complete: complete};
+}
+
+// setInput replaces the line and moves the cursor to its end
+func (editor *lineEditor) setInput(input []rune){
+	editor.input = append([]rune{}, input...);
+	editor.cursor = len(editor.input);
+}
+
+// finish returns the line that was entered and starts a new one
+func (editor *lineEditor) finish() (string){
+	line := string(editor.input);
+	editor.input = []rune{};
+	editor.cursor = 0;
+	editor.browsing = 0;
+	editor.draft = nil;
+	return line;
+}
+
+// handleKey changes the line for the given key. It returns the candidates
+// when a completion has more than one, and false if the key isn't one it
+// edits with
+func (editor *lineEditor) handleKey(key rune) ([]string, bool){
+	switch key{
+	case keyLeft, keyCtrlB:{
+		editor.cursor = max(editor.cursor - 1, 0);
+	}
+	case keyRight, keyCtrlF:{
+		editor.cursor = min(editor.cursor + 1, len(editor.input));
+	}
+	case keyHome, keyCtrlA:{
+		editor.cursor = 0;
+	}
+	case keyEnd, keyCtrlE:{
+		editor.cursor = len(editor.input);
+	}
+	case keyBackspace:{
+		if (editor.cursor > 0){
+			editor.input = append(editor.input[:editor.cursor - 1], editor.input[editor.cursor:]...);
+			editor.cursor--;
+		}
+	}
+	case keyDelete, keyCtrlD:{
+		if (editor.cursor < len(editor.input)){
+			editor.input = append(editor.input[:editor.cursor], editor.input[editor.cursor + 1:]...);
+		}
+	}
+	case keyCtrlK:{
+		editor.input = editor.input[:editor.cursor];
+	}
+	case keyCtrlU:{
+		editor.input = append([]rune{}, editor.input[editor.cursor:]...);
+		editor.cursor = 0;
+	}
+	case keyCtrlW:{
+		// Delete back to the start of the word, skipping any spaces first
+		start := editor.cursor;
+		for ((start > 0) && unicode.IsSpace(editor.input[start - 1])){
+			start--;
+		}
+		for ((start > 0) && !unicode.IsSpace(editor.input[start - 1])){
+			start--;
+		}
+		editor.input = append(editor.input[:start], editor.input[editor.cursor:]...);
+		editor.cursor = start;
+	}
+	case keyUp, keyCtrlP:{
+		if ((editor.history == nil) || (editor.browsing >= len(editor.history.entries))){
+			break;
+		}
+		if (editor.browsing == 0){
+			editor.draft = append([]rune{}, editor.input...);
+		}
+		editor.browsing++;
+		editor.setInput([]rune(historyLine(editor.history, editor.browsing)));
+	}
+	case keyDown, keyCtrlN:{
+		if (editor.browsing == 0){
+			break;
+		}
+		editor.browsing--;
+		if (editor.browsing == 0){
+			editor.setInput(editor.draft);
+		} else {
+			editor.setInput([]rune(historyLine(editor.history, editor.browsing)));
+		}
+	}
+	case keyTab:{
+		if (editor.complete == nil){
+			break;
+		}
+		input, cursor, candidates := editor.complete(editor.input, editor.cursor);
+		editor.input = input;
+		editor.cursor = cursor;
+		return candidates, true;
+	}
+	default:{
+		if ((key <= 0) || unicode.IsControl(key)){
+			return nil, false;
+		}
+		editor.input = append(editor.input[:editor.cursor], append([]rune{key}, editor.input[editor.cursor:]...)...);
+		editor.cursor++;
+	}
+	}
+	return nil, true;
+}
+
+// window returns the part of the line that fits in width columns, scrolled
+// to keep the cursor in view, and the column the cursor is in within it.
+// Columns are counted by display width so wide characters take up two
+func (editor *lineEditor) window(width int) ([]rune, int){
+	offset := 0;
+	for (displayWidth(editor.input[offset:editor.cursor]) > width){
+		offset++;
+	}
+	input := editor.input[offset:];
+	input = input[:cutWidth(input, width)];
+	return input, displayWidth(editor.input[offset:editor.cursor]);
+}
+
+// readKey reads a single key press. Escape sequences for keys like the arrows
+// are returned as one of the negative key constants
+func readKey(reader *bufio.Reader) (rune, error){
+	char, _, err := reader.ReadRune();
+	if (err != nil){
+		return 0, err;
+	}
+	switch char{
+	case '\n':{
+		return keyEnter, nil;
+	}
+	case 8:{
+		return keyBackspace, nil;
+	}
+	case keyEscape:{
+		// Terminals write a whole sequence at once, so an escape on its own is
+		// just the escape key
+		if (reader.Buffered() == 0){
+			return keyEscape, nil;
+		}
+	}
+	default:{
+		return char, nil;
+	}
+	}
+
+	introducer, err := reader.ReadByte();
+	if (err != nil){
+		return 0, err;
+	}
+	if ((introducer != '[') && (introducer != 'O')){
+		return keyUnknown, nil;
+	}
+	var sequence []byte;
+	for {
+		next, err := reader.ReadByte();
+		if (err != nil){
+			return 0, err;
+		}
+		sequence = append(sequence, next);
+		if ((next >= 0x40) && (next <= 0x7e)){
+			break;
+		}
+	}
+
+	switch string(sequence){
+	case "A": return keyUp, nil;
+	case "B": return keyDown, nil;
+	case "C": return keyRight, nil;
+	case "D": return keyLeft, nil;
+	case "H", "1~", "7~": return keyHome, nil;
+	case "F", "4~", "8~": return keyEnd, nil;
+	case "3~": return keyDelete, nil;
+	case "5~": return keyPageUp, nil;
+	case "6~": return keyPageDown, nil;
+	}
+	return keyUnknown, nil;
+}
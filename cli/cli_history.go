@@ -0,0 +1,136 @@
+package cli
+
+// Keeps the lines the user has entered so they can be recalled with the up
+// arrow, including ones from earlier sessions
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// HistorySize is the number of lines kept in the history and its file
+const HistorySize = 500;
+
+// historyEntry is a line that was entered. saved is what's written to the
+// history file, which has any secrets left out, and is blank if the line
+// isn't saved at all
+type historyEntry struct{
+	line string;
+	saved string;
+}
+
+// inputHistory is the lines entered, oldest first
+type inputHistory struct{
+	entries []historyEntry;
+	path string;		// The file lines are saved to, blank if they aren't
+	lines int;			// Lines in the file, used to tell when it needs trimming
+}
+
+// loadHistory reads the history saved at path. A missing file is an empty
+// history and a blank path is one that's never saved
+func loadHistory(path string) (*inputHistory, error){
+	history := &inputHistory{entries: []historyEntry{}, path: path};
+	if (path == ""){
+		return history, nil;
+	}
+
+	file, err := os.Open(path);
+	if (os.IsNotExist(err)){
+		return history, nil;
+	}
+	if (err != nil){
+		return history, fmt.Errorf("cliHistory.loadHistory: %s", err);
+	}
+	defer file.Close();
+
+	scanner := bufio.NewScanner(file);
+	for (scanner.Scan()){
+		if (scanner.Text() != ""){
+			history.entries = append(history.entries, historyEntry{line: scanner.Text(), saved: scanner.Text()});
+			history.lines++;
+		}
+	}
+	if (scanner.Err() != nil){
+		return history, fmt.Errorf("cliHistory.loadHistory: %s", scanner.Err());
+	}
+	if (len(history.entries) > HistorySize){
+		history.entries = history.entries[len(history.entries) - HistorySize:];
+	}
+	return history, nil;
+}
+
+// historyLine returns the line index entries back from the newest
+func historyLine(history *inputHistory, index int) (string){
+	return history.entries[len(history.entries) - index].line;
+}
+
+// addHistory adds line to the history unless it's the same as the last one.
+// saved is what's written to the history file in its place, or blank to keep
+// it out of the file
+func addHistory(history *inputHistory, line string, saved string){
+	if ((line == "") || ((len(history.entries) > 0) && (historyLine(history, 1) == line))){
+		return;
+	}
+	history.entries = append(history.entries, historyEntry{line: line, saved: saved});
+	if (len(history.entries) > HistorySize){
+		history.entries = history.entries[len(history.entries) - HistorySize:];
+	}
+	if ((history.path == "") || (saved == "")){
+		return;
+	}
+
+	// Appending is cheap, so the file is only rewritten once it's grown to
+	// twice the size that's kept
+	if (history.lines >= HistorySize * 2){
+		writeHistory(history);
+		return;
+	}
+	file, err := os.OpenFile(history.path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0600);
+	if (err != nil){
+		return;
+	}
+	defer file.Close();
+	_, err = fmt.Fprintln(file, saved);
+	if (err == nil){
+		history.lines++;
+	}
+}
+
+// writeHistory replaces the history file with the lines kept in memory
+func writeHistory(history *inputHistory){
+	var contents strings.Builder;
+	lines := 0;
+	for _, entry := range history.entries{
+		if (entry.saved != ""){
+			contents.WriteString(entry.saved + "\n");
+			lines++;
+		}
+	}
+
+	temp := history.path + ".tmp";
+	err := os.WriteFile(temp, []byte(contents.String()), 0600);
+	if (err != nil){
+		return;
+	}
+	if (os.Rename(temp, history.path) == nil){
+		history.lines = lines;
+	}
+}
+
+// savedLine returns line as it's written to the history file, with the
+// command's secret argument left out
+func savedLine(parseResult CLIParse, line string) (string){
+	command := parseResult.Command;
+	if ((command == nil) || (command.Secret == 0) || (len(parseResult.Args) < command.Secret)){
+		return line;
+	}
+	words := []string{CommandPrefix + parseResult.Name};
+	for index, arg := range parseResult.Args{
+		if ((index + 1) != command.Secret){
+			words = append(words, quoteArg(arg));
+		}
+	}
+	return strings.Join(words, " ");
+}
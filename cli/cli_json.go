@@ -0,0 +1,95 @@
+package cli
+
+// Writes everything the CLI would print as one JSON object per line so other
+// programs can read the client's output without parsing text meant for people
+
+import (
+	"encoding/json"
+	"io"
+	"p2psystem/client"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// OutputText prints events for people to read
+	OutputText = "text";
+	// OutputJSON prints every event as a JSON object on its own line
+	OutputJSON = "json";
+)
+
+// JSONEvent is a line of JSON output. Type is one of the client's event types
+// ("connect", "message", "direct", "announcement", "kick", "disconnect",
+// "nickname" or "members") or "error" for a command that failed and "output"
+// for anything else a command printed
+type JSONEvent struct{
+	Type string `json:"type"`;
+	Room string `json:"room"`;			// The address of the server
+	Nickname string `json:"nickname"`;
+	Timestamp string `json:"timestamp"`;	// RFC 3339
+	Text string `json:"text"`;
+	Members []string `json:"members,omitempty"`;
+}
+
+// jsonOutput writes JSON lines to out. It's also an io.Writer that turns each
+// line written to it into an "output" event, so commands can print to it as
+// they would to a terminal
+type jsonOutput struct{
+	out io.Writer;
+	lock sync.Mutex;
+	partial string;		// Output that hasn't been ended with a newline yet
+}
+
+func newJSONOutput(out io.Writer) (*jsonOutput){
+	return &jsonOutput{out: out};
+}
+
+// writeRecord writes record as a line. The lock must be held
+func (output *jsonOutput) writeRecord(record JSONEvent){
+	if (record.Timestamp == ""){
+		record.Timestamp = time.Now().Format(time.RFC3339);
+	}
+	// Encode writes the newline and leaves < and > alone, unlike Marshal
+	encoder := json.NewEncoder(output.out);
+	encoder.SetEscapeHTML(false);
+	encoder.Encode(record);
+}
+
+// writeEvent writes an event from the session
+func (output *jsonOutput) writeEvent(event client.Event){
+	output.lock.Lock();
+	defer output.lock.Unlock();
+	output.writeRecord(JSONEvent{
+		Type: event.Type.String(),
+		Room: event.Addr,
+		Nickname: event.Nickname,
+		Timestamp: event.Timestamp.Format(time.RFC3339),
+		Text: event.Text,
+		Members: event.Members,
+	});
+}
+
+// writeError writes an "error" event for err on the connection
+func (output *jsonOutput) writeError(connection *client.ClientConnection, err error){
+	room := "";
+	if (connection != nil){
+		room = client.GetAddr(connection);
+	}
+	output.lock.Lock();
+	defer output.lock.Unlock();
+	output.writeRecord(JSONEvent{Type: "error", Room: room, Text: err.Error()});
+}
+
+// Write turns every complete line in p into an "output" event
+func (output *jsonOutput) Write(p []byte) (int, error){
+	output.lock.Lock();
+	defer output.lock.Unlock();
+
+	split := strings.Split(output.partial + string(p), "\n");
+	output.partial = split[len(split) - 1];
+	for _, line := range split[:len(split) - 1]{
+		output.writeRecord(JSONEvent{Type: "output", Text: line});
+	}
+	return len(p), nil;
+}
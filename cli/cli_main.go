@@ -1,81 +1,210 @@
 package cli
 
 import (
-	"bufio"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"p2psystem/client"
-	"p2psystem/server"
 	"strings"
+	"time"
 )
 
+// printEvent writes an event from the session to out
+func printEvent(out io.Writer, event client.Event){
+	switch event.Type{
+	case client.EventConnect:{
+		fmt.Fprintf(out, "Connected to %s\n", event.Addr);
+	}
+	case client.EventMessage:{
+		fmt.Fprintf(out, "%s %s : %s\n", event.Nickname, event.Timestamp.Format(time.Kitchen), event.Text);
+	}
+	case client.EventDirectMessage:{
+		fmt.Fprintf(out, "%s -> you %s : %s\n", event.Nickname, event.Timestamp.Format(time.Kitchen), event.Text);
+	}
+	case client.EventAnnouncement, client.EventKick:{
+		fmt.Fprintf(out, "Server %s: %s\n", event.Timestamp.Format(time.Kitchen), event.Text);
+	}
+	case client.EventDisconnect:{
+		fmt.Fprintf(out, "Disconnected from %s\n", event.Addr);
+	}
+	}
+}
+
+// CLIOptions are used by Run to set up the CLI
+type CLIOptions struct{
+	// LogLevel is changed by /loglevel, which is refused if it's nil
+	LogLevel *slog.LevelVar;
+	// Commands are the commands the CLI understands, DefaultCommands if nil
+	Commands *CommandRegistry;
+	// UI is UIAuto, UIFull or UILine. Blank is the same as UIAuto
+	UI string;
+	// ShowMembers starts the full screen interface with the member list shown
+	ShowMembers bool;
+	// HistoryPath is the file entered lines are saved to so they can be
+	// recalled in later sessions. Blank keeps them for this session only
+	HistoryPath string;
+	// Output is OutputText or OutputJSON. Blank is the same as OutputText.
+	// JSON is always read a line at a time
+	Output string;
+	// AutoConnect joins the saved rooms marked AutoConnect before the first
+	// line is read
+	AutoConnect bool;
+}
+
+// CLIState is what command handlers are given to act on
+type CLIState struct{
+	Session *client.ClientSession;
+	LogLevel *slog.LevelVar;
+	Commands *CommandRegistry;
+	// Out is where commands write their output. In the full screen interface
+	// anything written to stdout instead would be drawn over
+	Out io.Writer;
+	term terminal;
+	json *jsonOutput;	// Only set when writing JSON
+	batch *batchState;	// Only set while running a script
+	// discovered are the rooms last listed by /discover, in the order they
+	// were numbered
+	discovered []client.DiscoveredRoom;
+	quit bool;		// Set once the CLI should stop reading input
+}
+
 /**
-Initialises the CLI for the p2p system
+Initialises the CLI for the p2p system with the built in commands and reads
+commands from stdin until the user quits or stdin is closed. Events from
+session are printed as they arrive. logLevel is changed by /loglevel
 */
-func Init(){
-	fmt.Print("CLI initialised\n");
-	var stdinStr string;
-	var err error;
-	reader := bufio.NewReader(os.Stdin);
-	brk := false;
-	for (true){
-		stdinStr, err = reader.ReadString('\n');
-		if (err == io.EOF){break;}
-		// Strip out the newline at the end
-		if (stdinStr[len(stdinStr) - 1] == '\n'){
-			stdinStr = strings.Replace(stdinStr, "\n", "", -1);
-		}
+func Init(session *client.ClientSession, logLevel *slog.LevelVar){
+	Run(session, CLIOptions{LogLevel: logLevel});
+}
 
-		var parseResult CLIParse = ParseStr(stdinStr);
-		session := client.GetSession();
+// printError tells the user that something failed
+func printError(state *CLIState, err error){
+	if (state.json != nil){
+		state.json.writeError(client.GetCurrentConnection(state.Session), err);
+		return;
+	}
+	fmt.Fprintf(state.Out, "%s\n", err);
+}
 
-		switch parseResult.CmdType{
-		case MSG: {
-			//delStr := strings.Repeat("\b", len(stdinStr) + 1);
-			//fmt.Printf("%s",delStr);
-			fmt.Print("\033[F");
-			client.SendMessage(session.CurrentConnection, stdinStr);
+// autoConnect joins the saved rooms marked AutoConnect and reports the ones
+// that couldn't be joined
+func autoConnect(state *CLIState){
+	results := client.AutoConnect(state.Session);
+	if (len(results) == 0){
+		return;
+	}
+	joined := 0;
+	for _, result := range results{
+		if (result.Err != nil){
+			printError(state, fmt.Errorf("Unable to connect to %s (%s): %s", result.Alias, result.Addr, result.Err));
+			continue;
 		}
-		case Quit: {
-			fmt.Print("Quitting\n");
-			brk = true;
+		joined++;
+	}
+	current := client.GetCurrentConnection(state.Session);
+	if (joined > 0){
+		fmt.Fprintf(state.Out, "Joined %d of %d saved rooms, the current room is %s\n",
+			joined, len(results), client.GetAddr(current));
+	}
+}
+
+// Run is the same as Init but lets the commands and the interface be chosen
+func Run(session *client.ClientSession, options CLIOptions){
+	registry := options.Commands;
+	if (registry == nil){
+		var err error;
+		registry, err = DefaultCommands();
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Unable to start the CLI: %s\n", err);
+			return;
 		}
-		case Connect: {			
-			aliasedAddr, err := client.GetSavedRoom(session, parseResult.address);
+	}
 
-			if (err != nil){
-				fmt.Printf("cliMain: unable to parse /connect: %s", err);
-				return;
-			}
+	state := &CLIState{
+		Session: session,
+		LogLevel: options.LogLevel,
+		Commands: registry,
+	};
+	history, historyErr := loadHistory(options.HistoryPath);
+	editor := newLineEditor(history, func(input []rune, cursor int) ([]rune, int, []string){
+		return completeInput(state, input, cursor);
+	});
 
-			if (aliasedAddr == ""){
-				fmt.Printf("Connecting to address\n");
-				client.Connect(parseResult.address);
-			} else {
-				fmt.Printf("Connecting to alias %s, addr: %s\n", parseResult.address, aliasedAddr);
-				client.Connect(aliasedAddr)
-			}
+	var term terminal;
+	ui, err := ResolveUI(options.UI);
+	if (options.Output == OutputJSON){
+		state.json = newJSONOutput(os.Stdout);
+		term = newLineTerminal(os.Stdin, state.json, false);
+	} else if (err != nil){
+		fmt.Printf("%s, using %s\n", err, UILine);
+	} else if (ui == UIFull){
+		full, err := newFullTerminal(session, os.Stdin, os.Stdout, editor, options.ShowMembers);
+		if (err != nil){
+			fmt.Printf("Unable to start the full screen interface, using %s: %s\n", UILine, err);
+		} else {
+			term = full;
 		}
-		case ViewSaved:{
-			client.DisplaySavedAliases(session);
+	}
+	// Lines are only edited here on a terminal that understands escape codes,
+	// pipes and dumb terminals are read as they are
+	if ((term == nil) && interactive()){
+		restore, err := makeRaw(os.Stdin);
+		if (err != nil){
+			fmt.Printf("Unable to edit lines, reading them as they're typed: %s\n", err);
+		} else {
+			term = newEditingTerminal(os.Stdin, os.Stdout, editor, restore);
 		}
+	}
+	if (term == nil){
+		term = newLineTerminal(os.Stdin, os.Stdout, interactive());
+	}
+	defer term.Close();
 
-		case Nickname: {
-			client.ChangeNickname(session.CurrentConnection, parseResult.info);
-		}
-		default:{
-			fmt.Print("Invalid command\n");
+	client.AddHandler(session, client.EventHandlerFunc(func(event client.Event){
+		if (state.json != nil){
+			state.json.writeEvent(event);
+			return;
 		}
+		printEvent(term, event);
+	}));
+	fmt.Fprint(term, "CLI initialised\n");
+	state.Out = term;
+	state.term = term;
+	if (historyErr != nil){
+		printError(state, fmt.Errorf("Unable to load input history: %s", historyErr));
+	}
+	if (options.AutoConnect){
+		autoConnect(state);
+		term.Refresh();
+	}
+	for (!state.quit){
+		stdinStr, err := term.ReadLine();
+		if (err != nil){break;}
+		if (strings.TrimSpace(stdinStr) == ""){
+			continue;
 		}
-		if (brk){
-			break;
+
+		parseResult, err := ParseLine(registry, stdinStr);
+		addHistory(history, stdinStr, savedLine(parseResult, stdinStr));
+		if (err != nil){
+			printError(state, err);
+			continue;
 		}
-	}
-	// Shutdown the client by disconnecting from all servers
-	client.DisconnectAll(client.GetSession());
-	server.Shutdown(server.GetServerRoom());
 
-	client.WriteConfig(client.GetSession(), "config");
+		if (parseResult.Command == nil){
+			term.SendingMessage();
+			err = client.SendMessage(client.GetCurrentConnection(session), parseResult.Message);
+			if (err != nil){
+				printError(state, fmt.Errorf("Unable to send message: %s", err));
+			}
+			continue;
+		}
 
-}
\ No newline at end of file
+		err = parseResult.Command.Handler(state, parseResult.Args);
+		if (err != nil){
+			printError(state, err);
+		}
+		term.Refresh();
+	}
+}
@@ -5,95 +5,137 @@ import (
 	"strings"
 )
 
-/**
-Each enum represents the parsed action to be taken from the given command.
-All commands must have is 0th character be '/'
-	- MSG			: Any inputs that isn't prepended with a /
-	- Unknown 		: The input is an unrecognized command
-	- Quit 			: The CLI input should stop and the application should shutdown
-	- Connect 		: Connect to a given address and port in the format address:port
-	- Disconnect 	:
-	- Nickname		: Signals to the connected server to change the nickname of the client
-	- ViewSaved		: Displays all saved servers
-*/
-const (
-	MSG int = -2
-	Unknown int = -1
-	Quit int = 0
-	Connect int = 1
-	Disconnect int  = 2
-	Nickname int = 3
-	ViewSaved int = 4
-
-)
+// CommandPrefix starts every line that's a command rather than a message. A
+// message that should start with it is typed with the prefix twice
+const CommandPrefix = "/";
 
 // A struct containing the information associated with the string that we
-// interpreted as a command
+// interpreted from a line of input
 type CLIParse struct {
-	CmdType int;
-	address string;
-	info string;
+	// Message is the text to send when the line isn't a command
+	Message string;
+	// Command is the registered command the line runs, nil for messages
+	Command *Command;
+	Name string;		// The command as it was typed, without the prefix
+	Args []string;
 }
 
-// Given the input string, return a constant representing the command type
-func ParseStr(cmdStr string) CLIParse{
-	var retVal CLIParse;
-	retVal.CmdType = Unknown;
+// SplitArgs splits str into arguments on whitespace. Double or single quotes
+// group words containing spaces into one argument and a backslash escapes the
+// next character outside single quotes
+func SplitArgs(str string) ([]string, error){
+	return splitArgs(str, AnyArgs);
+}
 
-	if (cmdStr == ""){
-		return retVal;
-	}
+// splitArgs is SplitArgs that stops at limit arguments, the last of them
+// being the rest of str exactly as it was typed. AnyArgs doesn't stop
+func splitArgs(str string, limit int) ([]string, error){
+	args := []string{};
+	var current strings.Builder;
+	// inArg is true once anything, even an empty pair of quotes, has started
+	// an argument
+	inArg := false;
+	var quote rune = 0;
+	escaped := false;
 
-	if (cmdStr[0] != '/'){
-		retVal.CmdType = MSG;
-		return retVal;
+	for index, char := range str{
+		if (!inArg && (limit != AnyArgs) && (len(args) == limit - 1) && (char != ' ') && (char != '\t')){
+			args = append(args, str[index:]);
+			return args, nil;
+		}
+		if (escaped){
+			current.WriteRune(char);
+			escaped = false;
+			continue;
+		}
+		switch {
+		case ((char == '\\') && (quote != '\'')):{
+			escaped = true;
+			inArg = true;
+		}
+		case (quote != 0):{
+			if (char == quote){
+				quote = 0;
+			} else {
+				current.WriteRune(char);
+			}
+		}
+		case ((char == '"') || (char == '\'')):{
+			quote = char;
+			inArg = true;
+		}
+		case ((char == ' ') || (char == '\t')):{
+			if (inArg){
+				args = append(args, current.String());
+				current.Reset();
+				inArg = false;
+			}
+		}
+		default:{
+			current.WriteRune(char);
+			inArg = true;
+		}
+		}
 	}
 
-	var cmdChunks []string = strings.Split(cmdStr, " ");
-	// Check the 0th element
-	cmd := strings.Trim(cmdChunks[0], "\n");
-	//fmt.Printf("%s|\n", cmd);
-	switch cmd{
-	case "/quit":
-		fallthrough;
-	case "/QUIT":{
-		retVal.CmdType = Quit;
+	if (quote != 0){
+		return nil, fmt.Errorf("missing closing %c", quote);
 	}
-	case "/connect":
-		fallthrough;
-	case "/CONNECT":{
-		if (len(cmdChunks) == 1){
-			fmt.Print("Missing IP and Port in /connect\n");
-			return retVal;
-		}
-		retVal.address = cmdChunks[1]
-
-		// Finalize by setting the CmdType to Connect
-		retVal.CmdType = Connect;
+	if (escaped){
+		current.WriteRune('\\');
+	}
+	if (inArg){
+		args = append(args, current.String());
 	}
+	return args, nil;
+}
 
-	case "/nickname": fallthrough;
-	case "/NICKNAME": fallthrough;
-	case "/NICK": fallthrough;
-	case "/nick":{
-		if (len(cmdChunks) == 1){
-			fmt.Print("Missing nickname to change\n");
-			return retVal;
-		}
-		retVal.info = cmdChunks[1];
+// ParseLine interprets a line of input using the commands in registry. Lines
+// that don't start with CommandPrefix are messages
+func ParseLine(registry *CommandRegistry, line string) (CLIParse, error){
+	var retVal CLIParse;
 
-		// Finalize by setting the CmdType to Nickname
-		retVal.CmdType = Nickname;
+	if (!strings.HasPrefix(line, CommandPrefix)){
+		retVal.Message = line;
+		return retVal, nil;
+	}
+	if (strings.HasPrefix(line, CommandPrefix + CommandPrefix)){
+		retVal.Message = line[len(CommandPrefix):];
+		return retVal, nil;
 	}
 
-	case "/viewsaved": fallthrough;	
-	case "/VIEWSAVED":{
-		retVal.CmdType = ViewSaved;
+	// The arguments are split once it's known whether the command takes the
+	// rest of the line as it is
+	args, err := splitArgs(line[len(CommandPrefix):], 2);
+	if (err != nil){
+		return retVal, fmt.Errorf("Unable to parse command: %s", err);
+	}
+	if (len(args) == 0){
+		return retVal, fmt.Errorf("Missing command after %s, try %shelp", CommandPrefix, CommandPrefix);
 	}
 
-	default:{
-		retVal.CmdType = Unknown;
+	retVal.Name = args[0];
+	command, exists := LookupCommand(registry, retVal.Name);
+	if (!exists){
+		return retVal, fmt.Errorf("Unknown command %s%s, try %shelp", CommandPrefix, retVal.Name, CommandPrefix);
 	}
+	retVal.Command = command;
+
+	retVal.Args = []string{};
+	if (len(args) > 1){
+		limit := AnyArgs;
+		if (command.Rest){
+			limit = command.MaxArgs;
+		}
+		retVal.Args, err = splitArgs(args[1], limit);
+		if (err != nil){
+			return retVal, fmt.Errorf("Unable to parse command: %s", err);
+		}
 	}
-	return retVal;
-}
\ No newline at end of file
+
+	if ((len(retVal.Args) < command.MinArgs) ||
+		((command.MaxArgs != AnyArgs) && (len(retVal.Args) > command.MaxArgs))){
+		return retVal, fmt.Errorf("Usage: %s", commandUsage(command));
+	}
+	return retVal, nil;
+}
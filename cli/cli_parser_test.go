@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T){
+	registry, err := DefaultCommands();
+	if (err != nil){
+		t.Fatalf("built in commands clash: %s", err);
+	}
+	tests := []struct{
+		line string;
+		command string;		// The command's registered name, blank for messages
+		args []string;
+		message string;
+		err string;		// The start of the error, blank if it parses
+	}{
+		// Messages
+		{line: "hello there", message: "hello there"},
+		{line: "  it's  spaced  ", message: "  it's  spaced  "},
+		{line: "//not a command", message: "/not a command"},
+
+		// Quoting
+		{line: "/connect localhost:8080", command: "connect", args: []string{"localhost:8080"}},
+		{line: "/connect  host   'two words' ", command: "connect", args: []string{"host", "two words"}},
+		{line: "/connect host \"it's quoted\"", command: "connect", args: []string{"host", "it's quoted"}},
+		{line: "/connect host 'say \"hi\"'", command: "connect", args: []string{"host", "say \"hi\""}},
+		{line: "/connect host two\\ words", command: "connect", args: []string{"host", "two words"}},
+		{line: "/connect host 'back\\slash'", command: "connect", args: []string{"host", "back\\slash"}},
+		{line: "/connect host \"\"", command: "connect", args: []string{"host", ""}},
+		{line: "/connect host trailing\\", command: "connect", args: []string{"host", "trailing\\"}},
+		{line: "/connect host 'unclosed", err: "Unable to parse command: missing closing '"},
+		{line: "/connect host \"unclosed", err: "Unable to parse command: missing closing \""},
+		{line: "/nick it's", err: "Unable to parse command"},
+
+		// Names and aliases ignore case
+		{line: "/Quit", command: "quit", args: []string{}},
+		{line: "/QUIT", command: "quit", args: []string{}},
+		{line: "/exit", command: "quit", args: []string{}},
+		{line: "/Nick bob", command: "nickname", args: []string{"bob"}},
+		{line: "/WHISPER bob hi", command: "msg", args: []string{"bob", "hi"}},
+
+		// The rest of the line is kept as typed
+		{line: "/msg bob it's   fine", command: "msg", args: []string{"bob", "it's   fine"}},
+
+		// Unknown commands
+		{line: "/", err: "Missing command after /"},
+		{line: "/   ", err: "Missing command after /"},
+		{line: "/nonsense", err: "Unknown command /nonsense"},
+
+		// Argument counts
+		{line: "/quit now", err: "Usage: /quit"},
+		{line: "/connect", err: "Usage: /connect <address|alias> [password]"},
+		{line: "/connect host password extra", err: "Usage: /connect"},
+		{line: "/nick", err: "Usage: /nickname <nickname>"},
+		{line: "/nick two words", err: "Usage: /nickname"},
+		{line: "/nick 'two words'", command: "nickname", args: []string{"two words"}},
+		{line: "/msg bob", err: "Usage: /msg <nickname> <message>"},
+		{line: "/help connect extra", err: "Usage: /help [command]"},
+		{line: "/export a b c d", command: "export", args: []string{"a", "b", "c", "d"}},
+	};
+	for _, test := range tests{
+		parseResult, err := ParseLine(registry, test.line);
+		if (test.err != ""){
+			if ((err == nil) || !strings.HasPrefix(err.Error(), test.err)){
+				t.Errorf("%q: got error %v, expected %q", test.line, err, test.err);
+			}
+			continue;
+		}
+		if (err != nil){
+			t.Errorf("%q: %s", test.line, err);
+			continue;
+		}
+
+		if (test.command == ""){
+			if ((parseResult.Command != nil) || (parseResult.Message != test.message)){
+				t.Errorf("%q: got message %q, expected %q", test.line, parseResult.Message, test.message);
+			}
+			continue;
+		}
+		if ((parseResult.Command == nil) || (parseResult.Command.Name != test.command)){
+			t.Errorf("%q: didn't run /%s", test.line, test.command);
+			continue;
+		}
+		if (!reflect.DeepEqual(parseResult.Args, test.args)){
+			t.Errorf("%q: got %q, expected %q", test.line, parseResult.Args, test.args);
+		}
+	}
+}
+
+func TestHelpForOneCommand(t *testing.T){
+	registry, err := DefaultCommands();
+	if (err != nil){
+		t.Fatalf("built in commands clash: %s", err);
+	}
+	tests := []struct{
+		line string;
+		output string;
+	}{
+		{"/help connect", "/connect <address|alias> [password]\n  Connects to a room by its address or saved alias\n"},
+		{"/help /Connect", "/connect <address|alias> [password]\n"},
+		{"/help exit", "/quit\n  Also /exit\n"},
+		{"/help whisper", "/msg <nickname> <message>\n  Also /whisper\n"},
+	};
+	for _, test := range tests{
+		parseResult, err := ParseLine(registry, test.line);
+		if (err != nil){
+			t.Errorf("%q: %s", test.line, err);
+			continue;
+		}
+		var out bytes.Buffer;
+		state := &CLIState{Commands: registry, Out: &out};
+		err = parseResult.Command.Handler(state, parseResult.Args);
+		if (err != nil){
+			t.Errorf("%q: %s", test.line, err);
+			continue;
+		}
+		if (!strings.HasPrefix(out.String(), test.output)){
+			t.Errorf("%q: printed %q, expected it to start with %q", test.line, out.String(), test.output);
+		}
+	}
+
+	parseResult, err := ParseLine(registry, "/help nonsense");
+	if (err != nil){
+		t.Fatalf("unable to parse /help nonsense: %s", err);
+	}
+	err = parseResult.Command.Handler(&CLIState{Commands: registry, Out: &bytes.Buffer{}}, parseResult.Args);
+	if ((err == nil) || (err.Error() != "Unknown command nonsense")){
+		t.Errorf("got %v for an unknown command", err);
+	}
+}
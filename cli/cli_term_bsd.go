@@ -0,0 +1,13 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package cli
+
+import (
+	"syscall"
+)
+
+// The ioctls that read and change a terminal's termios
+const (
+	ioctlGetTermios = syscall.TIOCGETA;
+	ioctlSetTermios = syscall.TIOCSETA;
+)
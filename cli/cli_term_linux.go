@@ -0,0 +1,13 @@
+//go:build linux
+
+package cli
+
+import (
+	"syscall"
+)
+
+// The ioctls that read and change a terminal's termios
+const (
+	ioctlGetTermios = syscall.TCGETS;
+	ioctlSetTermios = syscall.TCSETS;
+)
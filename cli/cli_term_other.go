@@ -0,0 +1,27 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package cli
+
+// Raw mode needs termios, so on platforms without it the CLI falls back to
+// reading lines as they are
+
+import (
+	"fmt"
+	"os"
+)
+
+// isTerminal always returns false so that UIAuto picks line mode
+func isTerminal(file *os.File) (bool){
+	return false;
+}
+
+func makeRaw(file *os.File) (func(), error){
+	return nil, fmt.Errorf("cliTerm.makeRaw: raw mode isn't supported on this platform");
+}
+
+func terminalSize(file *os.File) (int, int, error){
+	return 0, 0, fmt.Errorf("cliTerm.terminalSize: not supported on this platform");
+}
+
+func notifyResize(resized chan os.Signal){
+}
@@ -0,0 +1,81 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package cli
+
+// Puts the terminal into raw mode and asks it for its size using the termios
+// ioctls directly so the CLI doesn't need anything outside the standard library
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// winsize is the struct filled in by TIOCGWINSZ
+type winsize struct{
+	Row uint16;
+	Col uint16;
+	X uint16;
+	Y uint16;
+}
+
+// ioctl runs the given terminal ioctl on fd
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) (error){
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg));
+	if (errno != 0){
+		return errno;
+	}
+	return nil;
+}
+
+// isTerminal returns true if file is a terminal
+func isTerminal(file *os.File) (bool){
+	var termios syscall.Termios;
+	return (ioctl(file.Fd(), ioctlGetTermios, unsafe.Pointer(&termios)) == nil);
+}
+
+// makeRaw stops the terminal from echoing, buffering lines and turning keys
+// like Ctrl-C into signals. Output is still processed so a newline, such as
+// one ending a log line on stderr, returns to the start of the line. The
+// returned function puts it back how it was
+func makeRaw(file *os.File) (func(), error){
+	var old syscall.Termios;
+	err := ioctl(file.Fd(), ioctlGetTermios, unsafe.Pointer(&old));
+	if (err != nil){
+		return nil, fmt.Errorf("cliTerm.makeRaw: %s", err);
+	}
+
+	raw := old;
+	raw.Iflag &^= (syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON);
+	raw.Lflag &^= (syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN);
+	raw.Cflag &^= (syscall.CSIZE | syscall.PARENB);
+	raw.Cflag |= syscall.CS8;
+	raw.Cc[syscall.VMIN] = 1;
+	raw.Cc[syscall.VTIME] = 0;
+
+	err = ioctl(file.Fd(), ioctlSetTermios, unsafe.Pointer(&raw));
+	if (err != nil){
+		return nil, fmt.Errorf("cliTerm.makeRaw: %s", err);
+	}
+	return func(){
+		ioctl(file.Fd(), ioctlSetTermios, unsafe.Pointer(&old));
+	}, nil;
+}
+
+// terminalSize returns the number of columns and rows in the terminal
+func terminalSize(file *os.File) (int, int, error){
+	var size winsize;
+	err := ioctl(file.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&size));
+	if (err != nil){
+		return 0, 0, fmt.Errorf("cliTerm.terminalSize: %s", err);
+	}
+	return int(size.Col), int(size.Row), nil;
+}
+
+// notifyResize sends to resized whenever the terminal changes size
+func notifyResize(resized chan os.Signal){
+	signal.Notify(resized, syscall.SIGWINCH);
+}
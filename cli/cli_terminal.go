@@ -0,0 +1,232 @@
+package cli
+
+// The CLI either reads lines and prints as it goes, which works anywhere, or
+// takes over the whole terminal. Both are behind the terminal interface so
+// commands don't need to know which one they're writing to
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// UIAuto uses the full screen interface when stdin and stdout are both
+	// terminals that support it and line mode otherwise
+	UIAuto = "auto";
+	// UIFull takes over the whole terminal
+	UIFull = "full";
+	// UILine reads a line at a time and prints output as it arrives. On a
+	// terminal the line is edited like the full screen interface's, pipes and
+	// dumb terminals are read as they are
+	UILine = "line";
+)
+
+// terminal is where the CLI reads input from and writes output to
+type terminal interface{
+	io.Writer
+	// ReadLine returns the next line the user entered without its newline
+	ReadLine() (string, error);
+	// SendingMessage is called just before a line is sent to the room
+	SendingMessage();
+	// Refresh redraws anything that shows the state of the session
+	Refresh();
+	Close();
+}
+
+// ResolveUI returns UIFull or UILine for the given mode, picking one for
+// UIAuto based on whether stdin and stdout are terminals
+func ResolveUI(mode string) (string, error){
+	switch mode{
+	case UIFull, UILine:{
+		return mode, nil;
+	}
+	case UIAuto, "":{
+		if (interactive()){
+			return UIFull, nil;
+		}
+		return UILine, nil;
+	}
+	}
+	return "", fmt.Errorf("unknown UI %q: expected %s, %s or %s", mode, UIAuto, UIFull, UILine);
+}
+
+// interactive returns true if stdin and stdout are both a terminal that
+// understands escape codes, rather than pipes, files or a dumb terminal
+func interactive() (bool){
+	term := os.Getenv("TERM");
+	return (isTerminal(os.Stdin) && isTerminal(os.Stdout) && (term != "") && (term != "dumb"));
+}
+
+// lineTerminal reads stdin a line at a time and writes straight to stdout.
+// Without an editor lines are edited by the terminal itself, so there's no
+// history recall or completion
+type lineTerminal struct{
+	reader *bufio.Reader;
+	out io.Writer;
+	eraseEcho bool;		// Move up over sent messages so the server's copy replaces them
+
+	// Only set when lines are edited here, with the terminal in raw mode
+	editor *lineEditor;
+	restore func();
+	lock sync.Mutex;	// Held while writing output or drawing the line being typed
+	partial string;		// Output that hasn't been ended with a newline yet
+	closed bool;
+}
+
+func newLineTerminal(in io.Reader, out io.Writer, eraseEcho bool) (*lineTerminal){
+	return &lineTerminal{reader: bufio.NewReader(in), out: out, eraseEcho: eraseEcho};
+}
+
+// newEditingTerminal returns a lineTerminal that edits lines with editor.
+// in must already be in raw mode, restore is called on Close to put it back
+func newEditingTerminal(in io.Reader, out io.Writer, editor *lineEditor, restore func()) (*lineTerminal){
+	term := &lineTerminal{
+		reader: bufio.NewReader(in),
+		out: out,
+		eraseEcho: true,
+		editor: editor,
+		restore: restore,
+	};
+	term.lock.Lock();
+	term.drawInput();
+	term.lock.Unlock();
+	return term;
+}
+
+func (term *lineTerminal) Write(p []byte) (int, error){
+	if (term.editor == nil){
+		return term.out.Write(p);
+	}
+	term.lock.Lock();
+	defer term.lock.Unlock();
+	term.addOutput(string(p));
+	term.drawInput();
+	return len(p), nil;
+}
+
+// addOutput writes output over the line being typed, which needs drawing
+// again afterwards. The lock must be held
+func (term *lineTerminal) addOutput(output string){
+	fmt.Fprintf(term.out, "\r\033[2K%s%s", term.partial, output);
+	text := term.partial + output;
+	term.partial = text[strings.LastIndex(text, "\n") + 1:];
+}
+
+// drawInput draws the line being typed after any partial output, scrolled to
+// keep the cursor in view if it's wider than the terminal. The lock must be held
+func (term *lineTerminal) drawInput(){
+	if (term.closed){
+		return;
+	}
+	width := 80;
+	file, isFile := term.out.(*os.File);
+	if (isFile){
+		columns, _, err := terminalSize(file);
+		if ((err == nil) && (columns > 0)){
+			width = columns;
+		}
+	}
+	prefix := term.partial + inputPrompt;
+	input, column := term.editor.window(max(width - displayWidth([]rune(prefix)) - 1, 1));
+	fmt.Fprintf(term.out, "\r\033[2K%s%s", prefix, sanitizeLine(string(input)));
+	if (column < displayWidth(input)){
+		fmt.Fprintf(term.out, "\033[%dD", displayWidth(input) - column);
+	}
+}
+
+func (term *lineTerminal) ReadLine() (string, error){
+	if (term.editor != nil){
+		return term.editLine();
+	}
+	line, err := term.reader.ReadString('\n');
+	if ((err != nil) && (line == "")){
+		return "", err;
+	}
+	return strings.TrimRight(line, "\r\n"), nil;
+}
+
+// editLine lets the user type a line with the editor and returns it once they
+// press enter. Ctrl-C, or Ctrl-D on an empty line, returns io.EOF
+func (term *lineTerminal) editLine() (string, error){
+	for {
+		key, err := readKey(term.reader);
+		if (err != nil){
+			return "", err;
+		}
+
+		term.lock.Lock();
+		switch key{
+		case keyEnter:{
+			// Leave the line on the screen as a terminal would
+			line := term.editor.finish();
+			term.addOutput(inputPrompt + sanitizeLine(line) + "\n");
+			term.drawInput();
+			term.lock.Unlock();
+			return line, nil;
+		}
+		case keyCtrlC:{
+			term.lock.Unlock();
+			return "", io.EOF;
+		}
+		case keyCtrlD:{
+			if (len(term.editor.input) == 0){
+				term.lock.Unlock();
+				return "", io.EOF;
+			}
+			term.editor.handleKey(key);
+		}
+		case keyCtrlL:{
+			fmt.Fprint(term.out, "\033[2J\033[H");
+		}
+		default:{
+			candidates, _ := term.editor.handleKey(key);
+			if (len(candidates) > 1){
+				term.addOutput("  " + strings.Join(candidates, "  ") + "\n");
+			}
+		}
+		}
+		term.drawInput();
+		term.lock.Unlock();
+	}
+}
+
+func (term *lineTerminal) SendingMessage(){
+	// The server sends the message back so move up over the typed line and
+	// let it be overwritten
+	if (!term.eraseEcho){
+		return;
+	}
+	if (term.editor == nil){
+		fmt.Fprint(term.out, "\033[F");
+		return;
+	}
+	// The line being typed is drawn where the sent one was
+	term.lock.Lock();
+	defer term.lock.Unlock();
+	fmt.Fprint(term.out, "\r\033[2K\033[F");
+	term.drawInput();
+}
+
+func (term *lineTerminal) Refresh(){
+}
+
+// Close clears the line being typed and puts the terminal back out of raw mode
+func (term *lineTerminal) Close(){
+	if (term.editor == nil){
+		return;
+	}
+	term.lock.Lock();
+	defer term.lock.Unlock();
+	if (term.closed){
+		return;
+	}
+	term.closed = true;
+	fmt.Fprintf(term.out, "\r\033[2K%s", term.partial);
+	if (term.restore != nil){
+		term.restore();
+	}
+}
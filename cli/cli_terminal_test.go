@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineModeEditsOnATerminal(t *testing.T){
+	history := &inputHistory{entries: []historyEntry{{line: "/connect room"}}};
+	editor := newLineEditor(history, func(input []rune, cursor int) ([]rune, int, []string){
+		return []rune("/quit "), len("/quit "), []string{"/quit"};
+	});
+	keys := "hello\x1b[D\x1b[DX\r" +	// Left twice and insert
+		"\x1b[A\r" +				// Recall the last line from the history
+		"/q\t\r" +					// Complete
+		"bye\x7f\x7f\x7f\x04";		// Backspace to an empty line then Ctrl-D
+	var out bytes.Buffer;
+	restored := false;
+	term := newEditingTerminal(strings.NewReader(keys), &out, editor, func(){
+		restored = true;
+	});
+
+	for _, expected := range []string{"helXlo", "/connect room", "/quit "}{
+		line, err := term.ReadLine();
+		if (err != nil){
+			t.Fatalf("expected %q: %s", expected, err);
+		}
+		if (line != expected){
+			t.Errorf("read %q, expected %q", line, expected);
+		}
+	}
+	_, err := term.ReadLine();
+	if (err != io.EOF){
+		t.Errorf("expected Ctrl-D on an empty line to be io.EOF, got %v", err);
+	}
+
+	incoming := "someone : hi\n";
+	term.Write([]byte(incoming));
+	if (!strings.Contains(out.String(), "\r\033[2K" + incoming + "\r\033[2K" + inputPrompt)){
+		t.Errorf("expected output to be written over the input line and the line drawn again after it");
+	}
+	term.Close();
+	if (!restored){
+		t.Errorf("expected Close to restore the terminal");
+	}
+}
+
+func TestInputWindowCountsWideCharacters(t *testing.T){
+	editor := newLineEditor(nil, nil);
+	editor.setInput([]rune("日本語abc"));
+	editor.cursor = 3;
+	input, column := editor.window(20);
+	if ((string(input) != "日本語abc") || (column != 6)){
+		t.Errorf("got %q with the cursor in column %d, expected the whole line and column 6", string(input), column);
+	}
+
+	// Scrolled so the cursor at the end is still in view
+	editor.cursor = len(editor.input);
+	input, column = editor.window(7);
+	if ((string(input) != "本語abc") || (column != 7)){
+		t.Errorf("got %q with the cursor in column %d, expected \"本語abc\" and column 7", string(input), column);
+	}
+
+	if (fitWidth("日本", 3) != "日 "){
+		t.Errorf("expected a wide character that doesn't fit to be padded with a space, got %q", fitWidth("日本", 3));
+	}
+}
@@ -0,0 +1,390 @@
+package cli
+
+// A full screen interface drawn with ANSI escape codes. Output scrolls in the
+// top of the screen, with an optional list of the room's members on the right,
+// above a status bar and the line being typed. Incoming messages are drawn
+// above the input line so they never mangle what's being typed
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"p2psystem/client"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// ScrollbackLines is the number of lines of output the full screen
+	// interface keeps to scroll back through
+	ScrollbackLines = 1000;
+	// MemberPaneWidth is the width of the member list including its border
+	MemberPaneWidth = 22;
+	// inputPrompt is drawn in front of the line being typed
+	inputPrompt = "> ";
+)
+
+// fullTerminal takes over the terminal while the CLI is running
+type fullTerminal struct{
+	session *client.ClientSession;
+	in *os.File;
+	out *os.File;
+	reader *bufio.Reader;
+	restore func();		// Puts the terminal back out of raw mode
+	resized chan os.Signal;
+	done chan bool;
+
+	lock sync.Mutex;	// Held while changing anything below or drawing
+	closed bool;
+	lines []string;		// Output, oldest first
+	partial string;		// Output that hasn't been ended with a newline yet
+	scroll int;			// Lines scrolled back from the newest
+	editor *lineEditor;	// The line being typed
+	showMembers bool;
+	// current is the session's current connection, copied from the CLI's
+	// goroutine so it's safe to read while drawing from any goroutine
+	current *client.ClientConnection;
+	width int;
+	height int;
+}
+
+// newFullTerminal puts the terminal into raw mode and switches to its
+// alternate screen, which leaves what was on the screen before untouched
+func newFullTerminal(session *client.ClientSession, in *os.File, out *os.File, editor *lineEditor,
+	showMembers bool) (*fullTerminal, error){
+	restore, err := makeRaw(in);
+	if (err != nil){
+		return nil, fmt.Errorf("cliTUI: %s", err);
+	}
+
+	term := &fullTerminal{
+		session: session,
+		in: in,
+		out: out,
+		reader: bufio.NewReader(in),
+		restore: restore,
+		resized: make(chan os.Signal, 1),
+		done: make(chan bool),
+		lines: []string{},
+		editor: editor,
+		showMembers: showMembers,
+		current: client.GetCurrentConnection(session),
+	};
+	term.updateSize();
+	fmt.Fprint(out, "\033[?1049h\033[2J");
+
+	notifyResize(term.resized);
+	go term.watchResize();
+	// Member lists aren't printed so they need to be drawn when they arrive
+	client.AddHandler(session, client.EventHandlerFunc(func(event client.Event){
+		if (event.Type == client.EventMembers){
+			term.lock.Lock();
+			term.draw();
+			term.lock.Unlock();
+		}
+	}));
+
+	term.lock.Lock();
+	term.draw();
+	term.lock.Unlock();
+	return term, nil;
+}
+
+// updateSize reads the size of the terminal, keeping the last size if it
+// can't be read
+func (term *fullTerminal) updateSize(){
+	width, height, err := terminalSize(term.out);
+	if ((err != nil) || (width <= 0) || (height <= 0)){
+		if (term.width == 0){
+			term.width, term.height = 80, 24;
+		}
+		return;
+	}
+	term.width, term.height = width, height;
+}
+
+// watchResize redraws the screen whenever the terminal changes size
+func (term *fullTerminal) watchResize(){
+	for {
+		select {
+		case <- term.resized:{
+			term.lock.Lock();
+			term.updateSize();
+			term.draw();
+			term.lock.Unlock();
+		}
+		case <- term.done:{
+			return;
+		}
+		}
+	}
+}
+
+// Write adds output to the scrollback. Control characters are removed so no
+// one in the room can send escape codes to the terminal
+func (term *fullTerminal) Write(p []byte) (int, error){
+	term.lock.Lock();
+	defer term.lock.Unlock();
+	term.addOutput(string(p));
+	term.draw();
+	return len(p), nil;
+}
+
+// addOutput adds text to the scrollback. The lock must be held
+func (term *fullTerminal) addOutput(output string){
+	text := term.partial + output;
+	split := strings.Split(text, "\n");
+	term.partial = split[len(split) - 1];
+	added := split[:len(split) - 1];
+	for _, line := range added{
+		term.lines = append(term.lines, sanitizeLine(line));
+	}
+	if (len(term.lines) > ScrollbackLines){
+		term.lines = term.lines[len(term.lines) - ScrollbackLines:];
+	}
+	// Keep showing the same lines if the user has scrolled back
+	if (term.scroll > 0){
+		term.scroll = min(term.scroll + len(added), len(term.lines) - 1);
+	}
+}
+
+// sanitizeLine replaces tabs with spaces and drops other control characters
+func sanitizeLine(line string) (string){
+	return strings.Map(func(char rune) (rune){
+		if (char == '\t'){
+			return ' ';
+		}
+		if (unicode.IsControl(char)){
+			return -1;
+		}
+		return char;
+	}, line);
+}
+
+// ReadLine lets the user type a line and returns it once they press enter.
+// Ctrl-C, or Ctrl-D on an empty line, returns io.EOF
+func (term *fullTerminal) ReadLine() (string, error){
+	for {
+		key, err := readKey(term.reader);
+		if (err != nil){
+			return "", err;
+		}
+
+		term.lock.Lock();
+		switch key{
+		case keyEnter:{
+			line := term.editor.finish();
+			term.scroll = 0;
+			term.draw();
+			term.lock.Unlock();
+			return line, nil;
+		}
+		case keyCtrlC:{
+			term.lock.Unlock();
+			return "", io.EOF;
+		}
+		case keyCtrlD:{
+			if (len(term.editor.input) == 0){
+				term.lock.Unlock();
+				return "", io.EOF;
+			}
+			term.editor.handleKey(key);
+		}
+		case keyCtrlL:{
+			fmt.Fprint(term.out, "\033[2J");
+		}
+		case keyPageUp:{
+			term.scroll = min(term.scroll + max(term.messageRows() / 2, 1), max(len(term.lines) - 1, 0));
+		}
+		case keyPageDown:{
+			term.scroll = max(term.scroll - max(term.messageRows() / 2, 1), 0);
+		}
+		default:{
+			candidates, _ := term.editor.handleKey(key);
+			if (len(candidates) > 1){
+				term.addOutput("  " + strings.Join(candidates, "  ") + "\n");
+			}
+		}
+		}
+		term.draw();
+		term.lock.Unlock();
+	}
+}
+
+// SendingMessage does nothing since typed lines aren't echoed into the output
+func (term *fullTerminal) SendingMessage(){
+}
+
+// Refresh copies the session's current connection for the status bar and
+// redraws the screen. It must be called from the CLI's goroutine
+func (term *fullTerminal) Refresh(){
+	term.lock.Lock();
+	defer term.lock.Unlock();
+	term.current = client.GetCurrentConnection(term.session);
+	term.draw();
+}
+
+// toggleMembers shows or hides the member list and returns whether it's shown
+func (term *fullTerminal) toggleMembers() (bool){
+	term.lock.Lock();
+	defer term.lock.Unlock();
+	term.showMembers = !term.showMembers;
+	term.draw();
+	return term.showMembers;
+}
+
+// Close puts the terminal back how it was before the interface started
+func (term *fullTerminal) Close(){
+	term.lock.Lock();
+	defer term.lock.Unlock();
+	if (term.closed){
+		return;
+	}
+	term.closed = true;
+	signal.Stop(term.resized);
+	close(term.done);
+	fmt.Fprint(term.out, "\033[?25h\033[?1049l");
+	term.restore();
+}
+
+// messageRows returns the number of rows output is drawn in
+func (term *fullTerminal) messageRows() (int){
+	return max(term.height - 2, 1);
+}
+
+// wideRanges are the characters drawn two columns wide, mostly CJK and emoji
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f}, {0x2e80, 0x303e}, {0x3041, 0x33ff}, {0x3400, 0x4dbf},
+	{0x4e00, 0x9fff}, {0xa000, 0xa4cf}, {0xa960, 0xa97f}, {0xac00, 0xd7a3},
+	{0xf900, 0xfaff}, {0xfe10, 0xfe19}, {0xfe30, 0xfe6f}, {0xff00, 0xff60},
+	{0xffe0, 0xffe6}, {0x1f300, 0x1f64f}, {0x1f900, 0x1f9ff}, {0x20000, 0x2fffd},
+	{0x30000, 0x3fffd},
+};
+
+// runeWidth returns the number of columns char takes up on the screen
+func runeWidth(char rune) (int){
+	if (unicode.In(char, unicode.Mn, unicode.Me, unicode.Cf)){
+		return 0;
+	}
+	for _, wide := range wideRanges{
+		if ((char >= wide[0]) && (char <= wide[1])){
+			return 2;
+		}
+	}
+	return 1;
+}
+
+// displayWidth returns the number of columns text takes up on the screen
+func displayWidth(text []rune) (int){
+	width := 0;
+	for _, char := range text{
+		width += runeWidth(char);
+	}
+	return width;
+}
+
+// cutWidth returns how many of runes fit in width columns
+func cutWidth(runes []rune, width int) (int){
+	used := 0;
+	for index, char := range runes{
+		used += runeWidth(char);
+		if (used > width){
+			return index;
+		}
+	}
+	return len(runes);
+}
+
+// fitWidth cuts text down to width columns or pads it out with spaces
+func fitWidth(text string, width int) (string){
+	runes := []rune(text);
+	runes = runes[:cutWidth(runes, width)];
+	return string(runes) + strings.Repeat(" ", width - displayWidth(runes));
+}
+
+// wrapLine splits line into rows of at most width columns
+func wrapLine(line string, width int) ([]string){
+	runes := []rune(line);
+	if (displayWidth(runes) <= width){
+		return []string{line};
+	}
+	rows := []string{};
+	for (displayWidth(runes) > width){
+		// Always take something so a character wider than the row still moves on
+		cut := max(cutWidth(runes, width), 1);
+		rows = append(rows, string(runes[:cut]));
+		runes = runes[cut:];
+	}
+	return append(rows, string(runes));
+}
+
+// draw redraws the whole screen. The lock must be held
+func (term *fullTerminal) draw(){
+	if (term.closed){
+		return;
+	}
+	var screen bytes.Buffer;
+	// Hide the cursor while drawing so it doesn't flicker across the screen
+	screen.WriteString("\033[?25l");
+
+	rows := term.messageRows();
+	paneWidth := 0;
+	if (term.showMembers && (term.width >= MemberPaneWidth * 2)){
+		paneWidth = MemberPaneWidth;
+	}
+	textWidth := max(term.width - paneWidth, 1);
+
+	// Wrap lines from the bottom of the visible output until the screen is full
+	visible := []string{};
+	for index := len(term.lines) - term.scroll - 1; ((index >= 0) && (len(visible) < rows)); index--{
+		wrapped := wrapLine(term.lines[index], textWidth);
+		visible = append(wrapped, visible...);
+	}
+	if (len(visible) > rows){
+		visible = visible[len(visible) - rows:];
+	}
+
+	connected := client.IsConnected(term.current);
+	var members []string;
+	if (connected){
+		members = client.GetMembers(term.current);
+	}
+
+	for row := 0; row < rows; row++{
+		fmt.Fprintf(&screen, "\033[%d;1H\033[2K", row + 1);
+		line := row - (rows - len(visible));
+		if (line >= 0){
+			screen.WriteString(visible[line]);
+		}
+		if (paneWidth == 0){
+			continue;
+		}
+		cell := "";
+		if (row == 0){
+			cell = fmt.Sprintf("Members (%d)", len(members));
+		} else if (row - 1 < len(members)){
+			cell = sanitizeLine(members[row - 1]);
+		}
+		fmt.Fprintf(&screen, "\033[%d;%dH│ %s", row + 1, textWidth + 1, fitWidth(cell, paneWidth - 2));
+	}
+
+	status := " Not connected";
+	if (connected){
+		status = fmt.Sprintf(" %s | %s | %d members", client.GetAddr(term.current),
+			sanitizeLine(client.GetConnectionNickname(term.current)), len(members));
+	}
+	if (term.scroll > 0){
+		status += fmt.Sprintf(" | %d lines back, PgDn to return", term.scroll);
+	}
+	fmt.Fprintf(&screen, "\033[%d;1H\033[7m%s\033[0m", rows + 1, fitWidth(status, term.width));
+
+	input, column := term.editor.window(max(term.width - displayWidth([]rune(inputPrompt)) - 1, 1));
+	fmt.Fprintf(&screen, "\033[%d;1H\033[2K%s%s", rows + 2, inputPrompt, sanitizeLine(string(input)));
+	fmt.Fprintf(&screen, "\033[%d;%dH\033[?25h", rows + 2, displayWidth([]rune(inputPrompt)) + column + 1);
+
+	term.out.Write(screen.Bytes());
+}
@@ -3,13 +3,27 @@ package client
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"p2psystem/common"
+	"path/filepath"
+	"slices"
+	"sort"
 )
 
 // Handles everything to do with loading, parsing and saving the config
 type savedRoom struct {
 	Addr string;
 	Alias string;
+	// Password is sent to the server when joining if it isn't blank
+	Password string `json:",omitempty"`;
+	// AutoConnect rooms are joined when the client starts
+	AutoConnect bool `json:",omitempty"`;
+	// Nickname is used in this room instead of DefaultName if it isn't blank
+	Nickname string `json:",omitempty"`;
+	// JoinOrder sorts the AutoConnect rooms, lowest first. The first one
+	// joined becomes the current room
+	JoinOrder int `json:",omitempty"`;
 }
 
 // Config stores all the configuration values for the 
@@ -21,32 +35,115 @@ type Config struct{
 	// SavedRooms stores an array of the rooms that the user has saved and can
 	// connect to by its alias
 	SavedRooms []savedRoom;
+
+	// DiscoveryAddr is the UDP address in the format address:port that the
+	// client listens on for rooms advertising themselves. If it's blank
+	// common.DefaultDiscoveryAddr is used
+	DiscoveryAddr string `json:",omitempty"`;
+
+	// Hooks are programs run when something happens in a room, e.g. to show
+	// a desktop notification
+	Hooks []Hook `json:",omitempty"`;
+	// MaxHookProcesses is how many hooks can run at once. If it's 0
+	// DefaultMaxHookProcesses is used
+	MaxHookProcesses int `json:",omitempty"`;
+
+	// TranscriptDir is where every room's messages are saved so they can be
+	// exported later. It's relative to the config directory and blank doesn't
+	// save them
+	TranscriptDir string `json:",omitempty"`;
+
+	// Compression is the compression methods the client picks from, out of
+	// none, flate and dict, the most preferred first. If it's empty
+	// common.DefaultCompressionMethods is used
+	Compression []string `json:",omitempty"`;
+	// CompressionLevel is the flate level from 1 to 9. If it's 0
+	// common.DefaultCompressionLevel is used
+	CompressionLevel int `json:",omitempty"`;
+	// CompressionThreshold is the size in bytes below which messages are
+	// sent uncompressed. If it's 0 common.DefaultCompressionThreshold is used
+	CompressionThreshold int `json:",omitempty"`;
+}
+
+// ConfigFileName is the name of the client's config file in its config
+// directory
+const ConfigFileName = "clientConfig.cfg";
+
+// DefaultConfigDir returns the per-user directory the config is kept in, e.g.
+// ~/.config/gomsg on Linux. If the user has no config directory it's "config"
+// in the working directory
+func DefaultConfigDir() (string){
+	dir, err := os.UserConfigDir();
+	if (err != nil){
+		return "config";
+	}
+	return filepath.Join(dir, "gomsg");
 }
 
 // WriteConfig is the yang to ReadConfig's yin and writes the contents of the
-// config struct as a JSON file to clientConfig.cfg
-// If the file doesn't exist. it is created.
+// config struct as a JSON file to clientConfig.cfg in the directory FilePath
+// The directory is created if it doesn't exist. The config is written to a
+// temporary file that then replaces clientConfig.cfg, so a crash part way
+// through leaves the old config as it was. A config that couldn't be loaded
+// is kept as clientConfig.cfg.bak instead of being replaced
 func WriteConfig(session *ClientSession, FilePath string) (error){
-	file, err := os.Create(FilePath + string(os.PathSeparator) + "clientConfig.cfg")
+	session.configLock.Lock();
+	defer session.configLock.Unlock();
+	return writeConfig(session, session.Config, FilePath);
+}
+
+// writeConfig writes cfg as WriteConfig does. The config lock must be held
+func writeConfig(session *ClientSession, cfg *Config, FilePath string) (error){
+	buf, err := json.MarshalIndent(cfg, "","\t");
 	if (err != nil){
-		fmt.Printf("WriteConfig: Unable to save client config: %s\n", err);
+		session.log.Error("unable to marshal client config", "err", err);
 		return fmt.Errorf("WriteConfig: %s", err);
 	}
 
-	var buf []byte;
-	buf, err = json.MarshalIndent(session.Config, "","\t");
-
+	// Saved rooms can have passwords so only the user can read the config
+	err = os.MkdirAll(FilePath, 0700);
+	if (err != nil){
+		session.log.Error("unable to create config directory", "path", FilePath, "err", err);
+		return fmt.Errorf("WriteConfig: %s", err);
+	}
+	file, err := os.CreateTemp(FilePath, ConfigFileName + ".*.tmp");
 	if (err != nil){
-		fmt.Printf("WriteConfig: Unable to marshal JSON: %s\n", err);
+		session.log.Error("unable to save client config", "err", err);
 		return fmt.Errorf("WriteConfig: %s", err);
 	}
+	// Does nothing once the file has been renamed
+	defer os.Remove(file.Name());
 
 	_, err = file.Write(buf);
+	if (err == nil){
+		err = file.Sync();
+	}
+	closeErr := file.Close();
+	if (err == nil){
+		err = closeErr;
+	}
 	if (err != nil){
-		fmt.Printf("WriteConfig: Unable to write JSON to file: %s\n", err);
+		session.log.Error("unable to write client config", "err", err);
 		return fmt.Errorf("WriteConfig: %s", err);
 	}
 
+	path := filepath.Join(FilePath, ConfigFileName);
+	if (session.brokenConfig == path){
+		// The saved rooms it had are only lost if the user chooses to
+		backup := path + ".bak";
+		err = os.Rename(path, backup);
+		if ((err != nil) && !os.IsNotExist(err)){
+			session.log.Error("unable to move aside client config that couldn't be loaded", "path", path, "err", err);
+			return fmt.Errorf("WriteConfig: %s couldn't be loaded and won't be overwritten: %s", path, err);
+		}
+		session.log.Warn("moved aside client config that couldn't be loaded", "path", path, "backup", backup);
+		session.brokenConfig = "";
+	}
+	err = os.Rename(file.Name(), path);
+	if (err != nil){
+		session.log.Error("unable to replace client config", "err", err);
+		return fmt.Errorf("WriteConfig: %s", err);
+	}
 	return nil;
 }
 
@@ -54,37 +151,21 @@ func WriteConfig(session *ClientSession, FilePath string) (error){
 // with the parsed configuration values
 // The cfg file is formatted in JSON
 func ReadConfig(session *ClientSession, FilePath string) (error){
-	file, err := os.Open(FilePath);
-	if (err != nil){
-		fmt.Printf("clientMain: Unable to open file at path %s: %s\n", FilePath, err);
-		return fmt.Errorf("clientMain.ReadConfig: %s", err);
-	}
-
-	var data []byte = make([]byte, 4096);
-	_, err = file.Read(data);
+	data, err := os.ReadFile(FilePath);
 	if (err != nil){
-		fmt.Printf("clientMain.ReadConfig: Unable to read file at path %s: %s\n", FilePath, err);
+		session.log.Warn("unable to read client config", "path", FilePath, "err", err);
 		return fmt.Errorf("clientMain.ReadConfig: %s", err);
 	}
-	// Find the first occurrence of the null byte and slice to right before that
-	var sliceLimit int = 1;
-	for k,v := range data{
-		if (v == 0){
-			sliceLimit = k;
-			break;
-		}
-	}
 
 	var retCFG Config;
-	err = json.Unmarshal(data[:sliceLimit], &retCFG);
+	err = json.Unmarshal(data, &retCFG);
 	if (err != nil){
-		fmt.Printf("clientMain: Unable to parse CFG file for config values: %s", err);
+		session.log.Warn("unable to parse client config", "path", FilePath, "err", err);
 		return fmt.Errorf("clientMain.ReadConfig: %s", err);
 	}
-
-	file.Close();
-
-	session.Config = &retCFG;
+	if (retCFG.SavedRooms == nil){
+		retCFG.SavedRooms = []savedRoom{};
+	}
 
 	var nameOccurrence map[string]int = map[string]int{};
 	// Resolve any colliding savenames
@@ -92,10 +173,8 @@ func ReadConfig(session *ClientSession, FilePath string) (error){
 		num, exists := nameOccurrence[retCFG.SavedRooms[index].Alias];
 		if (exists){
 			newAlias := retCFG.SavedRooms[index].Alias + fmt.Sprintf("%d", num);
-			fmt.Printf("The alias %s, already exists as a saved alias. Changing name from %s -> %s\n", 
-				retCFG.SavedRooms[index].Alias, 
-				retCFG.SavedRooms[index].Alias, 
-				newAlias);
+			session.log.Warn("alias already exists as a saved alias, renaming it",
+				"alias", retCFG.SavedRooms[index].Alias, "newAlias", newAlias);
 			retCFG.SavedRooms[index].Alias = newAlias;
 		} else {
 			nameOccurrence[retCFG.SavedRooms[index].Alias] = 0;
@@ -104,17 +183,53 @@ func ReadConfig(session *ClientSession, FilePath string) (error){
 		nameOccurrence[retCFG.SavedRooms[index].Alias] = num + 1;
 	}
 
+	session.configLock.Lock();
+	session.Config = &retCFG;
+	session.configLock.Unlock();
+	return nil;
+}
+
+// GetConfig returns the session's config, or nil if it hasn't been loaded.
+// The config is replaced rather than changed, so it mustn't be changed either
+func GetConfig(session *ClientSession) (*Config){
+	session.configLock.RLock();
+	defer session.configLock.RUnlock();
+	return session.Config;
+}
+
+// updateConfig makes change to a copy of the config and writes it, only
+// replacing the session's config once it's been written. Changes that fail
+// or can't be saved leave the config as it was
+func updateConfig(session *ClientSession, change func(cfg *Config) (error)) (error){
+	session.configLock.Lock();
+	defer session.configLock.Unlock();
+	if (session.Config == nil){
+		return fmt.Errorf("clientConfig: config has not been loaded yet");
+	}
+
+	cfg := *session.Config;
+	cfg.SavedRooms = slices.Clone(session.Config.SavedRooms);
+	err := change(&cfg);
+	if (err != nil){
+		return err;
+	}
+	err = writeConfig(session, &cfg, session.configDir);
+	if (err != nil){
+		return err;
+	}
+	session.Config = &cfg;
 	return nil;
 }
 
 // GetSavedRoom returns the address associated with the alias
 // if no alias exists then the function returns a blank string
 func GetSavedRoom(session *ClientSession, Alias string) (string, error){
-	if (session.Config == nil){
+	cfg := GetConfig(session);
+	if (cfg == nil){
 		return "", fmt.Errorf("clientConfig: config has not been loaded yet");
 	}
 
-	for _, savedRoom := range session.Config.SavedRooms{
+	for _, savedRoom := range cfg.SavedRooms{
 		if (savedRoom.Alias == Alias){
 			return savedRoom.Addr, nil;
 		}
@@ -123,9 +238,203 @@ func GetSavedRoom(session *ClientSession, Alias string) (string, error){
 	return "", nil;
 }
 
-// DisplaySavedAliases prints all aliases and their addresses to stdout
-func DisplaySavedAliases(session *ClientSession){
-	for ind, room := range session.Config.SavedRooms{
-		fmt.Printf("%d) : Alias: %s, Address: %s\n",ind, room.Alias, room.Addr);
+// GetSavedAliases returns the alias of every saved room
+func GetSavedAliases(session *ClientSession) ([]string){
+	cfg := GetConfig(session);
+	if (cfg == nil){
+		return []string{};
+	}
+	aliases := make([]string, 0, len(cfg.SavedRooms));
+	for _, savedRoom := range cfg.SavedRooms{
+		aliases = append(aliases, savedRoom.Alias);
+	}
+	return aliases;
+}
+
+// GetSavedRoomPassword returns the password saved with the alias. If no alias
+// exists or it has no password then the function returns a blank string
+func GetSavedRoomPassword(session *ClientSession, Alias string) (string){
+	cfg := GetConfig(session);
+	if (cfg == nil){
+		return "";
+	}
+
+	for _, savedRoom := range cfg.SavedRooms{
+		if (savedRoom.Alias == Alias){
+			return savedRoom.Password;
+		}
+	}
+
+	return "";
+}
+
+// SaveRoom adds the address to the saved rooms under the given alias and
+// writes the config so that it persists
+func SaveRoom(session *ClientSession, Alias string, Addr string, Password string) (error){
+	if (Alias == ""){
+		return fmt.Errorf("clientConfig: alias must not be blank");
+	}
+	err := common.ValidateAddress(Addr);
+	if (err != nil){
+		return fmt.Errorf("clientConfig: %s", err);
+	}
+
+	return updateConfig(session, func(cfg *Config) (error){
+		if (findSavedRoom(cfg, Alias) >= 0){
+			return fmt.Errorf("clientConfig: the alias %s already exists", Alias);
+		}
+		cfg.SavedRooms = append(cfg.SavedRooms, savedRoom{
+			Addr: Addr,
+			Alias: Alias,
+			Password: Password,
+		});
+		return nil;
+	});
+}
+
+// findSavedRoom returns the index of the saved room with the alias or -1 if
+// there isn't one
+func findSavedRoom(cfg *Config, Alias string) (int){
+	for index, room := range cfg.SavedRooms{
+		if (room.Alias == Alias){
+			return index;
+		}
+	}
+	return -1;
+}
+
+// updateSavedRoom makes change to the saved room with the given alias and
+// writes the config
+func updateSavedRoom(session *ClientSession, Alias string, change func(room *savedRoom)) (error){
+	return updateConfig(session, func(cfg *Config) (error){
+		index := findSavedRoom(cfg, Alias);
+		if (index < 0){
+			return fmt.Errorf("clientConfig: no room is saved as %s", Alias);
+		}
+		change(&cfg.SavedRooms[index]);
+		return nil;
+	});
+}
+
+// UnsaveRoom removes the saved room with the given alias and writes the config
+func UnsaveRoom(session *ClientSession, Alias string) (error){
+	return updateConfig(session, func(cfg *Config) (error){
+		index := findSavedRoom(cfg, Alias);
+		if (index < 0){
+			return fmt.Errorf("clientConfig: no room is saved as %s", Alias);
+		}
+		cfg.SavedRooms = slices.Delete(cfg.SavedRooms, index, index + 1);
+		return nil;
+	});
+}
+
+// RenameRoom changes the alias of a saved room and writes the config
+func RenameRoom(session *ClientSession, Alias string, NewAlias string) (error){
+	if (NewAlias == ""){
+		return fmt.Errorf("clientConfig: alias must not be blank");
+	}
+	return updateConfig(session, func(cfg *Config) (error){
+		index := findSavedRoom(cfg, Alias);
+		if (index < 0){
+			return fmt.Errorf("clientConfig: no room is saved as %s", Alias);
+		}
+		if ((NewAlias != Alias) && (findSavedRoom(cfg, NewAlias) >= 0)){
+			return fmt.Errorf("clientConfig: the alias %s already exists", NewAlias);
+		}
+		cfg.SavedRooms[index].Alias = NewAlias;
+		return nil;
+	});
+}
+
+// SetDefaultName changes the nickname sent to servers when joining and writes
+// the config. A nickname given on the command line still takes its place for
+// this session
+func SetDefaultName(session *ClientSession, Name string) (error){
+	if (len(Name) > common.NicknameMaxSize){
+		return fmt.Errorf("clientConfig: nickname is longer than %d characters", common.NicknameMaxSize);
+	}
+	return updateConfig(session, func(cfg *Config) (error){
+		cfg.DefaultName = Name;
+		return nil;
+	});
+}
+
+// SetRoomAutoConnect sets whether the saved room is joined when the client
+// starts and writes the config
+func SetRoomAutoConnect(session *ClientSession, Alias string, AutoConnect bool) (error){
+	return updateSavedRoom(session, Alias, func(room *savedRoom){
+		room.AutoConnect = AutoConnect;
+	});
+}
+
+// SetRoomJoinOrder sets where the saved room comes when joining rooms on start
+// up and writes the config
+func SetRoomJoinOrder(session *ClientSession, Alias string, JoinOrder int) (error){
+	return updateSavedRoom(session, Alias, func(room *savedRoom){
+		room.JoinOrder = JoinOrder;
+	});
+}
+
+// SetRoomNickname sets the nickname used in the saved room, or clears it if
+// Name is blank, and writes the config
+func SetRoomNickname(session *ClientSession, Alias string, Name string) (error){
+	if (len(Name) > common.NicknameMaxSize){
+		return fmt.Errorf("clientConfig: nickname is longer than %d characters", common.NicknameMaxSize);
+	}
+	return updateSavedRoom(session, Alias, func(room *savedRoom){
+		room.Nickname = Name;
+	});
+}
+
+// roomNickname returns the nickname saved for the room at addr, or a blank
+// string if it isn't saved or has no nickname
+func roomNickname(session *ClientSession, addr string) (string){
+	cfg := GetConfig(session);
+	if (cfg == nil){
+		return "";
+	}
+	for _, room := range cfg.SavedRooms{
+		if ((room.Addr == addr) && (room.Nickname != "")){
+			return room.Nickname;
+		}
+	}
+	return "";
+}
+
+// autoConnectRooms returns the saved rooms to join on start up in the order
+// they're joined
+func autoConnectRooms(session *ClientSession) ([]savedRoom){
+	rooms := []savedRoom{};
+	cfg := GetConfig(session);
+	if (cfg == nil){
+		return rooms;
+	}
+	for _, room := range cfg.SavedRooms{
+		if (room.AutoConnect){
+			rooms = append(rooms, room);
+		}
+	}
+	// Rooms with the same JoinOrder keep the order they were saved in
+	sort.SliceStable(rooms, func(i int, j int) (bool){
+		return rooms[i].JoinOrder < rooms[j].JoinOrder;
+	});
+	return rooms;
+}
+
+// DisplaySavedAliases prints all aliases and their addresses to out
+func DisplaySavedAliases(session *ClientSession, out io.Writer){
+	cfg := GetConfig(session);
+	if (cfg == nil){
+		return;
+	}
+	for ind, room := range cfg.SavedRooms{
+		extra := "";
+		if (room.Nickname != ""){
+			extra += fmt.Sprintf(", Nickname: %s", room.Nickname);
+		}
+		if (room.AutoConnect){
+			extra += fmt.Sprintf(", Auto-connect: order %d", room.JoinOrder);
+		}
+		fmt.Fprintf(out, "%d) : Alias: %s, Address: %s%s\n",ind, room.Alias, room.Addr, extra);
 	}
 }
\ No newline at end of file
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBrokenConfigIsKept(t *testing.T){
+	dir := t.TempDir();
+	path := filepath.Join(dir, ConfigFileName);
+	broken := []byte("{\"SavedRooms\": [{\"Alias\": \"home\",");
+	err := os.WriteFile(path, broken, 0600);
+	if (err != nil){
+		t.Fatalf("unable to write config: %s", err);
+	}
+
+	session := NewSession(discardLogger);
+	LoadConfig(session, dir);
+	if (len(GetSavedAliases(session)) != 0){
+		t.Fatalf("expected an empty config, got %v", GetSavedAliases(session));
+	}
+	err = SaveRoom(session, "work", "127.0.0.1:9002", "");
+	if (err != nil){
+		t.Fatalf("unable to save room: %s", err);
+	}
+
+	backup, err := os.ReadFile(path + ".bak");
+	if (err != nil){
+		t.Fatalf("broken config wasn't kept: %s", err);
+	}
+	if (string(backup) != string(broken)){
+		t.Errorf("backup is %q, expected %q", backup, broken);
+	}
+	session = NewSession(discardLogger);
+	LoadConfig(session, dir);
+	aliases := GetSavedAliases(session);
+	if ((len(aliases) != 1) || (aliases[0] != "work")){
+		t.Errorf("saved config has %v, expected [work]", aliases);
+	}
+}
+
+func TestConfigIsOnlyChangedOnceWritten(t *testing.T){
+	dir := filepath.Join(t.TempDir(), "config");
+	session := NewSession(discardLogger);
+	LoadConfig(session, dir);
+	err := SaveRoom(session, "home", "127.0.0.1:9001", "");
+	if (err != nil){
+		t.Fatalf("unable to save room: %s", err);
+	}
+
+	// Readers run alongside the changes, -race catches them touching the
+	// config without the lock
+	done := make(chan bool);
+	go func(){
+		defer close(done);
+		for range 100{
+			GetSavedAliases(session);
+			autoConnectRooms(session);
+			configCompression(session);
+		}
+	}();
+	for i := range 20{
+		err = SetRoomJoinOrder(session, "home", i);
+		if (err != nil){
+			t.Fatalf("unable to change room: %s", err);
+		}
+	}
+	<- done;
+
+	// Nothing can be written once the directory is a file
+	err = os.RemoveAll(dir);
+	if (err == nil){
+		err = os.WriteFile(dir, []byte{}, 0600);
+	}
+	if (err != nil){
+		t.Fatalf("unable to replace the config directory: %s", err);
+	}
+	err = SaveRoom(session, "work", "127.0.0.1:9002", "");
+	if (err == nil){
+		t.Fatalf("expected saving to fail");
+	}
+	err = RenameRoom(session, "home", "house");
+	if (err == nil){
+		t.Fatalf("expected renaming to fail");
+	}
+	aliases := GetSavedAliases(session);
+	if ((len(aliases) != 1) || (aliases[0] != "home")){
+		t.Errorf("config has %v after the writes failed, expected [home]", aliases);
+	}
+}
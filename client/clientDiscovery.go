@@ -0,0 +1,143 @@
+package client
+
+// Listens for servers advertising their rooms on the local network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"p2psystem/common"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// DiscoveryExpiry is how long a discovered room is kept after its last
+	// advertisement
+	DiscoveryExpiry = 10 * time.Second;
+)
+
+// DiscoveredRoom is a room that advertised itself on the local network
+type DiscoveredRoom struct{
+	Addr string;
+	Advert common.RoomAdvertisement;
+	LastSeen time.Time;
+}
+
+// StartDiscovery listens for room advertisements on the config's
+// DiscoveryAddr in the background and caches every room it hears from
+func StartDiscovery(session *ClientSession) (error){
+	addr := common.DefaultDiscoveryAddr;
+	cfg := GetConfig(session);
+	if ((cfg != nil) && (cfg.DiscoveryAddr != "")){
+		addr = cfg.DiscoveryAddr;
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr);
+	if (err != nil){
+		return fmt.Errorf("clientDiscovery: %s", err);
+	}
+
+	var socket *net.UDPConn;
+	if (udpAddr.IP.IsMulticast()){
+		socket, err = net.ListenMulticastUDP("udp4", nil, udpAddr);
+	} else {
+		socket, err = net.ListenUDP("udp4", &net.UDPAddr{Port: udpAddr.Port});
+	}
+	if (err != nil){
+		return fmt.Errorf("clientDiscovery: unable to listen on %s: %s", addr, err);
+	}
+
+	session.discoveryLock.Lock();
+	session.discoverySocket = socket;
+	session.discoveryLock.Unlock();
+
+	go func(){
+		data := make([]byte, 2048);
+		for {
+			size, source, err := socket.ReadFromUDP(data);
+			if (err != nil){
+				// The socket was closed by StopDiscovery
+				return;
+			}
+
+			var advert common.RoomAdvertisement;
+			err = json.Unmarshal(data[:size], &advert);
+			if ((err != nil) || (advert.Port <= 0)){
+				continue;
+			}
+			roomAddr := net.JoinHostPort(source.IP.String(), strconv.Itoa(advert.Port));
+
+			session.discoveryLock.Lock();
+			session.discovered[roomAddr] = DiscoveredRoom{
+				Addr: roomAddr,
+				Advert: advert,
+				LastSeen: time.Now(),
+			};
+			session.discoveryLock.Unlock();
+		}
+	}();
+
+	return nil;
+}
+
+// StopDiscovery stops listening for room advertisements
+func StopDiscovery(session *ClientSession){
+	session.discoveryLock.Lock();
+	defer session.discoveryLock.Unlock();
+
+	if (session.discoverySocket != nil){
+		session.discoverySocket.Close();
+		session.discoverySocket = nil;
+	}
+}
+
+// GetDiscoveredRooms returns every room that's advertised itself recently,
+// sorted by name and then address
+func GetDiscoveredRooms(session *ClientSession) ([]DiscoveredRoom){
+	session.discoveryLock.Lock();
+	defer session.discoveryLock.Unlock();
+
+	retVal := make([]DiscoveredRoom, 0, len(session.discovered));
+	for addr, room := range session.discovered{
+		if (time.Since(room.LastSeen) > DiscoveryExpiry){
+			delete(session.discovered, addr);
+			continue;
+		}
+		retVal = append(retVal, room);
+	}
+
+	sort.Slice(retVal, func(i int, j int) (bool){
+		if (retVal[i].Advert.Name != retVal[j].Advert.Name){
+			return retVal[i].Advert.Name < retVal[j].Advert.Name;
+		}
+		return retVal[i].Addr < retVal[j].Addr;
+	});
+	return retVal;
+}
+
+// DisplayDiscoveredRooms prints every discovered room to out and returns
+// them in the order they were numbered
+func DisplayDiscoveredRooms(session *ClientSession, out io.Writer) ([]DiscoveredRoom){
+	rooms := GetDiscoveredRooms(session);
+	if (len(rooms) == 0){
+		fmt.Fprint(out, "No rooms found on the local network\n");
+		return rooms;
+	}
+
+	for ind, room := range rooms{
+		name := room.Advert.Name;
+		if (name == ""){
+			name = "(unnamed)";
+		}
+		locked := "";
+		if (room.Advert.Password){
+			locked = ", password required";
+		}
+		fmt.Fprintf(out, "%d) : Name: %s, Address: %s, Users: %d/%d%s\n", ind, name, room.Addr,
+			room.Advert.Users, room.Advert.MaxUsers, locked);
+	}
+	return rooms;
+}
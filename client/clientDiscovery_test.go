@@ -0,0 +1,105 @@
+package client
+
+import (
+	"net"
+	"p2psystem/common"
+	"p2psystem/server"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryHearsAdvertisedRoom(t *testing.T){
+	// Find a UDP port nothing else is using for the adverts
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)});
+	if (err != nil){
+		t.Fatalf("unable to find a free port: %s", err);
+	}
+	discoveryAddr := probe.LocalAddr().String();
+	probe.Close();
+
+	session := NewSession(discardLogger);
+	LoadConfig(session, t.TempDir());
+	err = updateConfig(session, func(cfg *Config) (error){
+		cfg.DiscoveryAddr = discoveryAddr;
+		return nil;
+	});
+	if (err != nil){
+		t.Fatalf("unable to set the discovery address: %s", err);
+	}
+	err = StartDiscovery(session);
+	if (err != nil){
+		t.Fatalf("unable to start discovery: %s", err);
+	}
+	t.Cleanup(func(){
+		StopDiscovery(session);
+	});
+
+	cfg := server.DefaultServerConfig();
+	cfg.Name = "lobby";
+	cfg.MaxClients = 5;
+	cfg.Password = "secret";
+	cfg.Advertise = true;
+	cfg.DiscoveryAddr = discoveryAddr;
+	room, err := server.New(server.ServerOptions{
+		Config: &cfg,
+		Listen: server.ListenAddrs{"127.0.0.1:0"},
+		Logger: discardLogger,
+	});
+	if (err != nil){
+		t.Fatalf("unable to create server: %s", err);
+	}
+	_, err = server.Start(room);
+	if (err != nil){
+		t.Fatalf("unable to start server: %s", err);
+	}
+	t.Cleanup(func(){
+		server.Stop(room);
+	});
+	roomAddr := server.BoundAddrs(room)[0];
+
+	// Rooms advertise every DiscoveryInterval
+	deadline := time.Now().Add(server.DiscoveryInterval + testTimeout);
+	rooms := GetDiscoveredRooms(session);
+	for (len(rooms) == 0){
+		if (time.Now().After(deadline)){
+			t.Fatalf("didn't hear from the room");
+		}
+		time.Sleep(50 * time.Millisecond);
+		rooms = GetDiscoveredRooms(session);
+	}
+	expected := common.RoomAdvertisement{Name: "lobby", Port: rooms[0].Advert.Port, MaxUsers: 5, Password: true};
+	if ((len(rooms) != 1) || (rooms[0].Addr != roomAddr) || (rooms[0].Advert != expected)){
+		t.Errorf("discovered %+v, expected %+v at %s", rooms, expected, roomAddr);
+	}
+	if (roomAddr != net.JoinHostPort("127.0.0.1", strconv.Itoa(rooms[0].Advert.Port))){
+		t.Errorf("advertised port %d for a room at %s", rooms[0].Advert.Port, roomAddr);
+	}
+}
+
+func TestDiscoveredRoomsExpire(t *testing.T){
+	session := NewSession(discardLogger);
+	now := time.Now();
+	session.discovered = map[string]DiscoveredRoom{
+		"10.0.0.3:9000": {Addr: "10.0.0.3:9000", Advert: common.RoomAdvertisement{Name: "b"}, LastSeen: now},
+		"10.0.0.2:9000": {Addr: "10.0.0.2:9000", Advert: common.RoomAdvertisement{Name: "a"}, LastSeen: now},
+		"10.0.0.1:9000": {Addr: "10.0.0.1:9000", Advert: common.RoomAdvertisement{Name: "b"}, LastSeen: now},
+		"10.0.0.4:9000": {Addr: "10.0.0.4:9000", Advert: common.RoomAdvertisement{Name: "a"},
+			LastSeen: now.Add(-DiscoveryExpiry - time.Second)},
+	};
+
+	rooms := GetDiscoveredRooms(session);
+	expected := []string{"10.0.0.2:9000", "10.0.0.1:9000", "10.0.0.3:9000"};
+	if (len(rooms) != len(expected)){
+		t.Fatalf("got %d rooms, expected %d", len(rooms), len(expected));
+	}
+	for i, room := range rooms{
+		if (room.Addr != expected[i]){
+			t.Errorf("room %d is %s, expected %s", i, room.Addr, expected[i]);
+		}
+	}
+	_, kept := session.discovered["10.0.0.4:9000"];
+	if (kept){
+		t.Errorf("the expired room is still cached");
+	}
+}
@@ -0,0 +1,185 @@
+package client
+
+// Turns the packets servers send into events that programs using the client
+// can subscribe to instead of reading them from stdout
+
+import (
+	"encoding/json"
+	"fmt"
+	"p2psystem/common"
+	"strings"
+	"time"
+)
+
+// EventType identifies what happened in an Event
+type EventType int;
+
+const (
+	// EventConnect is sent once a connection finishes its handshake
+	EventConnect EventType = iota;
+	// EventMessage is a chat message sent to the room. Nickname is the sender
+	EventMessage;
+	// EventAnnouncement is a message from the server itself
+	EventAnnouncement;
+	// EventKick is sent when the server removes the client and Text is the reason
+	EventKick;
+	// EventDisconnect is sent once a connection is closed for any reason
+	EventDisconnect;
+	// EventNicknameChange is sent when anyone in the room changes their
+	// nickname. Nickname is the old name and Text is the new one
+	EventNicknameChange;
+	// EventMembers is sent whenever the server's list of members changes.
+	// Nickname is this client's own nickname on the server
+	EventMembers;
+	// EventDirectMessage is a message sent only to this client. Nickname is
+	// the sender
+	EventDirectMessage;
+)
+
+// Event is something that happened on one of a session's connections
+type Event struct{
+	Type EventType;
+	Connection *ClientConnection;
+	Addr string;		// The address of the server the event came from
+	Nickname string;
+	Text string;
+	Members []string;	// Only set for EventMembers
+	Timestamp time.Time;
+}
+
+// EventHandler is implemented by anything that wants to receive a session's
+// events. HandleEvent is called from the connection's goroutine so it should
+// return quickly
+type EventHandler interface{
+	HandleEvent(event Event);
+}
+
+// EventHandlerFunc lets an ordinary function be used as an EventHandler
+type EventHandlerFunc func(event Event);
+
+func (handler EventHandlerFunc) HandleEvent(event Event){
+	handler(event);
+}
+
+// String returns the lowercase name of the event type
+func (eventType EventType) String() (string){
+	switch eventType{
+	case EventConnect: return "connect";
+	case EventMessage: return "message";
+	case EventAnnouncement: return "announcement";
+	case EventKick: return "kick";
+	case EventDisconnect: return "disconnect";
+	case EventNicknameChange: return "nickname";
+	case EventMembers: return "members";
+	case EventDirectMessage: return "direct";
+	}
+	return fmt.Sprintf("unknown(%d)", int(eventType));
+}
+
+// AddHandler registers handler to be called with every event on the session
+func AddHandler(session *ClientSession, handler EventHandler){
+	session.handlerLock.Lock();
+	defer session.handlerLock.Unlock();
+	session.handlers = append(session.handlers, handler);
+}
+
+// Subscribe returns a channel that receives every event on the session. The
+// channel holds up to size events, after which the connections wait for the
+// events to be read
+func Subscribe(session *ClientSession, size int) (<-chan Event){
+	events := make(chan Event, size);
+	AddHandler(session, EventHandlerFunc(func(event Event){
+		events <- event;
+	}));
+	return events;
+}
+
+// emit passes event to every handler registered on the session
+func emit(session *ClientSession, event Event){
+	session.handlerLock.Lock();
+	handlers := make([]EventHandler, len(session.handlers));
+	copy(handlers, session.handlers);
+	session.handlerLock.Unlock();
+
+	for _, handler := range handlers{
+		handler.HandleEvent(event);
+	}
+}
+
+// newEvent returns an event of the given type from the connection
+func newEvent(connection *ClientConnection, eventType EventType) (Event){
+	return Event{
+		Type: eventType,
+		Connection: connection,
+		Addr: connection.addr,
+		Timestamp: time.Now(),
+	};
+}
+
+// packetEvent converts a packet from the server into an event. Packets that
+// don't have an event return false
+func packetEvent(connection *ClientConnection, pkt *common.MsgPacket) (Event, bool, error){
+	var event Event;
+	switch pkt.PktType{
+	case common.PktMSG:{
+		event = newEvent(connection, EventMessage);
+	}
+	case common.PktANC:{
+		event = newEvent(connection, EventAnnouncement);
+	}
+	case common.PktKCK:{
+		event = newEvent(connection, EventKick);
+	}
+	case common.PktMDF:{
+		event = newEvent(connection, EventNicknameChange);
+	}
+	case common.PktMEM:{
+		event = newEvent(connection, EventMembers);
+	}
+	case common.PktWSP:{
+		event = newEvent(connection, EventDirectMessage);
+	}
+	default:{
+		return event, false, nil;
+	}
+	}
+
+	if (pkt.Timestamp != 0){
+		event.Timestamp = time.Unix(int64(pkt.Timestamp), 0);
+	}
+	event.Nickname = strings.TrimRight(pkt.SendNickname, "\x00");
+
+	msg, err := common.DecodeMessage(pkt);
+	if (err != nil){
+		return event, false, fmt.Errorf("clientEvents: %s", err);
+	}
+	event.Text = strings.TrimRight(msg, "\x00");
+
+	if (pkt.PktType == common.PktMDF){
+		var change common.ClientModifcation;
+		err = json.Unmarshal([]byte(event.Text), &change);
+		if (err != nil){
+			return event, false, fmt.Errorf("clientEvents: %s", err);
+		}
+		event.Text = change.NewName;
+	}
+	if (pkt.PktType == common.PktWSP){
+		var whisper common.Whisper;
+		err = json.Unmarshal([]byte(event.Text), &whisper);
+		if (err != nil){
+			return event, false, fmt.Errorf("clientEvents: %s", err);
+		}
+		event.Text = whisper.Text;
+	}
+	if (pkt.PktType == common.PktMEM){
+		var list common.MemberList;
+		err = json.Unmarshal([]byte(event.Text), &list);
+		if (err != nil){
+			return event, false, fmt.Errorf("clientEvents: %s", err);
+		}
+		event.Text = "";
+		event.Nickname = list.Nickname;
+		event.Members = list.Members;
+	}
+	return event, true, nil;
+}
@@ -17,72 +17,132 @@ import (
 func handleHandshake(session *ClientSession, connection *ClientConnection) (bool, error){
 	var data []byte = make([]byte, common.PktBufferSize);
 
-	//fmt.Printf("clientHandshake: connecting with %s from %s\n", connection.server.RemoteAddr(), connection.server.LocalAddr());
+	session.log.Debug("beginning handshake", "remote", connection.server.RemoteAddr(), "local", connection.server.LocalAddr());
 	connection.server.SetReadDeadline(time.Now().Add(4 * time.Second));
-	_, err := connection.server.Read(data);
+	_, err := io.ReadFull(connection.server, data);
 	if (err != nil){
 		if (errors.Is(err, os.ErrDeadlineExceeded)){
-			fmt.Printf("clientHandshake: server timed out\n");
-			return false, nil;
+			session.log.Info("server timed out during handshake", "remote", connection.server.RemoteAddr());
+			return false, fmt.Errorf("clientHandshake: server timed out");
 		}
 
-		fmt.Printf("clientHandshake: %s", err);
+		session.log.Warn("unable to read handshake", "remote", connection.server.RemoteAddr(), "err", err);
 		return false, fmt.Errorf("clientHandshake: %s", err);
 	}
-	//fmt.Printf("clientHandshake: recieved packet\n");
 
 	pkt := common.DeserializePacket(data);
+	session.log.Debug("received packet", "remote", connection.server.RemoteAddr(), "packet", common.PacketName(pkt.PktType));
 	if (pkt.PktType == common.PktREF){
-		fmt.Printf("clientHandshake: server refused connection\n");
-		return false, nil;
+		session.log.Info("server refused connection", "remote", connection.server.RemoteAddr());
+		return false, fmt.Errorf("clientHandshake: server refused connection");
 	} else if (pkt.PktType != common.PktACP){
-		fmt.Printf("clientHandshake: unrecognised packet type\n");
-		return false, nil;
+		session.log.Warn("unrecognised packet type during handshake", "remote", connection.server.RemoteAddr(),
+			"packet", common.PacketName(pkt.PktType));
+		return false, fmt.Errorf("clientHandshake: unrecognised packet type");
 	}
 
-	//fmt.Printf("clientHandshake: recevied ACP packet\n");
+	// Older servers send the ACP without a ServerHello, in which case the
+	// client uses the encoding they know
+	var serverHello common.ServerHello;
+	if (pkt.PayloadSize > 0){
+		helloRaw, err := common.DecodeMessage(&pkt);
+		if (err == nil){
+			err = json.Unmarshal([]byte(strings.TrimRight(helloRaw, "\x00")), &serverHello);
+		}
+		if (err != nil){
+			session.log.Warn("unable to unpack ACP packet", "remote", connection.server.RemoteAddr(), "err", err);
+		}
+	}
+	methods, compression := configCompression(session);
+	compression.Method = common.ChooseCompression(methods, serverHello.Compression);
+	connection.compression = compression;
+	// Everything after the ACK is in compact frames if the server offered them
+	connection.compact = serverHello.Compact;
+	session.log.Debug("chose compression", "remote", connection.server.RemoteAddr(), "compression", compression.Method,
+		"compact", connection.compact);
+
 	// Then prepare the ACK packet
 	pkt = common.MsgPacket{
 		PktType: common.PktACK,
 	}
 	// Encode the data in
 	var modifierpkt common.ClientModifcation = common.ClientModifcation{
-		NewName: session.Config.DefaultName,
+		NewName: connection.nickname,
+		Password: connection.password,
+		Compression: compression.Method,
+		Compact: connection.compact,
 	}
 	// Then write it to JSON
 	ackPkt, err := json.Marshal(modifierpkt);
 	if (err != nil){
-		fmt.Printf("clientHandshake: unable to encode config to ACK packet: %s\n", err);
+		session.log.Error("unable to encode config to ACK packet", "err", err);
 		return false, fmt.Errorf("clientHandshake: %s", err);
 	}
-	err = common.EncodeMessage(&pkt, strings.Trim(string(ackPkt), "\x00"));
+	// The server doesn't know the choice until it's read this
+	err = common.EncodeMessageWith(&pkt, strings.Trim(string(ackPkt), "\x00"), common.Compression{});
 	if (err != nil){
-		fmt.Printf("clientHandshake: unable to encode json: %s\n", err);
+		session.log.Error("unable to encode ACK packet", "err", err);
 		return false, fmt.Errorf("clientHandshake: %s", err);
 	}
 
 	err = common.SerializePacket(&pkt, data);
 	if (err != nil){
-		fmt.Printf("clientHandshake: unable to serialize ACK packet: %s\n", err);
+		session.log.Error("unable to serialize ACK packet", "err", err);
 		return false, fmt.Errorf("clientHandshake: %s", err);
 	}
 	_, err = connection.server.Write(data);
 	if (err != nil){
-		fmt.Printf("clientHandshake: uanble to send ACK packet: %s\n", err);
+		session.log.Error("unable to send ACK packet", "remote", connection.server.RemoteAddr(), "err", err);
 		return false, fmt.Errorf("clientHandshake: %s", err);
 	}
 
 	return true, nil;
 }
 
+// configCompression returns the compression methods the config prefers and
+// the level and threshold to compress with, using the defaults for anything
+// that isn't set or isn't valid
+func configCompression(session *ClientSession) ([]string, common.Compression){
+	methods := common.DefaultCompressionMethods;
+	compression := common.Compression{
+		Level: common.DefaultCompressionLevel,
+		Threshold: common.DefaultCompressionThreshold,
+	};
+	cfg := GetConfig(session);
+	if (cfg == nil){
+		return methods, compression;
+	}
+	if (len(cfg.Compression) > 0){
+		methods = cfg.Compression;
+	}
+	if (cfg.CompressionLevel != 0){
+		compression.Level = cfg.CompressionLevel;
+	}
+	if (cfg.CompressionThreshold != 0){
+		compression.Threshold = cfg.CompressionThreshold;
+	}
+	err := common.ValidateCompression(methods, compression.Level, compression.Threshold);
+	if (err != nil){
+		session.log.Warn("invalid compression in client config, using the defaults", "err", err);
+		return common.DefaultCompressionMethods, common.Compression{
+			Level: common.DefaultCompressionLevel,
+			Threshold: common.DefaultCompressionThreshold,
+		};
+	}
+	return methods, compression;
+}
+
 // clientHandler contains the functions used by the goroutine that's run
 // when a connection is successfully established
 
 func connMain(connection *ClientConnection) (error){
-	fmt.Printf("Connected to %s\n",connection.server.RemoteAddr().String());
+	session := connection.session;
+	openTranscript(connection);
+	emit(session, newEvent(connection, EventConnect));
 
 	var dataBuffer [common.PktBufferSize]byte;
-	var canRead chan bool = make(chan bool);
+	var canRead chan *common.MsgPacket = make(chan *common.MsgPacket);
+	stopReading := make(chan bool);
 
 	connection.server.SetReadDeadline(time.Time{});
 
@@ -92,64 +152,71 @@ func connMain(connection *ClientConnection) (error){
 	go func(){
 		defer childThreads.Done();
 
+		// Each packet is read into its own buffer so the next read can't
+		// overwrite it while it's being handled
+		var readBuffer [common.PktBufferSize]byte;
 		for {
-			_, err := connection.server.Read(dataBuffer[:]);
+			var pkt *common.MsgPacket;
+			err := common.ReadPacket(connection.server, readBuffer[:], connection.compact);
 			if (err != nil){
-				if ((errors.Is(err, io.ErrUnexpectedEOF)) || (errors.Is(err, io.EOF))){
-					canRead <- false;
-					break;
-				}
-				// Silently handle errors here
-				//fmt.Printf("clientMain: Unable to read from server: %s\n", err);
-				break;
+				// Errors here are expected when the connection is closed
+				connection.log.Debug("stopped reading from server", "remote", connection.server.RemoteAddr(), "err", err);
+			} else {
+				deserialized := common.DeserializePacket(readBuffer[:]);
+				pkt = &deserialized;
 			}
 
-			canRead <- true;
+			select {
+			case canRead <- pkt:
+			case <- stopReading:{
+				return;
+			}
+			}
+			if (pkt == nil){
+				return;
+			}
 		}
 	}();
+	defer func(){
+		connection.dead.Store(true);
+		connection.server.Close();
+		close(stopReading);
+		childThreads.Wait();
+		closeTranscript(connection);
+		emit(session, newEvent(connection, EventDisconnect));
+		close(connection.finished);
+	}();
 
 	var brk bool = false;
 
 	for {
 		if (brk){break;}
 		select {
-		case active := <- canRead:{
-			if (!active){
+		case inboundPkt := <- canRead:{
+			if (inboundPkt == nil){
 				brk = true;
 				continue;
 			}
-			// Deserialize the packet
-			pkt := common.DeserializePacket(dataBuffer[:]);
-			switch pkt.PktType{
-			case common.PktMSG:{
-				timestamp := time.Unix(int64(pkt.Timestamp), 0);
-				msg, err := common.DecodeMessage(&pkt);
-				if (err != nil){
-					fmt.Printf("clientMain: unable to decode packet message\n");
-					return fmt.Errorf("clientMain: %s", err);
-				}
-				fmt.Printf("%s %s : %s\n", pkt.SendNickname, timestamp.Format(time.Kitchen), msg);
+			event, ok, err := packetEvent(connection, inboundPkt);
+			if (err != nil){
+				connection.log.Warn("unable to decode packet", "remote", connection.server.RemoteAddr(),
+					"packet", common.PacketName(inboundPkt.PktType), "err", err);
+				return fmt.Errorf("clientMain: %s", err);
 			}
-			case common.PktANC:{
-				timestamp := time.Unix(int64(pkt.Timestamp), 0);
-				msg, err := common.DecodeMessage(&pkt);
-				if (err != nil){
-					fmt.Printf("clientMain: unable to decode packet message\n");
-					return fmt.Errorf("clientMain: %s", err);
-				}
-				fmt.Printf("Server %s: %s\n", timestamp.Format(time.Kitchen), msg);
+			if (!ok){
+				continue;
 			}
-			case common.PktKCK:{
-				timestamp := time.Unix(int64(pkt.Timestamp), 0);
-				msg, err := common.DecodeMessage(&pkt);
-				if (err != nil){
-					fmt.Printf("clientMain: unable to decode packet message\n");
-					return fmt.Errorf("clientMain: %s", err);
-				}
-
-				fmt.Printf("Server %s: %s\n", timestamp.Format(time.Kitchen), msg);
+			if (event.Type == EventMembers){
+				connection.memberLock.Lock();
+				connection.nickname = event.Nickname;
+				connection.members = event.Members;
+				connection.memberLock.Unlock();
 			}
+			entry, isEntry := transcriptEntry(event);
+			if (isEntry){
+				recordTranscript(connection, entry);
 			}
+			emit(session, event);
 		}
 		case currentIns := <- connection.instructions:{
 			switch currentIns{
@@ -158,7 +225,7 @@ func connMain(connection *ClientConnection) (error){
 					pkt := common.MsgPacket{PktType: common.PktDCN};
 					common.SerializePacket(&pkt, dataBuffer[:]);
 
-					_, err := connection.server.Write(dataBuffer[:]);
+					err := common.WritePacket(connection.server, dataBuffer[:], connection.compact);
 
 					if (err != nil){
 						if !((err == io.EOF) || (err == io.ErrUnexpectedEOF)){
@@ -173,36 +240,42 @@ func connMain(connection *ClientConnection) (error){
 		}
 		}
 	}
-	connection.dead = true;
-	connection.server.Close();
-	childThreads.Wait();
 	return nil;
 }
 
 // Performs the handshake with the given connection and if successful, adds it
 // to the clientSession
-func createConnection(session *ClientSession, connection net.Conn) (error){
+func createConnection(session *ClientSession, connection net.Conn, addr string, password string) (*ClientConnection, error){
 	// Create a client connection
 	newClient := ClientConnection{
 		server: connection,
-		instructions: make(chan uint8),
-		dead: false,
+		instructions: make(chan uint8, 1),
+		finished: make(chan bool),
+		password: password,
+		addr: addr,
+		session: session,
+		log: session.log,
+		nickname: connectionNickname(session, addr),
 	}
 
 	status, err := handleHandshake(session,&newClient);
 
 	if (err != nil){
-		fmt.Printf("clientHandler.makeConnection: unable to complete handshake: %s", err);
-		return fmt.Errorf("clientHandler.makeConnection: %s", err);
+		connection.Close();
+		return nil, fmt.Errorf("clientHandler.makeConnection: %s", err);
 	}
 	if (!status){
-		return nil;
+		connection.Close();
+		return nil, fmt.Errorf("clientHandler.makeConnection: unable to complete handshake");
 	}
+	// Rooms can be joined in parallel on start up
+	session.connectionLock.Lock();
+	defer session.connectionLock.Unlock();
 	// Find the first suitible location in the session
 	var indexToInsertTo int = -1;
 	for ind, val := range session.connectedServers{
 		if (val == nil){continue;}
-		if (val.dead){
+		if (val.dead.Load()){
 			indexToInsertTo = ind;
 			break;
 		}
@@ -212,8 +285,8 @@ func createConnection(session *ClientSession, connection net.Conn) (error){
 	} else {
 		session.connectedServers = append(session.connectedServers, &newClient);
 	}
-	session.CurrentConnection = &newClient;
+	session.currentConnection = &newClient;
 	go connMain(&newClient);
 
-	return nil;
+	return &newClient, nil;
 }
\ No newline at end of file
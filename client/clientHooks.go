@@ -0,0 +1,263 @@
+package client
+
+// Runs programs from the config when something happens in a room, so the user
+// can be notified while the terminal isn't focused or automate replies
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The events a hook can run on
+const (
+	// HookMention runs when a message in a room contains this client's
+	// nickname
+	HookMention = "mention";
+	// HookDirect runs when a message is sent only to this client
+	HookDirect = "direct";
+	// HookKick runs when a server kicks this client
+	HookKick = "kick";
+	// HookDisconnect runs when a server closes the connection, but not when
+	// the client disconnects itself
+	HookDisconnect = "disconnect";
+)
+
+const (
+	// HookTimeout is how long a hook can run before it's killed if it doesn't
+	// give its own Timeout
+	HookTimeout = 10 * time.Second;
+	// DefaultMaxHookProcesses is how many hooks can run at once if the config
+	// doesn't say
+	DefaultMaxHookProcesses = 4;
+	// hookBacklog is how many hooks can wait for a free process before any
+	// more are dropped
+	hookBacklog = 64;
+)
+
+// Hook is a program run on an event. The event is passed to it both as
+// GOMSG_ environment variables and as a HookEvent in JSON on stdin
+type Hook struct{
+	Event string;		// HookMention, HookDirect, HookKick or HookDisconnect
+	Command string;		// The program, looked up on PATH if it isn't a path
+	Args []string `json:",omitempty"`;
+	// Timeout is how many seconds the program has before it's killed. If it's
+	// 0 HookTimeout is used
+	Timeout int `json:",omitempty"`;
+}
+
+// HookEvent is what a hook is told about the event it's run for
+type HookEvent struct{
+	Hook string `json:"hook"`;				// The Hook's Event
+	Room string `json:"room"`;				// The address of the server
+	Nickname string `json:"nickname"`;		// Who sent the message, if there was one
+	Self string `json:"self"`;				// This client's nickname in the room
+	Timestamp string `json:"timestamp"`;	// RFC 3339
+	Text string `json:"text"`;				// The message or kick reason
+}
+
+// hookRun is a hook waiting to be run
+type hookRun struct{
+	hook Hook;
+	event HookEvent;
+}
+
+// startHooks starts the processes that run the config's hooks and subscribes
+// them to the session's events. Hooks that can't be run are logged and left
+// out
+func startHooks(session *ClientSession){
+	cfg := GetConfig(session);
+	if (cfg == nil){
+		return;
+	}
+	hooks := []Hook{};
+	for _, hook := range cfg.Hooks{
+		switch hook.Event{
+		case HookMention, HookDirect, HookKick, HookDisconnect:
+		default:{
+			session.log.Warn("unknown hook event, ignoring the hook", "event", hook.Event, "command", hook.Command);
+			continue;
+		}
+		}
+		if (hook.Command == ""){
+			session.log.Warn("hook has no command, ignoring it", "event", hook.Event);
+			continue;
+		}
+		hooks = append(hooks, hook);
+	}
+	if (len(hooks) == 0){
+		return;
+	}
+
+	processes := cfg.MaxHookProcesses;
+	if (processes <= 0){
+		processes = DefaultMaxHookProcesses;
+	}
+	session.hookQueue = make(chan hookRun, hookBacklog);
+	for range processes{
+		session.hookWorkers.Add(1);
+		go func(){
+			defer session.hookWorkers.Done();
+			for run := range session.hookQueue{
+				runHook(session, run);
+			}
+		}();
+	}
+
+	AddHandler(session, EventHandlerFunc(func(event Event){
+		hookName, hookEvent := hookEventFor(event);
+		if (hookName == ""){
+			return;
+		}
+		for _, hook := range hooks{
+			if (hook.Event == hookName){
+				queueHook(session, hookRun{hook: hook, event: hookEvent});
+			}
+		}
+	}));
+	session.log.Info("hooks started", "hooks", len(hooks), "processes", processes);
+}
+
+// StopHooks stops running hooks for new events and waits for the ones already
+// queued to finish
+func StopHooks(session *ClientSession){
+	session.hookLock.Lock();
+	if ((session.hookQueue == nil) || session.hooksStopped){
+		session.hookLock.Unlock();
+		return;
+	}
+	session.hooksStopped = true;
+	close(session.hookQueue);
+	session.hookLock.Unlock();
+	session.hookWorkers.Wait();
+}
+
+// queueHook queues a hook to run. It's called from the connection's goroutine
+// so it never waits, and the hook is dropped if the queue is full
+func queueHook(session *ClientSession, run hookRun){
+	session.hookLock.Lock();
+	defer session.hookLock.Unlock();
+	if (session.hooksStopped){
+		return;
+	}
+	select {
+	case session.hookQueue <- run:
+	default:{
+		session.log.Warn("too many hooks waiting to run, dropping one", "event", run.hook.Event, "command", run.hook.Command);
+	}
+	}
+}
+
+// hookEventFor returns which hook the event runs and what the hook is told
+// about it, or a blank name if it doesn't run one
+func hookEventFor(event Event) (string, HookEvent){
+	self := GetConnectionNickname(event.Connection);
+	hookEvent := HookEvent{
+		Room: event.Addr,
+		Nickname: event.Nickname,
+		Self: self,
+		Timestamp: event.Timestamp.Format(time.RFC3339),
+		Text: event.Text,
+	};
+	switch event.Type{
+	case EventMessage:{
+		if ((event.Nickname == self) || !mentions(event.Text, self)){
+			return "", hookEvent;
+		}
+		hookEvent.Hook = HookMention;
+	}
+	case EventDirectMessage:{
+		hookEvent.Hook = HookDirect;
+	}
+	case EventKick:{
+		hookEvent.Hook = HookKick;
+		hookEvent.Nickname = "";
+	}
+	case EventDisconnect:{
+		if ((event.Connection != nil) && event.Connection.leaving.Load()){
+			return "", hookEvent;
+		}
+		hookEvent.Hook = HookDisconnect;
+	}
+	}
+	return hookEvent.Hook, hookEvent;
+}
+
+// mentions returns true if text contains nickname as a word of its own,
+// ignoring case
+func mentions(text string, nickname string) (bool){
+	if (nickname == ""){
+		return false;
+	}
+	text = strings.ToLower(text);
+	nickname = strings.ToLower(nickname);
+	isWord := func(char rune) (bool){
+		return (unicode.IsLetter(char) || unicode.IsDigit(char) || (char == '_'));
+	};
+
+	start := 0;
+	for {
+		index := strings.Index(text[start:], nickname);
+		if (index < 0){
+			return false;
+		}
+		index += start;
+		before, _ := utf8.DecodeLastRuneInString(text[:index]);
+		after, _ := utf8.DecodeRuneInString(text[index + len(nickname):]);
+		if (!isWord(before) && !isWord(after)){
+			return true;
+		}
+		start = index + 1;
+	}
+}
+
+// runHook runs the hook's program and waits for it to exit or time out. Its
+// output goes to the log so it can't draw over the CLI
+func runHook(session *ClientSession, run hookRun){
+	timeout := HookTimeout;
+	if (run.hook.Timeout > 0){
+		timeout = time.Duration(run.hook.Timeout) * time.Second;
+	}
+	input, err := json.Marshal(run.event);
+	if (err != nil){
+		session.log.Error("unable to encode hook event", "err", err);
+		return;
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout);
+	defer cancel();
+	cmd := exec.CommandContext(ctx, run.hook.Command, run.hook.Args...);
+	cmd.Env = append(os.Environ(),
+		"GOMSG_HOOK=" + run.event.Hook,
+		"GOMSG_ROOM=" + run.event.Room,
+		"GOMSG_NICKNAME=" + run.event.Nickname,
+		"GOMSG_SELF=" + run.event.Self,
+		"GOMSG_TIMESTAMP=" + run.event.Timestamp,
+		"GOMSG_TEXT=" + run.event.Text,
+	);
+	cmd.Stdin = bytes.NewReader(append(input, '\n'));
+	// Don't wait forever on output from anything the program left running
+	cmd.WaitDelay = time.Second;
+
+	output, err := cmd.CombinedOutput();
+	switch {
+	case (ctx.Err() == context.DeadlineExceeded):{
+		session.log.Warn("hook timed out", "event", run.hook.Event, "command", run.hook.Command, "timeout", timeout);
+	}
+	case (err != nil):{
+		session.log.Warn("hook failed", "event", run.hook.Event, "command", run.hook.Command,
+			"err", err, "output", strings.TrimSpace(string(output)));
+	}
+	default:{
+		session.log.Debug("ran hook", "event", run.hook.Event, "command", run.hook.Command,
+			"output", strings.TrimSpace(string(output)));
+	}
+	}
+}
+
@@ -2,17 +2,18 @@ package client
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net"
+	"os"
 	"p2psystem/common"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	// ClientNetworkType is a config variable that's fed into Dial as the Network argument
-	ClientNetworkType = "tcp";
 	// ClientDisconnect stops all handling functions
 	ClientDisconnect = 0;
 	
@@ -22,41 +23,95 @@ const (
 // of the client and stores all the connections
 type ClientSession struct {
 	connectedServers []*ClientConnection;
-	CurrentConnection *ClientConnection;
+	// currentConnection is the connection messages are sent to. Use
+	// GetCurrentConnection and SetCurrentConnection from outside the lock
+	currentConnection *ClientConnection;
 
+	// Config is replaced rather than changed when a saved room or the
+	// default name changes, so a copy from GetConfig is safe to keep reading
 	Config *Config;
+	configLock sync.RWMutex;	// Held while Config is read or replaced, or the config file written
+	// Nickname is sent to servers instead of Config.DefaultName if it isn't
+	// blank. Unlike DefaultName it isn't saved to the config
+	Nickname string;
+
+	configDir string;	// The directory the config was loaded from
+	// brokenConfig is the path of a config that couldn't be loaded. It's
+	// moved aside rather than overwritten the next time the config is written
+	brokenConfig string;
+	// connectionLock is held while connectedServers or currentConnection is
+	// read or changed
+	connectionLock sync.Mutex;
+
+	discovered map[string]DiscoveredRoom;	// Rooms found on the local network by address
+	discoverySocket *net.UDPConn;
+	discoveryLock sync.Mutex;
+
+	handlers []EventHandler;	// Called with every event on the session
+	handlerLock sync.Mutex;
+
+	hookQueue chan hookRun;		// Hooks waiting to run, nil if there aren't any
+	hooksStopped bool;
+	hookLock sync.Mutex;
+	hookWorkers sync.WaitGroup;
+
+	log *slog.Logger;	// Diagnostics go here and never to stdout
 }
 
 // ClientConnection represents a connection to a server
 type ClientConnection struct{
 	instructions chan uint8;
-	dead bool;
+	finished chan bool;	// Closed once connMain has exited
+	dead atomic.Bool;
+	leaving atomic.Bool;	// Set once the client has chosen to disconnect
 	server net.Conn;
+	password string;	// Sent to the server during the handshake
+	addr string;		// The address the connection was made to
+	session *ClientSession;
+	log *slog.Logger;
+
+	nickname string;	// This client's nickname as the server knows it
+	compression common.Compression;	// Agreed with the server in the handshake
+	compact bool;	// True if packets after the handshake are in compact frames
+	members []string;	// From the server's latest member list
+	memberLock sync.Mutex;
+
+	transcript []TranscriptEntry;	// The last TranscriptSize entries, oldest first
+	transcriptFile *os.File;		// Nil unless the config has a TranscriptDir
+	transcriptLock sync.Mutex;
 }
 
-var client ClientSession = ClientSession{
-	connectedServers: make([]*ClientConnection, 10),
-	CurrentConnection:  nil,
-
-	Config: nil,
+// NewSession returns a session with no connections and no config loaded. If
+// logger is nil diagnostics are written to stderr
+func NewSession(logger *slog.Logger) (*ClientSession){
+	if (logger == nil){
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil));
+	}
+	return &ClientSession{
+		connectedServers: make([]*ClientConnection, 10),
+		currentConnection: nil,
+
+		Config: nil,
+		discovered: map[string]DiscoveredRoom{},
+		handlers: []EventHandler{},
+		log: logger,
+	};
 }
 
-// GetSession is the accessor for the client's session
-func GetSession()(*ClientSession){
-	return &client;
+// SetLogger replaces the logger the session writes its diagnostics to
+func SetLogger(session *ClientSession, logger *slog.Logger){
+	session.log = logger;
 }
 
 // ChangeNickname signals to the server to internally change the nickname of this
-// slient. If the connection is closed then this silently doesn't raise any errors
+// slient. The server confirms the change with an EventNicknameChange
 func ChangeNickname(conn *ClientConnection, newNickname string) (error){
-	if ((conn == nil) || conn.dead){
-		fmt.Printf("Cannot change nickname: Server connection is closed\n");
-		return nil;
+	if ((conn == nil) || conn.dead.Load()){
+		return fmt.Errorf("clientMain.ChangeNickname: server connection is closed");
 	}
 
 	if (len(newNickname) > common.NicknameMaxSize){
-		fmt.Printf("Cannot change nickname: name is too long\n");
-		return nil;
+		return fmt.Errorf("clientMain.ChangeNickname: name is too long");
 	}
 
 	// Encode the pkt
@@ -67,7 +122,7 @@ func ChangeNickname(conn *ClientConnection, newNickname string) (error){
 	jsonBytes, err := json.Marshal(toChange);
 
 	if (err != nil){
-		fmt.Printf("clientMain.ChangeNickname: Unable to encode %s to MDF packet: %s\n", newNickname, err);
+		conn.log.Error("unable to encode MDF packet", "nickname", newNickname, "err", err);
 		return fmt.Errorf("clientMain.ChangeNickname: %s", err);
 	}
 
@@ -76,23 +131,23 @@ func ChangeNickname(conn *ClientConnection, newNickname string) (error){
 		PktType: common.PktMDF,
 	}
 
-	err = common.EncodeMessage(&pkt, string(jsonBytes));
+	err = common.EncodeMessageWith(&pkt, string(jsonBytes), conn.compression);
 	if (err != nil){
-		fmt.Printf("clientMain.ChangeNickname: Unable to encode %s to MDF packet: %s\n", jsonBytes, err);
+		conn.log.Error("unable to encode MDF packet", "nickname", newNickname, "err", err);
 		return fmt.Errorf("clientMain.ChangeNickname: %s", err);
 	}
 
 	var data []byte = make([]byte, common.PktBufferSize);
 	err = common.SerializePacket(&pkt, data);
 	if (err != nil){
-		fmt.Printf("clientMain.ChangeNickname: Unable to serialize MDF packet: %s\n", err);
+		conn.log.Error("unable to serialize MDF packet", "err", err);
 		return fmt.Errorf("clientMain.ChangeNickname: %s", err);
 	}
 
 	// Send it over to the server
-	_, err = conn.server.Write(data);
+	err = common.WritePacket(conn.server, data, conn.compact);
 	if (err != nil){
-		fmt.Printf("clientMain.ChangeNickname: Unable to send MDF packet: %s\n", err);
+		conn.log.Error("unable to send MDF packet", "remote", conn.server.RemoteAddr(), "err", err);
 		return fmt.Errorf("clientMain.ChangeNickname: %s", err);
 	}
 
@@ -101,72 +156,146 @@ func ChangeNickname(conn *ClientConnection, newNickname string) (error){
 
 // DisconnectAll will close every active connection in the given client session
 func DisconnectAll(session *ClientSession) (error){
-	// Prepare a DCN packet
-	// This is done separately from Disconnect so that one packet can be used
-	// for all connections rather than constantly making one for each connection
-	pkt := common.MsgPacket{
-		PktType: common.PktDCN,
-	}
-	data := make([]byte, common.PktBufferSize);
-
-	err := common.SerializePacket(&pkt, data);
-	if (err != nil){
-		fmt.Printf("clientMain.DisconnectAll: unable to serialize packet: %s", err);
-		return fmt.Errorf("clientMain.DisconnectAll: %s", err);
-	}
+	session.connectionLock.Lock();
+	connections := append([]*ClientConnection(nil), session.connectedServers...);
+	session.connectionLock.Unlock();
 
-	for _, v := range session.connectedServers{
-		if ((v == nil) || v.dead){
+	for _, v := range connections{
+		if (v == nil){
 			continue;
 		}
-		_, err = v.server.Write(data);
-		if (err != nil){
-			if (!errors.Is(err, io.EOF)){
-				fmt.Printf("clientMain.DisconnectAll: Unable to send DCN packet: %s", err);
-				return fmt.Errorf("clientMain.Disconnect: %s", err);
-			}
-		}
-		v.instructions <- ClientDisconnect;
-		v.dead = true;
-		v.server.Close();
+		Disconnect(v);
 	}
 
 	return nil;
 }
 
-// Disconnect closes the given ClientConnection
+// Disconnect tells the server the client is leaving, closes the given
+// ClientConnection and waits for it to finish
 func Disconnect(connection *ClientConnection){
-	connection.server.Close();
-	connection.dead = true;
+	connection.leaving.Store(true);
+	// The connection might have already stopped reading instructions if the
+	// server closed it first
+	select {
+	case connection.instructions <- ClientDisconnect:
+	case <- connection.finished:
+	}
+	<- connection.finished;
 }
 
 // SendMessage will send the given string to the connection
 func SendMessage(connection *ClientConnection, msg string) (error){
+	if ((connection == nil) || connection.dead.Load()){
+		return fmt.Errorf("SendMessage: not connected to a server");
+	}
 	// prepare a packet
 	var pkt common.MsgPacket = common.MsgPacket{
 		PktType: common.PktMSG,
 	}
-	err := common.EncodeMessage(&pkt, msg);
+	err := common.EncodeMessageWith(&pkt, msg, connection.compression);
 	if (err != nil){
-		fmt.Printf("clientMain: Unable to encode message: %s\n", err);
+		connection.log.Error("unable to encode message", "err", err);
 		return fmt.Errorf("SendMessage: %s", err);
 	}
 
 	var data []byte = make([]byte, common.PktBufferSize);
 	err = common.SerializePacket(&pkt, data);
 
-	_, err = connection.server.Write(data);
+	err = common.WritePacket(connection.server, data, connection.compact);
 	if (err != nil){
-		fmt.Printf("clientMain: Unable to send message: %s\n", err);
+		connection.log.Error("unable to send message", "remote", connection.server.RemoteAddr(), "err", err);
 		return fmt.Errorf("SendMessage: %s", err);
 	}
 
 	return nil;
 }
 
+// SendDirectMessage sends msg to the client called nickname on the
+// connection's server only. The server announces it to this client if no one
+// there has that nickname
+func SendDirectMessage(connection *ClientConnection, nickname string, msg string) (error){
+	if ((connection == nil) || connection.dead.Load()){
+		return fmt.Errorf("SendDirectMessage: not connected to a server");
+	}
+	jsonBytes, err := json.Marshal(common.Whisper{To: nickname, Text: msg});
+	if (err != nil){
+		return fmt.Errorf("SendDirectMessage: %s", err);
+	}
+	pkt := common.MsgPacket{
+		PktType: common.PktWSP,
+	}
+	err = common.EncodeMessageWith(&pkt, string(jsonBytes), connection.compression);
+	if (err != nil){
+		connection.log.Error("unable to encode direct message", "err", err);
+		return fmt.Errorf("SendDirectMessage: %s", err);
+	}
+
+	data := make([]byte, common.PktBufferSize);
+	err = common.SerializePacket(&pkt, data);
+	if (err != nil){
+		return fmt.Errorf("SendDirectMessage: %s", err);
+	}
+	err = common.WritePacket(connection.server, data, connection.compact);
+	if (err != nil){
+		connection.log.Error("unable to send direct message", "remote", connection.server.RemoteAddr(), "err", err);
+		return fmt.Errorf("SendDirectMessage: %s", err);
+	}
+	// The server doesn't send it back like it does messages to the room
+	recordTranscript(connection, TranscriptEntry{
+		Type: EventDirectMessage.String(),
+		Room: connection.addr,
+		Nickname: GetConnectionNickname(connection),
+		To: nickname,
+		Timestamp: time.Now(),
+		Text: msg,
+	});
+	return nil;
+}
+
+// GetAddr returns the address the connection was made to
+func GetAddr(connection *ClientConnection) (string){
+	return connection.addr;
+}
+
+// IsConnected returns true if the connection is still open
+func IsConnected(connection *ClientConnection) (bool){
+	return ((connection != nil) && !connection.dead.Load());
+}
+
+// GetMembers returns the nicknames of the clients on the connection's server
+func GetMembers(connection *ClientConnection) ([]string){
+	if (connection == nil){
+		return nil;
+	}
+	connection.memberLock.Lock();
+	defer connection.memberLock.Unlock();
+	return append([]string(nil), connection.members...);
+}
+
+// GetConnectionNickname returns the nickname the connection's server knows
+// this client by, which can differ from the session's after /nick or if the
+// server picked one
+func GetConnectionNickname(connection *ClientConnection) (string){
+	if (connection == nil){
+		return "";
+	}
+	connection.memberLock.Lock();
+	defer connection.memberLock.Unlock();
+	return connection.nickname;
+}
+
 // GetCurrentConnection returns the connection the given client session is currently interfacing with
 func GetCurrentConnection(client *ClientSession) (*ClientConnection){
-	return client.CurrentConnection;
+	client.connectionLock.Lock();
+	defer client.connectionLock.Unlock();
+	return client.currentConnection;
+}
+
+// SetCurrentConnection makes connection the one the session sends messages to
+func SetCurrentConnection(client *ClientSession, connection *ClientConnection){
+	client.connectionLock.Lock();
+	defer client.connectionLock.Unlock();
+	client.currentConnection = connection;
 }
 
 // SetNickname modifies the nickname the client is currently using and broadcasts
@@ -175,31 +304,147 @@ func SetNickname(newNick string){
 
 }
 
-// Connect will establish a connection to the given address
-func Connect(addr string) (error){
-	//fmt.Printf("clientMain: Connecting to %s\n", addr);
-	conn, err := net.DialTimeout(ClientNetworkType, addr, (4 * time.Second));
+// Connect will establish a connection to the given address and make it the
+// session's current connection. The password is only checked by servers that
+// have one
+func Connect(session *ClientSession, addr string, password string) (*ClientConnection, error){
+	session.log.Debug("connecting", "remote", addr);
+	err := common.ValidateAddress(addr);
+	if (err != nil){
+		return nil, fmt.Errorf("clientMain: %s", err);
+	}
+	transport, dialAddr, err := common.ResolveAddress(addr);
+	if (err != nil){
+		return nil, fmt.Errorf("clientMain: %s", err);
+	}
+	conn, err := transport.Dial(dialAddr, (4 * time.Second));
 	if err != nil {
-		fmt.Printf("Unable to connect to %s: %s\n", addr, err);
-		return fmt.Errorf("clientMain: %s", err);
+		session.log.Info("unable to connect", "remote", addr, "err", err);
+		return nil, fmt.Errorf("clientMain: %s", err);
 	}
-	//fmt.Printf("clientMain: dialled %s, from %s\n", conn.RemoteAddr().String(), conn.LocalAddr().String());
+	session.log.Debug("dialled server", "remote", conn.RemoteAddr(), "local", conn.LocalAddr());
 	// Create the client
-	err = createConnection(&client, conn);
+	connection, err := createConnection(session, conn, addr, password);
 
 	if (err != nil){
-		fmt.Printf("clientMain: Unable to create connection: %s", err);
-		return fmt.Errorf("clientMain: %s", err);
+		session.log.Info("unable to create connection", "remote", addr, "err", err);
+		return nil, fmt.Errorf("clientMain: %s", err);
 	}
 
-	return nil;
+	return connection, nil;
+}
+
+// AutoConnectResult is the outcome of joining one saved room on start up
+type AutoConnectResult struct{
+	Alias string;
+	Addr string;
+	Connection *ClientConnection;	// Nil if Err isn't
+	Err error;
+}
+
+// AutoConnect joins every saved room with AutoConnect set, all at the same
+// time, and returns how each went in JoinOrder. Once they've all finished the
+// first room in JoinOrder that was joined is made the session's current
+// connection
+func AutoConnect(session *ClientSession) ([]AutoConnectResult){
+	rooms := autoConnectRooms(session);
+	results := make([]AutoConnectResult, len(rooms));
+	previous := GetCurrentConnection(session);
+
+	var wait sync.WaitGroup;
+	for index, room := range rooms{
+		wait.Add(1);
+		go func(){
+			defer wait.Done();
+			connection, err := Connect(session, room.Addr, room.Password);
+			results[index] = AutoConnectResult{Alias: room.Alias, Addr: room.Addr, Connection: connection, Err: err};
+		}();
+	}
+	wait.Wait();
+
+	// Every Connect made its room current in whatever order they finished, so
+	// settle on the first by JoinOrder
+	current := previous;
+	for _, result := range results{
+		if (result.Err == nil){
+			current = result.Connection;
+			break;
+		}
+	}
+	SetCurrentConnection(session, current);
+	return results;
+}
+
+// connectionNickname returns the nickname sent to the server at addr. A
+// nickname given for the session wins, then one saved for the room and then
+// the config's DefaultName
+func connectionNickname(session *ClientSession, addr string) (string){
+	if (session.Nickname == ""){
+		nickname := roomNickname(session, addr);
+		if (nickname != ""){
+			return nickname;
+		}
+	}
+	return GetNickname(session);
+}
+
+// GetNickname returns the nickname the session sends to servers that have no
+// nickname of their own in SavedRooms
+func GetNickname(session *ClientSession) (string){
+	if (session.Nickname != ""){
+		return session.Nickname;
+	}
+	cfg := GetConfig(session);
+	if (cfg == nil){
+		return "";
+	}
+	return cfg.DefaultName;
 }
 
-func Init() {
-	err := ReadConfig(&client, "config/clientConfig.cfg");
+// LoadConfig loads clientConfig.cfg from the ConfigDir directory into the
+// session. A missing or broken config leaves the session with an empty one.
+// A broken config is renamed to clientConfig.cfg.bak when the empty one is
+// written in its place
+func LoadConfig(session *ClientSession, ConfigDir string){
+	path := filepath.Join(ConfigDir, ConfigFileName);
+	_, err := os.Stat(path);
+	if (os.IsNotExist(err)){
+		// The first run, the config is written when the client exits
+		session.log.Info("no client config yet, starting with an empty one", "path", path);
+		session.configLock.Lock();
+		session.Config = &Config{SavedRooms: []savedRoom{}};
+		session.configLock.Unlock();
+	} else {
+		err = ReadConfig(session, path);
+		if (err != nil){
+			session.log.Warn("unable to load client config, starting with an empty one", "path", path, "err", err);
+			session.configLock.Lock();
+			session.Config = &Config{SavedRooms: []savedRoom{}};
+			session.brokenConfig = path;
+			session.configLock.Unlock();
+		}
+	}
+	session.configDir = ConfigDir;
+}
+
+// Init loads clientConfig.cfg from the ConfigDir directory into the session,
+// creating the directory if it's missing, starts its hooks and starts
+// discovering rooms. If Nickname isn't blank it's used instead of
+// the config's DefaultName
+func Init(session *ClientSession, ConfigDir string, Nickname string) {
+	LoadConfig(session, ConfigDir);
+	session.Nickname = Nickname;
+	startHooks(session);
+	// Created now so the history can be saved alongside the config
+	err := os.MkdirAll(ConfigDir, 0700);
 	if (err != nil){
-		fmt.Printf("Unable to parse client config: %s", err);
+		session.log.Warn("unable to create config directory", "path", ConfigDir, "err", err);
 	}
 
-	fmt.Print("Client component initialised\n");
-}
\ No newline at end of file
+	err = StartDiscovery(session);
+	if (err != nil){
+		session.log.Warn("unable to discover rooms on the local network", "err", err);
+	}
+
+	session.log.Info("client component initialised");
+}
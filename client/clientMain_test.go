@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"p2psystem/server"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testTimeout is how long a test waits for something to arrive before failing
+const testTimeout = 5 * time.Second;
+
+// discardLogger drops everything logged to it
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil));
+
+// startRoom starts a server listening on a mem:// address named after the
+// test and returns it with the address
+func startRoom(t *testing.T, name string) (*server.ServerRoom, string){
+	t.Helper();
+	addr := "mem://" + t.Name() + "-" + name;
+	room, err := server.New(server.ServerOptions{
+		Listen: server.ListenAddrs{addr},
+		Logger: discardLogger,
+	});
+	if (err != nil){
+		t.Fatalf("unable to create server: %s", err);
+	}
+	_, err = server.Start(room);
+	if (err != nil){
+		t.Fatalf("unable to start server: %s", err);
+	}
+	t.Cleanup(func(){
+		server.Stop(room);
+	});
+	return room, addr;
+}
+
+// joinRoom connects a new session to addr as nickname and returns the
+// connection with the session's events
+func joinRoom(t *testing.T, addr string, nickname string) (*ClientConnection, <-chan Event){
+	t.Helper();
+	session := NewSession(discardLogger);
+	session.Nickname = nickname;
+	events := Subscribe(session, 1024);
+	connection, err := Connect(session, addr, "");
+	if (err != nil){
+		t.Fatalf("unable to connect to %s: %s", addr, err);
+	}
+	t.Cleanup(func(){
+		DisconnectAll(session);
+	});
+	return connection, events;
+}
+
+// waitForEvent returns the first event of eventType, skipping anything
+// before it. messages is the text of every EventMessage skipped
+func waitForEvent(t *testing.T, events <-chan Event, eventType EventType) (Event, []string){
+	t.Helper();
+	messages := []string{};
+	timeout := time.After(testTimeout);
+	for {
+		select {
+		case event := <- events:{
+			if (event.Type == eventType){
+				return event, messages;
+			}
+			if (event.Type == EventMessage){
+				messages = append(messages, event.Text);
+			}
+		}
+		case <- timeout:{
+			t.Fatalf("timed out waiting for a %s event", eventType);
+		}
+		}
+	}
+}
+
+func TestSessionOverMemoryTransport(t *testing.T){
+	baseline := runtime.NumGoroutine();
+	room, addr := startRoom(t, "room");
+	const sent = 100;
+
+	alice, aliceEvents := joinRoom(t, addr, "alice");
+	bob, bobEvents := joinRoom(t, addr, "bob");
+	waitForEvent(t, aliceEvents, EventConnect);
+	waitForEvent(t, bobEvents, EventConnect);
+
+	for i := range sent{
+		err := SendMessage(alice, fmt.Sprintf("message %d", i));
+		if (err != nil){
+			t.Fatalf("unable to send message %d: %s", i, err);
+		}
+	}
+	err := SendDirectMessage(alice, "bob", "just for bob");
+	if (err != nil){
+		t.Fatalf("unable to send a direct message: %s", err);
+	}
+	event, messages := waitForEvent(t, bobEvents, EventDirectMessage);
+	if ((event.Nickname != "alice") || (event.Text != "just for bob")){
+		t.Errorf("got a direct message %q from %q", event.Text, event.Nickname);
+	}
+	if (len(messages) != sent){
+		t.Fatalf("bob received %d of %d messages", len(messages), sent);
+	}
+	for i, text := range messages{
+		if (text != fmt.Sprintf("message %d", i)){
+			t.Fatalf("message %d was %q", i, text);
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout);
+	defer cancel();
+	summary, err := server.Shutdown(room, ctx);
+	if (err != nil){
+		t.Fatalf("unable to shut down: %s", err);
+	}
+	if ((summary.Notified != 2) || (summary.Drained != 2) || (summary.ForceClosed != 0)){
+		t.Errorf("notified %d, drained %d and force closed %d, expected 2, 2 and 0",
+			summary.Notified, summary.Drained, summary.ForceClosed);
+	}
+	for _, events := range []<-chan Event{aliceEvents, bobEvents}{
+		event, _ := waitForEvent(t, events, EventKick);
+		if (event.Text != "server shutdown"){
+			t.Errorf("kicked with %q", event.Text);
+		}
+		waitForEvent(t, events, EventDisconnect);
+	}
+	if (IsConnected(alice) || IsConnected(bob)){
+		t.Errorf("still connected after the server shut down");
+	}
+
+	// Disconnecting from a server that's already gone returns straight away
+	Disconnect(alice);
+	Disconnect(bob);
+	waitForGoroutines(t, baseline);
+}
+
+// waitForGoroutines fails the test if the number of goroutines doesn't drop
+// back to baseline
+func waitForGoroutines(t *testing.T, baseline int){
+	t.Helper();
+	deadline := time.Now().Add(testTimeout);
+	for (runtime.NumGoroutine() > baseline){
+		if (time.Now().After(deadline)){
+			buf := make([]byte, 1 << 16);
+			t.Fatalf("%d goroutines left running, expected %d:\n%s", runtime.NumGoroutine(), baseline,
+				buf[:runtime.Stack(buf, true)]);
+		}
+		time.Sleep(10 * time.Millisecond);
+	}
+}
+
+func TestAutoConnectPicksFirstByJoinOrder(t *testing.T){
+	session := NewSession(discardLogger);
+	LoadConfig(session, t.TempDir());
+	session.Nickname = "alice";
+	// Saved in a different order to the one they're joined in
+	for index, name := range []string{"third", "first", "second"}{
+		_, addr := startRoom(t, name);
+		err := SaveRoom(session, name, addr, "");
+		if (err == nil){
+			err = SetRoomAutoConnect(session, name, true);
+		}
+		if (err == nil){
+			err = SetRoomJoinOrder(session, name, map[string]int{"first": 1, "second": 2, "third": 3}[name]);
+		}
+		if (err != nil){
+			t.Fatalf("unable to save room %d: %s", index, err);
+		}
+	}
+	t.Cleanup(func(){
+		DisconnectAll(session);
+	});
+
+	results := AutoConnect(session);
+	aliases := []string{};
+	for _, result := range results{
+		if (result.Err != nil){
+			t.Fatalf("unable to join %s: %s", result.Alias, result.Err);
+		}
+		aliases = append(aliases, result.Alias);
+	}
+	if (fmt.Sprint(aliases) != "[first second third]"){
+		t.Errorf("joined %v, expected them in JoinOrder", aliases);
+	}
+	if (GetCurrentConnection(session) != results[0].Connection){
+		t.Errorf("current room is %s, expected the first", GetAddr(GetCurrentConnection(session)));
+	}
+}
@@ -0,0 +1,336 @@
+package client
+
+// Keeps what's been said on each connection so it can be exported to a file,
+// either from memory while the client runs or from the transcript files
+// written when TranscriptDir is set
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Formats a transcript can be exported in
+const (
+	TranscriptText = "text";
+	TranscriptJSON = "json";
+	// TranscriptHTML is a page with its styles included so it can be opened
+	// or attached on its own
+	TranscriptHTML = "html";
+)
+
+// TranscriptSize is the number of entries each connection keeps in memory
+const TranscriptSize = 1000;
+
+// TranscriptEntry is a line of a transcript. Type is "message", "direct",
+// "announcement", "kick" or "nickname"
+type TranscriptEntry struct{
+	Type string `json:"type"`;
+	Room string `json:"room"`;			// The address of the server
+	Nickname string `json:"nickname,omitempty"`;
+	To string `json:"to,omitempty"`;		// Who a direct message was sent to
+	Timestamp time.Time `json:"timestamp"`;
+	Text string `json:"text"`;
+}
+
+// TranscriptFilter picks the entries that are exported. Zero values don't
+// filter anything
+type TranscriptFilter struct{
+	Since time.Time;
+	Until time.Time;
+	Nicknames []string;		// Matched case-insensitively against the sender
+}
+
+// transcriptEntry returns the entry recorded for an event, or false if the
+// event isn't part of the conversation
+func transcriptEntry(event Event) (TranscriptEntry, bool){
+	entry := TranscriptEntry{
+		Type: event.Type.String(),
+		Room: event.Addr,
+		Nickname: event.Nickname,
+		Timestamp: event.Timestamp,
+		Text: event.Text,
+	};
+	switch event.Type{
+	case EventMessage, EventAnnouncement, EventKick, EventNicknameChange:
+	case EventDirectMessage:{
+		entry.To = GetConnectionNickname(event.Connection);
+	}
+	default:{
+		return entry, false;
+	}
+	}
+	return entry, true;
+}
+
+// recordTranscript adds an entry to the connection's transcript and its file
+func recordTranscript(connection *ClientConnection, entry TranscriptEntry){
+	connection.transcriptLock.Lock();
+	defer connection.transcriptLock.Unlock();
+
+	connection.transcript = append(connection.transcript, entry);
+	if (len(connection.transcript) > TranscriptSize){
+		connection.transcript = connection.transcript[len(connection.transcript) - TranscriptSize:];
+	}
+	if (connection.transcriptFile == nil){
+		return;
+	}
+	line, err := json.Marshal(entry);
+	if (err != nil){
+		return;
+	}
+	_, err = connection.transcriptFile.Write(append(line, '\n'));
+	if (err != nil){
+		connection.log.Warn("unable to write transcript, no longer saving it", "err", err);
+		connection.transcriptFile.Close();
+		connection.transcriptFile = nil;
+	}
+}
+
+// openTranscript opens the file the connection's transcript is appended to if
+// the config has a TranscriptDir
+func openTranscript(connection *ClientConnection){
+	path := TranscriptPath(connection.session, connection.addr);
+	if (path == ""){
+		return;
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700);
+	if (err != nil){
+		connection.log.Warn("unable to create transcript directory", "path", path, "err", err);
+		return;
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0600);
+	if (err != nil){
+		connection.log.Warn("unable to open transcript", "path", path, "err", err);
+		return;
+	}
+	connection.transcriptLock.Lock();
+	connection.transcriptFile = file;
+	connection.transcriptLock.Unlock();
+}
+
+// closeTranscript closes the connection's transcript file if it has one
+func closeTranscript(connection *ClientConnection){
+	connection.transcriptLock.Lock();
+	defer connection.transcriptLock.Unlock();
+	if (connection.transcriptFile != nil){
+		connection.transcriptFile.Close();
+		connection.transcriptFile = nil;
+	}
+}
+
+// TranscriptPath returns the file the transcript of the room at addr is saved
+// to, or a blank string if the config has no TranscriptDir. A relative
+// TranscriptDir is inside the config directory
+func TranscriptPath(session *ClientSession, addr string) (string){
+	cfg := GetConfig(session);
+	if ((cfg == nil) || (cfg.TranscriptDir == "")){
+		return "";
+	}
+	dir := cfg.TranscriptDir;
+	if (!filepath.IsAbs(dir)){
+		dir = filepath.Join(session.configDir, dir);
+	}
+	name := strings.Map(func(char rune) (rune){
+		if (((char >= 'a') && (char <= 'z')) || ((char >= 'A') && (char <= 'Z')) ||
+			((char >= '0') && (char <= '9')) || (char == '.') || (char == '-')){
+			return char;
+		}
+		return '_';
+	}, addr);
+	return filepath.Join(dir, name + ".jsonl");
+}
+
+// GetTranscript returns the entries the connection has kept in memory, oldest
+// first
+func GetTranscript(connection *ClientConnection) ([]TranscriptEntry){
+	if (connection == nil){
+		return []TranscriptEntry{};
+	}
+	connection.transcriptLock.Lock();
+	defer connection.transcriptLock.Unlock();
+	return append([]TranscriptEntry{}, connection.transcript...);
+}
+
+// ReadTranscript reads a transcript file written while TranscriptDir was set
+func ReadTranscript(path string) ([]TranscriptEntry, error){
+	file, err := os.Open(path);
+	if (err != nil){
+		return nil, fmt.Errorf("clientTranscript.ReadTranscript: %s", err);
+	}
+	defer file.Close();
+
+	entries := []TranscriptEntry{};
+	scanner := bufio.NewScanner(file);
+	lineNumber := 0;
+	for (scanner.Scan()){
+		lineNumber++;
+		if (strings.TrimSpace(scanner.Text()) == ""){
+			continue;
+		}
+		var entry TranscriptEntry;
+		err = json.Unmarshal(scanner.Bytes(), &entry);
+		if (err != nil){
+			return nil, fmt.Errorf("clientTranscript.ReadTranscript: line %d: %s", lineNumber, err);
+		}
+		entries = append(entries, entry);
+	}
+	if (scanner.Err() != nil){
+		return nil, fmt.Errorf("clientTranscript.ReadTranscript: %s", scanner.Err());
+	}
+	return entries, nil;
+}
+
+// ParseTranscriptTime reads a time for a TranscriptFilter. It's either RFC
+// 3339, a time of day today such as 14:30, or a duration such as 2h meaning
+// that long before now
+func ParseTranscriptTime(value string, now time.Time) (time.Time, error){
+	parsed, err := time.Parse(time.RFC3339, value);
+	if (err == nil){
+		return parsed, nil;
+	}
+	duration, err := time.ParseDuration(value);
+	if ((err == nil) && (duration >= 0)){
+		return now.Add(-duration), nil;
+	}
+	for _, layout := range []string{"15:04", "15:04:05"}{
+		clock, err := time.ParseInLocation(layout, value, now.Location());
+		if (err == nil){
+			year, month, day := now.Date();
+			return time.Date(year, month, day, clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location()), nil;
+		}
+	}
+	return time.Time{}, fmt.Errorf("clientTranscript: invalid time %q, expected something like 2h, 14:30 or 2006-01-02T15:04:05Z", value);
+}
+
+// FilterTranscript returns the entries that match filter
+func FilterTranscript(entries []TranscriptEntry, filter TranscriptFilter) ([]TranscriptEntry){
+	matched := []TranscriptEntry{};
+	for _, entry := range entries{
+		if (!filter.Since.IsZero() && entry.Timestamp.Before(filter.Since)){
+			continue;
+		}
+		if (!filter.Until.IsZero() && entry.Timestamp.After(filter.Until)){
+			continue;
+		}
+		if (len(filter.Nicknames) > 0){
+			found := false;
+			for _, nickname := range filter.Nicknames{
+				found = (found || strings.EqualFold(nickname, entry.Nickname));
+			}
+			if (!found){
+				continue;
+			}
+		}
+		matched = append(matched, entry);
+	}
+	return matched;
+}
+
+// TranscriptFormat returns the format for a file from its extension, or text
+// if it's not one that's known
+func TranscriptFormat(path string) (string){
+	switch strings.ToLower(filepath.Ext(path)){
+	case ".json":{
+		return TranscriptJSON;
+	}
+	case ".html", ".htm":{
+		return TranscriptHTML;
+	}
+	}
+	return TranscriptText;
+}
+
+// transcriptLine returns how an entry reads in a text transcript, without
+// the time
+func transcriptLine(entry TranscriptEntry) (string){
+	switch entry.Type{
+	case "direct":{
+		return fmt.Sprintf("%s -> %s: %s", entry.Nickname, entry.To, entry.Text);
+	}
+	case "announcement":{
+		return fmt.Sprintf("Server: %s", entry.Text);
+	}
+	case "kick":{
+		return fmt.Sprintf("Kicked: %s", entry.Text);
+	}
+	case "nickname":{
+		return fmt.Sprintf("%s is now known as %s", entry.Nickname, entry.Text);
+	}
+	}
+	return fmt.Sprintf("%s: %s", entry.Nickname, entry.Text);
+}
+
+// transcriptPage is the page written by TranscriptHTML
+var transcriptPage = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.3em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0.2em 0.6em; vertical-align: top; border-bottom: 1px solid #eee; }
+.time { color: #888; white-space: nowrap; font-family: monospace; }
+.nick { font-weight: bold; white-space: nowrap; }
+.text { white-space: pre-wrap; word-break: break-word; }
+.announcement, .kick, .nickname { color: #666; font-style: italic; }
+.direct .nick { color: #a50; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Exported {{.Exported}}, {{len .Entries}} entries</p>
+<table>
+{{range .Entries}}<tr class="{{.Type}}"><td class="time">{{.Timestamp.Format "2006-01-02 15:04:05"}}</td>{{if eq .Type "announcement"}}<td class="nick">Server</td>{{else if eq .Type "kick"}}<td class="nick">Kicked</td>{{else if eq .Type "direct"}}<td class="nick">{{.Nickname}} &rarr; {{.To}}</td>{{else}}<td class="nick">{{.Nickname}}</td>{{end}}<td class="text">{{if eq .Type "nickname"}}is now known as {{end}}{{.Text}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`));
+
+// ExportTranscript writes entries to out in the given format
+func ExportTranscript(out io.Writer, entries []TranscriptEntry, format string) (error){
+	switch format{
+	case TranscriptText:{
+		writer := bufio.NewWriter(out);
+		for _, entry := range entries{
+			fmt.Fprintf(writer, "[%s] %s\n", entry.Timestamp.Format("2006-01-02 15:04:05"), transcriptLine(entry));
+		}
+		return writer.Flush();
+	}
+	case TranscriptJSON:{
+		encoder := json.NewEncoder(out);
+		encoder.SetEscapeHTML(false);
+		encoder.SetIndent("", "\t");
+		return encoder.Encode(entries);
+	}
+	case TranscriptHTML:{
+		rooms := []string{};
+		seen := map[string]bool{};
+		for _, entry := range entries{
+			if (!seen[entry.Room]){
+				rooms = append(rooms, entry.Room);
+				seen[entry.Room] = true;
+			}
+		}
+		title := "Transcript";
+		if (len(rooms) > 0){
+			title = "Transcript of " + strings.Join(rooms, ", ");
+		}
+		return transcriptPage.Execute(out, map[string]any{
+			"Title": title,
+			"Exported": time.Now().Format("2006-01-02 15:04:05"),
+			"Entries": entries,
+		});
+	}
+	}
+	return fmt.Errorf("clientTranscript: unknown format %q, expected %s, %s or %s", format,
+		TranscriptText, TranscriptJSON, TranscriptHTML);
+}
@@ -0,0 +1,258 @@
+package common
+
+// Payloads can be sent as they are or compressed with flate, with or without
+// a dictionary of text that's common in chat. Which encoding a packet uses is
+// kept in its Flags so it can always be decoded, and each connection agrees on
+// the method it uses in the handshake. Packets from nodes older than this have
+// Flags of 0, which is the padded flate encoding they all used. A smaller
+// payload is only fewer bytes sent in compact frames, see WritePacket
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Encodings of a packet's payload, kept in the low bits of its Flags
+const (
+	// EncodingLegacy is flate at BestCompression over the content padded to
+	// 1024 bytes with null bytes. It's the only encoding older nodes know
+	EncodingLegacy = 0;
+	// EncodingNone is the content as it is
+	EncodingNone = 1;
+	// EncodingFlate is the content compressed with flate
+	EncodingFlate = 2;
+	// EncodingDict is the content compressed with flate using chatDictionary
+	EncodingDict = 3;
+
+	// FlagEncodingMask picks the encoding out of a packet's Flags
+	FlagEncodingMask = 0x03;
+	// MaxContentSize is the most content in bytes a payload holds, anything
+	// longer is cut short at the last whole character
+	MaxContentSize = 1024;
+)
+
+// Compression methods a connection can agree on
+const (
+	// CompressionLegacy is used with nodes that don't offer a method
+	CompressionLegacy = "";
+	CompressionNone = "none";
+	CompressionFlate = "flate";
+	CompressionDict = "dict";
+
+	// DefaultCompressionLevel is the flate level used if one isn't chosen.
+	// Lower levels don't bother compressing payloads as short as most chat
+	DefaultCompressionLevel = flate.BestCompression;
+	// DefaultCompressionThreshold is the size in bytes below which payloads
+	// aren't compressed if a threshold isn't chosen
+	DefaultCompressionThreshold = 32;
+)
+
+// DefaultCompressionMethods are the methods offered and accepted if none are
+// configured, the most preferred first
+var DefaultCompressionMethods = []string{CompressionDict, CompressionFlate, CompressionNone};
+
+// Compression is how a connection encodes the payloads it sends. Only Method
+// is agreed with the other end, Level and Threshold are up to the sender
+type Compression struct{
+	Method string;
+	Level int;			// The flate level, 1 to 9
+	Threshold int;		// Payloads shorter than this many bytes are sent as they are
+}
+
+// chatDictionary primes flate with text that chat payloads often contain, so
+// even short messages have something to refer back to. The most common text
+// is at the end where it's cheapest to refer to
+var chatDictionary = []byte(
+	"{\"Members\":[],\"Total\":,\"Nickname\":\"\"}{\"To\":\"\",\"Text\":\"\"}{\"NewName\":\"\",\"Password\":\"\"}" +
+	"{\"NodeID\":,\"Compression\":\"dict\",\"flate\",\"none\"]}" +
+	"http://https://www..com/ thanks thank you sorry please could would should because about " +
+	"what when where which there their they this that with have from your yes no ok okay lol " +
+	"has changed their name to has joined the room disconnected from the room guest " +
+	"I think it's don't can't I'm you're we're the and for are but not you all any can " +
+	"hello hi hey the of to and a in is it you that ");
+
+// ValidateCompression checks compression settings read from a config
+func ValidateCompression(methods []string, level int, threshold int) (error){
+	for _, method := range methods{
+		switch method{
+		case CompressionNone, CompressionFlate, CompressionDict:
+		default:{
+			return fmt.Errorf("unknown compression method %q, expected %s, %s or %s", method,
+				CompressionNone, CompressionFlate, CompressionDict);
+		}
+		}
+	}
+	if ((level < flate.BestSpeed) || (level > flate.BestCompression)){
+		return fmt.Errorf("compression level %d must be between %d and %d", level, flate.BestSpeed, flate.BestCompression);
+	}
+	if (threshold < 0){
+		return fmt.Errorf("compression threshold must not be negative");
+	}
+	return nil;
+}
+
+// ChooseCompression returns the first of ours that's also in theirs, or
+// CompressionLegacy if there isn't one
+func ChooseCompression(ours []string, theirs []string) (string){
+	for _, method := range ours{
+		if (slices.Contains(theirs, method)){
+			return method;
+		}
+	}
+	return CompressionLegacy;
+}
+
+// methodEncoding returns the encoding a method compresses with
+func methodEncoding(method string) (uint8){
+	switch method{
+	case CompressionNone:{
+		return EncodingNone;
+	}
+	case CompressionFlate:{
+		return EncodingFlate;
+	}
+	case CompressionDict:{
+		return EncodingDict;
+	}
+	}
+	return EncodingLegacy;
+}
+
+// encodePayload encodes content with the compression and returns the payload
+// and the encoding it ended up using
+func encodePayload(content string, compression Compression) ([]byte, uint8, error){
+	if (len(content) > MaxContentSize){
+		// Cut at the start of a character so none is split in two
+		cut := MaxContentSize;
+		for ((cut > 0) && !utf8.RuneStart(content[cut])){
+			cut--;
+		}
+		content = content[:cut];
+	}
+
+	encoding := methodEncoding(compression.Method);
+	if (encoding == EncodingLegacy){
+		var buffer bytes.Buffer;
+		_, err := WriteTo(&buffer, content);
+		return buffer.Bytes(), EncodingLegacy, err;
+	}
+	if ((encoding == EncodingNone) || (len(content) < compression.Threshold)){
+		return []byte(content), EncodingNone, nil;
+	}
+
+	level := compression.Level;
+	if (level == 0){
+		level = DefaultCompressionLevel;
+	}
+	var buffer bytes.Buffer;
+	var writer *flate.Writer;
+	var err error;
+	if (encoding == EncodingDict){
+		writer, err = flate.NewWriterDict(&buffer, level, chatDictionary);
+	} else {
+		writer, err = flate.NewWriter(&buffer, level);
+	}
+	if (err != nil){
+		return nil, encoding, err;
+	}
+	_, err = writer.Write([]byte(content));
+	if (err == nil){
+		err = writer.Close();
+	}
+	if (err != nil){
+		return nil, encoding, err;
+	}
+	// Text that doesn't compress is sent as it is rather than growing
+	if (buffer.Len() >= len(content)){
+		return []byte(content), EncodingNone, nil;
+	}
+	return buffer.Bytes(), encoding, nil;
+}
+
+// decodePayload returns the content of a payload in the given encoding
+func decodePayload(payload []byte, encoding uint8) (string, error){
+	switch encoding{
+	case EncodingLegacy:{
+		return ReadFrom(bytes.NewReader(payload));
+	}
+	case EncodingNone:{
+		return string(payload), nil;
+	}
+	}
+
+	var reader io.ReadCloser;
+	if (encoding == EncodingDict){
+		reader = flate.NewReaderDict(bytes.NewReader(payload), chatDictionary);
+	} else {
+		reader = flate.NewReader(bytes.NewReader(payload));
+	}
+	defer reader.Close();
+	// Nothing legitimate is longer than MaxContentSize, so stop there rather
+	// than inflating whatever a node sends
+	content, err := io.ReadAll(io.LimitReader(reader, MaxContentSize));
+	if (err != nil){
+		return "", fmt.Errorf("TextEncode: unable to read from reader: %s", err);
+	}
+	return string(content), nil;
+}
+
+// EncodeMessageWith is EncodeMessage with the payload encoded by compression
+// instead of being left as it is
+func EncodeMessageWith(pkt *MsgPacket, content string, compression Compression) (error){
+	payload, encoding, err := encodePayload(content, compression);
+	if (err != nil){
+		return fmt.Errorf("packet: %s", err);
+	}
+	if (len(payload) > len(pkt.Payload)){
+		return fmt.Errorf("packet: payload of %d bytes doesn't fit in a packet", len(payload));
+	}
+	pkt.Timestamp = uint64(time.Now().Unix());
+	pkt.PayloadSize = uint16(len(payload));
+	pkt.Payload = [len(pkt.Payload)]byte{};
+	copy(pkt.Payload[:], payload);
+	pkt.Flags = (pkt.Flags &^ FlagEncodingMask) | encoding;
+	return nil;
+}
+
+// CompressPacket returns the serialized packet in data with its payload
+// encoded the way compression says, or data itself if it already is. data is
+// never changed since it can be queued for other connections too
+func CompressPacket(data []byte, compression Compression) ([]byte, error){
+	pkt := DeserializePacket(data);
+	if (pkt.PayloadSize == 0){
+		return data, nil;
+	}
+	encoding := pkt.Flags & FlagEncodingMask;
+	target := methodEncoding(compression.Method);
+	if ((encoding == target) || ((target != EncodingLegacy) && (encoding == EncodingNone) &&
+		(int(pkt.PayloadSize) < compression.Threshold))){
+		return data, nil;
+	}
+
+	content, err := DecodeMessage(&pkt);
+	if (err != nil){
+		return nil, fmt.Errorf("packet: %s", err);
+	}
+	if (encoding == EncodingLegacy){
+		content = strings.TrimRight(content, "\x00");
+	}
+	timestamp := pkt.Timestamp;
+	err = EncodeMessageWith(&pkt, content, compression);
+	if (err != nil){
+		return nil, err;
+	}
+	pkt.Timestamp = timestamp;
+
+	out := make([]byte, PktBufferSize);
+	err = SerializePacket(&pkt, out);
+	if (err != nil){
+		return nil, err;
+	}
+	return out, nil;
+}
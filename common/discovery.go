@@ -0,0 +1,20 @@
+package common
+
+// Shared definitions for advertising rooms on the local network
+
+// DefaultDiscoveryAddr is the multicast group servers advertise themselves to
+// and clients listen on for advertisements
+const DefaultDiscoveryAddr = "239.255.0.90:9099";
+
+// RoomAdvertisement is the JSON payload a server periodically sends to
+// DiscoveryAddr so that clients on the local network can find it
+type RoomAdvertisement struct{
+	Name string;
+	// Port is the port the server accepts clients on. The address is taken
+	// from wherever the advertisement was sent from
+	Port int;
+	Users int;
+	MaxUsers int;
+	// Password is true if clients need a password to join
+	Password bool;
+}
@@ -0,0 +1,161 @@
+package common
+
+// Handles creating the loggers used for diagnostics so that they never end up
+// mixed in with the chat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// LogFileMaxSize is the number of bytes a log file can grow to before
+	// it's rotated
+	LogFileMaxSize = 10 * 1024 * 1024;
+	// LogFileBackups is the number of rotated log files that are kept
+	LogFileBackups = 3;
+)
+
+// NewLogger returns a logger that writes leveled, structured lines to output.
+// Changing level changes the verbosity of the logger while it's running
+func NewLogger(output io.Writer, level *slog.LevelVar) (*slog.Logger){
+	return slog.New(slog.NewTextHandler(output, &slog.HandlerOptions{Level: level}));
+}
+
+// ParseLogLevel converts one of debug, info, warn or error into its level
+func ParseLogLevel(name string) (slog.Level, error){
+	switch strings.ToLower(name){
+	case "debug":
+		return slog.LevelDebug, nil;
+	case "info":
+		return slog.LevelInfo, nil;
+	case "warn", "warning":
+		return slog.LevelWarn, nil;
+	case "error":
+		return slog.LevelError, nil;
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q: expected debug, info, warn or error", name);
+}
+
+// PacketName returns a readable name for the packet type used in log fields
+func PacketName(pktType uint8) (string){
+	switch pktType{
+	case PktMSG: return "MSG";
+	case PktANC: return "ANC";
+	case PktREF: return "REF";
+	case PktACP: return "ACP";
+	case PktACK: return "ACK";
+	case PktDCN: return "DCN";
+	case PktKCK: return "KCK";
+	case PktMDF: return "MDF";
+	case PktPER: return "PER";
+	case PktRLY: return "RLY";
+	case PktMEM: return "MEM";
+	case PktWSP: return "WSP";
+	}
+	return fmt.Sprintf("unknown(%d)", pktType);
+}
+
+// RotatingFile is a log file that's renamed to path.1, path.2 and so on once
+// it grows past maxSize, keeping at most backups old files
+type RotatingFile struct{
+	path string;
+	maxSize int64;
+	backups int;
+
+	file *os.File;
+	size int64;
+	lock sync.Mutex;
+}
+
+// OpenRotatingFile opens the log file at path for appending, creating it if
+// it doesn't exist
+func OpenRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error){
+	file, err := os.OpenFile(path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644);
+	if (err != nil){
+		return nil, fmt.Errorf("logger: %s", err);
+	}
+	info, err := file.Stat();
+	if (err != nil){
+		file.Close();
+		return nil, fmt.Errorf("logger: %s", err);
+	}
+
+	return &RotatingFile{
+		path: path,
+		maxSize: maxSize,
+		backups: backups,
+		file: file,
+		size: info.Size(),
+	}, nil;
+}
+
+// rotate shifts every backup up by one and starts a new empty log file. If a
+// rename fails the log file is reopened as it is, so nothing is lost and the
+// rotation is tried again on the next write
+func (rf *RotatingFile) rotate() (error){
+	err := rf.file.Close();
+	if (err != nil){
+		return err;
+	}
+
+	var rotateErr error;
+	for ind := rf.backups - 1; ((ind > 0) && (rotateErr == nil)); ind --{
+		rotateErr = os.Rename(fmt.Sprintf("%s.%d", rf.path, ind), fmt.Sprintf("%s.%d", rf.path, ind + 1));
+		// Backups that haven't been made yet are skipped
+		if (errors.Is(rotateErr, fs.ErrNotExist)){
+			rotateErr = nil;
+		}
+	}
+	if (rotateErr == nil){
+		if (rf.backups > 0){
+			rotateErr = os.Rename(rf.path, rf.path + ".1");
+		} else {
+			rotateErr = os.Remove(rf.path);
+		}
+	}
+
+	rf.file, err = os.OpenFile(rf.path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644);
+	if (err != nil){
+		return err;
+	}
+	info, err := rf.file.Stat();
+	if (err != nil){
+		return err;
+	}
+	rf.size = info.Size();
+	return rotateErr;
+}
+
+func (rf *RotatingFile) Write(b []byte) (int, error){
+	rf.lock.Lock();
+	defer rf.lock.Unlock();
+
+	var rotateErr error;
+	if ((rf.size > 0) && (rf.size + int64(len(b)) > rf.maxSize)){
+		rotateErr = rf.rotate();
+		if (rotateErr != nil){
+			rotateErr = fmt.Errorf("logger: unable to rotate %s: %s", rf.path, rotateErr);
+		}
+	}
+
+	size, err := rf.file.Write(b);
+	rf.size += int64(size);
+	if (err != nil){
+		return size, err;
+	}
+	// The line is still written when the rotation fails
+	return size, rotateErr;
+}
+
+func (rf *RotatingFile) Close() (error){
+	rf.lock.Lock();
+	defer rf.lock.Unlock();
+	return rf.file.Close();
+}
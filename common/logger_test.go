@@ -0,0 +1,95 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readLog returns the contents of path, or "missing" if it doesn't exist
+func readLog(t *testing.T, path string) (string){
+	t.Helper();
+	data, err := os.ReadFile(path);
+	if (os.IsNotExist(err)){
+		return "missing";
+	}
+	if (err != nil){
+		t.Fatalf("unable to read %s: %s", path, err);
+	}
+	return string(data);
+}
+
+func TestRotationKeepsBackups(t *testing.T){
+	for _, backups := range []int{0, 1, 3}{
+		path := filepath.Join(t.TempDir(), "p2p.log");
+		rotating, err := OpenRotatingFile(path, 8, backups);
+		if (err != nil){
+			t.Fatalf("unable to open log: %s", err);
+		}
+		// Every line is over half of the maximum size, so each gets a file
+		for i := range 6{
+			_, err = fmt.Fprintf(rotating, "line %d\n", i);
+			if (err != nil){
+				t.Fatalf("%d backups: unable to write line %d: %s", backups, i, err);
+			}
+		}
+		rotating.Close();
+
+		if (readLog(t, path) != "line 5\n"){
+			t.Errorf("%d backups: log has %q", backups, readLog(t, path));
+		}
+		for ind := 1; ind <= backups; ind++{
+			backup := readLog(t, fmt.Sprintf("%s.%d", path, ind));
+			if (backup != fmt.Sprintf("line %d\n", 5 - ind)){
+				t.Errorf("%d backups: backup %d has %q", backups, ind, backup);
+			}
+		}
+		extra := readLog(t, fmt.Sprintf("%s.%d", path, backups + 1));
+		if (extra != "missing"){
+			t.Errorf("%d backups: kept another backup with %q", backups, extra);
+		}
+	}
+}
+
+func TestFailedRotationKeepsLog(t *testing.T){
+	path := filepath.Join(t.TempDir(), "p2p.log");
+	// The log can't be renamed over a directory with something in it
+	err := os.MkdirAll(filepath.Join(path + ".1", "busy"), 0755);
+	if (err != nil){
+		t.Fatalf("unable to make directory: %s", err);
+	}
+	rotating, err := OpenRotatingFile(path, 8, 1);
+	if (err != nil){
+		t.Fatalf("unable to open log: %s", err);
+	}
+	defer rotating.Close();
+
+	_, err = rotating.Write([]byte("line 0\n"));
+	if (err != nil){
+		t.Fatalf("unable to write: %s", err);
+	}
+	size, err := rotating.Write([]byte("line 1\n"));
+	if (err == nil){
+		t.Errorf("expected the failed rotation to be returned");
+	}
+	if (size != len("line 1\n")){
+		t.Errorf("wrote %d bytes, expected the line to still be written", size);
+	}
+	if (readLog(t, path) != "line 0\nline 1\n"){
+		t.Errorf("log has %q after a failed rotation", readLog(t, path));
+	}
+
+	// Once the way is clear the next write rotates
+	err = os.RemoveAll(path + ".1");
+	if (err != nil){
+		t.Fatalf("unable to remove directory: %s", err);
+	}
+	_, err = rotating.Write([]byte("line 2\n"));
+	if (err != nil){
+		t.Errorf("unable to rotate: %s", err);
+	}
+	if ((readLog(t, path) != "line 2\n") || (readLog(t, path + ".1") != "line 0\nline 1\n")){
+		t.Errorf("log has %q and backup %q", readLog(t, path), readLog(t, path + ".1"));
+	}
+}
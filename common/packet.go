@@ -1,10 +1,9 @@
 package common
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
-	"time"
+	"io"
 )
 
 const (
@@ -13,6 +12,12 @@ const (
 	NicknameMaxSize = 64;
 	// PktBufferSize is the size of the byte array to serialize and deserialize the packet into
 	PktBufferSize = 4096;	
+	// packetHeaderSize is the bytes of a serialized packet before its payload
+	packetHeaderSize = 1 + 8 + NicknameMaxSize + 2;
+	// packetTrailerSize is the bytes of a serialized packet after its payload
+	packetTrailerSize = 8 + 8 + 1;
+	// payloadSize is the most bytes a packet's payload can hold
+	payloadSize = 2048;
 
 	// PktMSG indicates that the inbound packet's payload has a message to be
 	// sent to all other clients.
@@ -23,7 +28,8 @@ const (
 	PktANC = 2;		
 
 	// PktREF is used in the connection process and used if the server refused
-	// the client's connection
+	// the client's connection. A full room sends it but still accepts a
+	// PktPER in reply
 	PktREF = 3;
 
 	// PktACP is short for ACCEPT and indicates that the server accepted the client's
@@ -43,14 +49,88 @@ const (
 	PktKCK = 7;
 
 	// PktMDF is sent from the client to the server to indicate the client wishes
-	// to modify a property. The payload of this is a JSON file
+	// to modify a property. The payload of this is a JSON file. The server
+	// sends it back to every client when a nickname changes, with the old
+	// nickname as the sender
 	PktMDF = 8;
+
+	// PktPER is sent from a node to a server in place of PktACK and indicates
+	// that the connection is a link between two servers in the mesh rather
+	// than a client. The payload is a JSON encoded PeerHello
+	PktPER = 9;
+
+	// PktRLY is a message relayed between linked servers. It has the same
+	// payload as PktMSG and its Origin and Sequence identify the message
+	// across the mesh
+	PktRLY = 10;
+
+	// PktMEM is sent from the server to every client whenever someone joins,
+	// leaves or changes their nickname. The payload is a JSON encoded
+	// MemberList
+	PktMEM = 11;
+
+	// PktWSP is a direct message to one client. The client sends it to its
+	// server with a JSON encoded Whisper as the payload and the server passes
+	// it on to the client with that nickname, with the sender filled in
+	PktWSP = 12;
 )
 
+// ServerHello is a struct used to encode and decode JSON packets for PktACP
+// and PktREF. Older servers send them without a payload
+type ServerHello struct{
+	// Compression is the compression methods the server accepts, the most
+	// preferred first
+	Compression []string;
+	// Compact is true if the server can send and receive compact frames, see
+	// WritePacket
+	Compact bool `json:",omitempty"`;
+}
+
+// PeerHello is a struct used to encode and decode JSON packets for PktPER
+type PeerHello struct{
+	NodeID uint64;
+	// Secret is checked against the server's MeshSecret
+	Secret string `json:",omitempty"`;
+	// Password is checked against the server's password if it has one
+	Password string `json:",omitempty"`;
+	// Compression is the method picked from the ServerHello, or blank for
+	// the encoding older nodes use
+	Compression string `json:",omitempty"`;
+	// Compact is true if the ServerHello offered compact frames. Everything
+	// after the PktPER is sent in them both ways
+	Compact bool `json:",omitempty"`;
+}
+
 // ClientModifcation is a struct used to encode and decode JSON packets for
 // PktMDF 
 type ClientModifcation struct{
 	NewName string;
+	// Password is only sent in the ACK packet and is checked against the
+	// server's password if it has one
+	Password string;
+	// Compression is only sent in the ACK packet and is the method the client
+	// picked from the ServerHello, or blank for the encoding older nodes use
+	Compression string `json:",omitempty"`;
+	// Compact is only sent in the ACK packet and is true if the ServerHello
+	// offered compact frames. Everything after the ACK is sent in them both
+	// ways
+	Compact bool `json:",omitempty"`;
+}
+
+// MemberList is a struct used to encode and decode JSON packets for PktMEM
+type MemberList struct{
+	// Members is the sorted nicknames of the clients on the server, cut short
+	// if they don't all fit in one packet
+	Members []string;
+	Total int;
+	// Nickname is the nickname of the client the list was sent to
+	Nickname string;
+}
+
+// Whisper is a struct used to encode and decode JSON packets for PktWSP
+type Whisper struct{
+	To string;		// The nickname the message is for
+	Text string;
 }
 
 // MsgPacket is what is sent over sockets
@@ -60,6 +140,14 @@ type MsgPacket struct {
 	SendNickname string	// Filled in by the server
 	PayloadSize uint16
 	Payload [2048]byte
+	// Origin is the ID of the server the message was first sent to and
+	// Sequence is that server's counter for it. Together they uniquely
+	// identify a message as it's relayed through the mesh
+	Origin uint64
+	Sequence uint64
+	// Flags holds how the payload is encoded in its low bits, see
+	// FlagEncodingMask. Older nodes leave it as 0
+	Flags uint8
 }
 
 // Encodes the given number in network order and returns an array of bytes
@@ -101,6 +189,15 @@ func SerializePacket(pkt *MsgPacket, dest []byte) (error){
 	cursor += 2;
 
 	copy(dest[cursor:], pkt.Payload[:]);
+	cursor += uint64(len(pkt.Payload));
+
+	encodeNumber64(pkt.Origin, dest[cursor:]);
+	cursor += 8;
+
+	encodeNumber64(pkt.Sequence, dest[cursor:]);
+	cursor += 8;
+
+	dest[cursor] = pkt.Flags;
 
 	return nil;
 }
@@ -112,6 +209,9 @@ func DeserializePacket(byteArray []byte) (MsgPacket){
 	var timestamp uint64;
 	var size uint16;
 	var payload [2048]byte;
+	var origin uint64;
+	var sequence uint64;
+	var flags uint8;
 
 	var cursor uint64;
 
@@ -128,40 +228,92 @@ func DeserializePacket(byteArray []byte) (MsgPacket){
 	cursor += 2;
 
 	copy(payload[:], byteArray[cursor:]);
+	cursor += uint64(len(payload));
 
-	return MsgPacket{PktType: pktType, Timestamp: timestamp, SendNickname: nick, PayloadSize: size, Payload: payload};
-}
+	origin = decodeNumber64(byteArray[cursor:]);
+	cursor += 8;
 
-// EncodeMessage takes the given packet and string and compresses the string,
-// sets the timestamp and the packet size. The packet is modified in place
-func EncodeMessage(pkt *MsgPacket, content string) (error){
-	var stringBuffer bytes.Buffer;
+	sequence = decodeNumber64(byteArray[cursor:]);
+	cursor += 8;
 
-	pkt.Timestamp = uint64(time.Now().Unix());
+	flags = byteArray[cursor];
 
-	_, err := WriteTo(&stringBuffer, content);
-	if (err != nil){
-		return fmt.Errorf("packet: %s", err);
-	}
-	pkt.PayloadSize = uint16(stringBuffer.Len());
-	copy(pkt.Payload[:], stringBuffer.Bytes());
+	return MsgPacket{PktType: pktType, Timestamp: timestamp, SendNickname: nick, PayloadSize: size, Payload: payload,
+		Origin: origin, Sequence: sequence, Flags: flags};
+}
 
-	return nil;
+// EncodeMessage takes the given packet and string and puts the string in the
+// payload as it is, sets the timestamp and the packet size. The packet is
+// modified in place. It's compressed for each connection when it's written,
+// see CompressPacket
+func EncodeMessage(pkt *MsgPacket, content string) (error){
+	return EncodeMessageWith(pkt, content, Compression{Method: CompressionNone});
 }
 
 // Decode message takes the given pointer and returns the string associated with
-// the payload
+// the payload, in whichever encoding its Flags say it's in
 func DecodeMessage(pkt *MsgPacket) (string, error){
-	var retVal string;
-	var err error;
+	if (int(pkt.PayloadSize) > len(pkt.Payload)){
+		return "", fmt.Errorf("packet: payload size %d is larger than a packet", pkt.PayloadSize);
+	}
+	return decodePayload(pkt.Payload[:pkt.PayloadSize], pkt.Flags & FlagEncodingMask);
+}
+
+// WritePacket writes the serialized packet in data to out in a single write.
+// Unless compact is set it's written as the whole PktBufferSize bytes, which is
+// all older nodes can read. A compact frame is the packet's length as two bytes
+// followed by the packet without the unused end of its payload, so a short or
+// compressed payload means fewer bytes are sent
+func WritePacket(out io.Writer, data []byte, compact bool) (error){
+	if (!compact){
+		_, err := out.Write(data[:PktBufferSize]);
+		return err;
+	}
+
+	size := int(decodeNumber16(data[packetHeaderSize - 2:]));
+	if (size > payloadSize){
+		return fmt.Errorf("packet: payload size %d is larger than a packet", size);
+	}
+	length := packetHeaderSize + size + packetTrailerSize;
+	frame := make([]byte, 2 + length);
+	encodeNumber16(uint16(length), frame);
+	copy(frame[2:], data[:packetHeaderSize + size]);
+	copy(frame[2 + packetHeaderSize + size:], data[packetHeaderSize + payloadSize:][:packetTrailerSize]);
+	_, err := out.Write(frame);
+	return err;
+}
 
-	var buffer bytes.Buffer;
-	buffer.Write(pkt.Payload[:pkt.PayloadSize]);
+// ReadPacket reads a packet written by WritePacket into data, which must be
+// PktBufferSize bytes, so it can be passed to DeserializePacket whichever way
+// it was framed
+func ReadPacket(in io.Reader, data []byte, compact bool) (error){
+	if (!compact){
+		_, err := io.ReadFull(in, data[:PktBufferSize]);
+		return err;
+	}
 
-	retVal, err = ReadFrom(&buffer)
+	var prefix [2]byte;
+	_, err := io.ReadFull(in, prefix[:]);
 	if (err != nil){
-		return "", err;
+		return err;
+	}
+	length := int(decodeNumber16(prefix[:]));
+	if ((length < packetHeaderSize + packetTrailerSize) || (length > packetHeaderSize + payloadSize + packetTrailerSize)){
+		return fmt.Errorf("packet: frame of %d bytes isn't a packet", length);
+	}
+	_, err = io.ReadFull(in, data[:length]);
+	if (err != nil){
+		return err;
+	}
+	size := length - packetHeaderSize - packetTrailerSize;
+	if (int(decodeNumber16(data[packetHeaderSize - 2:])) != size){
+		return fmt.Errorf("packet: frame of %d bytes doesn't match its payload size", length);
 	}
-	return retVal, nil;
 
-}
\ No newline at end of file
+	// Move the fields after the payload back to where they're serialized
+	var trailer [packetTrailerSize]byte;
+	copy(trailer[:], data[packetHeaderSize + size:length]);
+	clear(data[packetHeaderSize + size:PktBufferSize]);
+	copy(data[packetHeaderSize + payloadSize:], trailer[:]);
+	return nil;
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCompactFrames(t *testing.T){
+	pkt := MsgPacket{
+		PktType: PktRLY,
+		SendNickname: "alice",
+		Origin: 7,
+		Sequence: 42,
+	}
+	err := EncodeMessageWith(&pkt, "hello hello hello hello hello hello hello", Compression{Method: CompressionDict,
+		Threshold: DefaultCompressionThreshold});
+	if (err != nil){
+		t.Fatalf("unable to encode message: %s", err);
+	}
+	data := make([]byte, PktBufferSize);
+	err = SerializePacket(&pkt, data);
+	if (err != nil){
+		t.Fatalf("unable to serialize packet: %s", err);
+	}
+
+	for _, compact := range []bool{false, true}{
+		var wire bytes.Buffer;
+		// Twice to check a frame doesn't read into the next
+		for range 2{
+			err = WritePacket(&wire, data, compact);
+			if (err != nil){
+				t.Fatalf("unable to write packet: %s", err);
+			}
+		}
+		if (compact && (wire.Len() > 2 * (2 + packetHeaderSize + int(pkt.PayloadSize) + packetTrailerSize))){
+			t.Errorf("compact frames took %d bytes", wire.Len());
+		}
+
+		for range 2{
+			read := make([]byte, PktBufferSize);
+			// Anything left in the buffer mustn't end up in the packet
+			for i := range read{
+				read[i] = 0xff;
+			}
+			err = ReadPacket(&wire, read, compact);
+			if (err != nil){
+				t.Fatalf("unable to read packet: %s", err);
+			}
+			if (!bytes.Equal(read, data)){
+				t.Fatalf("packet read with compact %t doesn't match the one written", compact);
+			}
+		}
+	}
+
+	// A length that can't be a packet is refused rather than read
+	err = ReadPacket(bytes.NewReader([]byte{0xff, 0xff}), make([]byte, PktBufferSize), true);
+	if (err == nil){
+		t.Errorf("expected an oversized frame to be refused");
+	}
+}
+
+func TestLongContentIsCutBetweenCharacters(t *testing.T){
+	// Each character is 3 bytes, so MaxContentSize falls part way through one
+	content := strings.Repeat("∑", MaxContentSize);
+	for _, method := range []string{CompressionLegacy, CompressionNone, CompressionFlate, CompressionDict}{
+		pkt := MsgPacket{PktType: PktMSG};
+		err := EncodeMessageWith(&pkt, content, Compression{Method: method});
+		if (err != nil){
+			t.Fatalf("%s: unable to encode message: %s", method, err);
+		}
+		decoded, err := DecodeMessage(&pkt);
+		if (err != nil){
+			t.Fatalf("%s: unable to decode message: %s", method, err);
+		}
+		// The legacy encoding pads the content out with null bytes
+		decoded = strings.TrimRight(decoded, "\x00");
+		if (!utf8.ValidString(decoded)){
+			t.Errorf("%s: decoded text isn't valid UTF-8", method);
+		}
+		if (decoded != content[:MaxContentSize - (MaxContentSize % 3)]){
+			t.Errorf("%s: decoded %d bytes, expected the %d bytes of whole characters", method, len(decoded),
+				MaxContentSize - (MaxContentSize % 3));
+		}
+	}
+}
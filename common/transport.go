@@ -0,0 +1,236 @@
+package common
+
+// Handles the different ways servers can listen for and clients can reach
+// each other. Addresses can be prefixed with a scheme to pick the transport:
+//	- host:port or tcp://host:port	: TCP
+//	- unix:///path/to/socket		: Unix domain socket on the same host
+//	- mem://name					: In-memory pipe within the same process
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Transport creates the listeners servers accept clients on and the
+// connections clients use to reach servers
+type Transport interface{
+	Listen(addr string) (net.Listener, error);
+	Dial(addr string, timeout time.Duration) (net.Conn, error);
+}
+
+// TCPTransport connects over TCP with addresses in the format address:port
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error){
+	// Binding an IP literal only listens on that family, so that 0.0.0.0:port
+	// and [::]:port can both be bound. A blank host listens on both
+	network := "tcp";
+	host, _, err := net.SplitHostPort(addr);
+	if (err == nil){
+		ip := net.ParseIP(host);
+		if (ip != nil){
+			network = "tcp6";
+			if (ip.To4() != nil){
+				network = "tcp4";
+			}
+		}
+	}
+	return net.Listen(network, addr);
+}
+
+func (TCPTransport) Dial(addr string, timeout time.Duration) (net.Conn, error){
+	return net.DialTimeout("tcp", addr, timeout);
+}
+
+// UnixTransport connects over Unix domain sockets with addresses that are a
+// path to the socket file
+type UnixTransport struct{}
+
+func (UnixTransport) Listen(addr string) (net.Listener, error){
+	listener, err := net.Listen("unix", addr);
+	if ((err != nil) && errors.Is(err, syscall.EADDRINUSE)){
+		// Remove the socket left behind by a server that didn't shut down
+		// cleanly, but only if nothing is listening on it anymore
+		conn, dialErr := net.DialTimeout("unix", addr, time.Second);
+		if (dialErr == nil){
+			conn.Close();
+			return nil, err;
+		}
+		os.Remove(addr);
+		listener, err = net.Listen("unix", addr);
+	}
+	return listener, err;
+}
+
+func (UnixTransport) Dial(addr string, timeout time.Duration) (net.Conn, error){
+	return net.DialTimeout("unix", addr, timeout);
+}
+
+// MemoryTransport connects servers and clients in the same process with
+// in-memory pipes so that no ports or files are needed
+type MemoryTransport struct{
+	listeners map[string]*memoryListener;
+	lock sync.Mutex;
+}
+
+// memoryAddr is the net.Addr of either end of an in-memory connection
+type memoryAddr string;
+
+func (addr memoryAddr) Network() (string){
+	return "mem";
+}
+
+func (addr memoryAddr) String() (string){
+	return string(addr);
+}
+
+// memoryListener accepts connections dialled through a MemoryTransport
+type memoryListener struct{
+	name string;
+	transport *MemoryTransport;
+	inbound chan net.Conn;
+	closed chan bool;
+	closeOnce sync.Once;
+}
+
+// DefaultMemoryTransport is the transport used for mem:// addresses
+var DefaultMemoryTransport = NewMemoryTransport();
+
+// NewMemoryTransport returns a MemoryTransport with no listeners
+func NewMemoryTransport() (*MemoryTransport){
+	return &MemoryTransport{listeners: map[string]*memoryListener{}};
+}
+
+func (mt *MemoryTransport) Listen(addr string) (net.Listener, error){
+	mt.lock.Lock();
+	defer mt.lock.Unlock();
+
+	_, exists := mt.listeners[addr];
+	if (exists){
+		return nil, fmt.Errorf("transport: mem://%s is already in use", addr);
+	}
+	listener := &memoryListener{
+		name: addr,
+		transport: mt,
+		inbound: make(chan net.Conn),
+		closed: make(chan bool),
+	};
+	mt.listeners[addr] = listener;
+	return listener, nil;
+}
+
+func (mt *MemoryTransport) Dial(addr string, timeout time.Duration) (net.Conn, error){
+	mt.lock.Lock();
+	listener, exists := mt.listeners[addr];
+	mt.lock.Unlock();
+	if (!exists){
+		return nil, fmt.Errorf("transport: nothing is listening on mem://%s", addr);
+	}
+
+	serverEnd, clientEnd := net.Pipe();
+	timer := time.NewTimer(timeout);
+	defer timer.Stop();
+
+	select {
+	case listener.inbound <- serverEnd:{
+		return clientEnd, nil;
+	}
+	case <- listener.closed:
+	case <- timer.C:
+	}
+	serverEnd.Close();
+	clientEnd.Close();
+	return nil, fmt.Errorf("transport: unable to connect to mem://%s", addr);
+}
+
+func (ml *memoryListener) Accept() (net.Conn, error){
+	select {
+	case conn := <- ml.inbound:{
+		return conn, nil;
+	}
+	case <- ml.closed:{
+		return nil, net.ErrClosed;
+	}
+	}
+}
+
+func (ml *memoryListener) Close() (error){
+	ml.closeOnce.Do(func(){
+		close(ml.closed);
+		ml.transport.lock.Lock();
+		delete(ml.transport.listeners, ml.name);
+		ml.transport.lock.Unlock();
+	});
+	return nil;
+}
+
+func (ml *memoryListener) Addr() (net.Addr){
+	return memoryAddr(ml.name);
+}
+
+// ResolveAddress returns the transport to use for addr and the address to
+// pass to it with the scheme removed
+func ResolveAddress(addr string) (Transport, string, error){
+	scheme, rest, found := strings.Cut(addr, "://");
+	if (!found){
+		return TCPTransport{}, addr, nil;
+	}
+
+	switch strings.ToLower(scheme){
+	case "tcp":{
+		return TCPTransport{}, rest, nil;
+	}
+	case "unix":{
+		if (rest == ""){
+			return nil, "", fmt.Errorf("transport: %q is missing the socket path", addr);
+		}
+		return UnixTransport{}, rest, nil;
+	}
+	case "mem":{
+		if (rest == ""){
+			return nil, "", fmt.Errorf("transport: %q is missing a name", addr);
+		}
+		return DefaultMemoryTransport, rest, nil;
+	}
+	}
+	return nil, "", fmt.Errorf("transport: unknown scheme %q in %q", scheme, addr);
+}
+
+// ValidateAddress checks that addr names a transport and an address it can use
+func ValidateAddress(addr string) (error){
+	transport, rest, err := ResolveAddress(addr);
+	if (err != nil){
+		return err;
+	}
+	_, isTCP := transport.(TCPTransport);
+	if (isTCP){
+		_, _, err = net.SplitHostPort(rest);
+		if ((err != nil) && strings.Contains(rest, ":") && (net.ParseIP(rest) != nil)){
+			return fmt.Errorf("%q is missing a port, IPv6 addresses are written as [address]:port", addr);
+		}
+		if (err != nil){
+			return fmt.Errorf("%q is not in the format address:port: %s", addr, err);
+		}
+	}
+	return nil;
+}
+
+// FormatAddress returns addr in the format ResolveAddress accepts so that a
+// listener's real address can be shown to users and dialled again
+func FormatAddress(addr net.Addr) (string){
+	switch addr.Network(){
+	case "unix":{
+		return "unix://" + addr.String();
+	}
+	case "mem":{
+		return "mem://" + addr.String();
+	}
+	}
+	return addr.String();
+}
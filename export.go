@@ -0,0 +1,115 @@
+package main
+
+// The export subcommand, which turns saved transcripts into something that can
+// be read or attached without running the client
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"p2psystem/cli"
+	"p2psystem/client"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runExport runs "p2p export" with the arguments after it and returns the
+// exit status
+func runExport(args []string) (int){
+	flags := flag.NewFlagSet("export", flag.ContinueOnError);
+	configDir := flags.String("config", envOr("GOMSG_CONFIG_DIR", client.DefaultConfigDir()),
+		"directory containing clientConfig.cfg, whose TranscriptDir has the transcripts [$GOMSG_CONFIG_DIR]");
+	format := flags.String("format", "",
+		"text, json or html, by default from the extension of -o or text");
+	since := flags.String("since", "", "leave out anything before this time, e.g. 2h, 14:30 or 2006-01-02T15:04:05Z");
+	until := flags.String("until", "", "leave out anything after this time");
+	nicknames := flags.String("nick", "", "comma separated nicknames to keep the messages of");
+	outPath := flags.String("o", "", "file to write to instead of stdout");
+	flags.Usage = func(){
+		fmt.Fprintf(flags.Output(), "Usage: %s export [flags] <room address or transcript file>...\n", os.Args[0]);
+		flags.PrintDefaults();
+	};
+	err := flags.Parse(args);
+	if (errors.Is(err, flag.ErrHelp)){
+		return cli.ExitOK;
+	}
+	if (err != nil){
+		return cli.ExitUsage;
+	}
+	if (flags.NArg() == 0){
+		flags.Usage();
+		return cli.ExitUsage;
+	}
+
+	filter := client.TranscriptFilter{};
+	now := time.Now();
+	if (*since != ""){
+		filter.Since, err = client.ParseTranscriptTime(*since, now);
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Invalid -since: %s\n", err);
+			return cli.ExitUsage;
+		}
+	}
+	if (*until != ""){
+		filter.Until, err = client.ParseTranscriptTime(*until, now);
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Invalid -until: %s\n", err);
+			return cli.ExitUsage;
+		}
+	}
+	if (*nicknames != ""){
+		filter.Nicknames = strings.Split(*nicknames, ",");
+	}
+	if (*format == ""){
+		*format = client.TranscriptFormat(*outPath);
+	}
+
+	session := client.NewSession(slog.New(slog.NewTextHandler(io.Discard, nil)));
+	client.LoadConfig(session, *configDir);
+	entries := []client.TranscriptEntry{};
+	for _, source := range flags.Args(){
+		// Anything that isn't a file is the address of a room
+		path := source;
+		_, err := os.Stat(path);
+		if (os.IsNotExist(err)){
+			path = client.TranscriptPath(session, source);
+			if (path == ""){
+				fmt.Fprintf(os.Stderr, "No transcript file %s and TranscriptDir isn't set in %s\n", source, client.ConfigFileName);
+				return cli.ExitFailed;
+			}
+		}
+		read, err := client.ReadTranscript(path);
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Unable to read transcript: %s\n", err);
+			return cli.ExitFailed;
+		}
+		entries = append(entries, read...);
+	}
+	sort.SliceStable(entries, func(i int, j int) (bool){
+		return entries[i].Timestamp.Before(entries[j].Timestamp);
+	});
+	entries = client.FilterTranscript(entries, filter);
+
+	var buffer bytes.Buffer;
+	err = client.ExportTranscript(&buffer, entries, *format);
+	if (err != nil){
+		fmt.Fprintf(os.Stderr, "Unable to export: %s\n", err);
+		return cli.ExitUsage;
+	}
+	if (*outPath == ""){
+		os.Stdout.Write(buffer.Bytes());
+		return cli.ExitOK;
+	}
+	err = os.WriteFile(*outPath, buffer.Bytes(), 0600);
+	if (err != nil){
+		fmt.Fprintf(os.Stderr, "Unable to export: %s\n", err);
+		return cli.ExitFailed;
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d entries to %s\n", len(entries), *outPath);
+	return cli.ExitOK;
+}
@@ -1,13 +1,206 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
 	"p2psystem/cli"
 	"p2psystem/client"
+	"p2psystem/common"
 	"p2psystem/server"
+	"syscall"
 )
 
+const (
+	// ModeBoth runs the server, the client and the interactive CLI together
+	ModeBoth = "both";
+	// ModeHost runs only the server and doesn't read from stdin
+	ModeHost = "host";
+	// ModeClient runs only the client and the interactive CLI
+	ModeClient = "client";
+)
+
+// envOr returns the value of the environment variable key or fallback if it
+// isn't set. This lets every flag's default be overridden from the environment
+func envOr(key string, fallback string) (string){
+	value, exists := os.LookupEnv(key);
+	if (!exists){
+		return fallback;
+	}
+	return value;
+}
+
 func main(){
-	client.Init();
-	server.Init("localhost", 9001);
-	cli.Init();
-}
\ No newline at end of file
+	if ((len(os.Args) > 1) && (os.Args[1] == "export")){
+		os.Exit(runExport(os.Args[2:]));
+	}
+
+	mode := flag.String("mode", envOr("GOMSG_MODE", ModeBoth),
+		"what to run: both, host (server only, no stdin) or client (no server) [$GOMSG_MODE]");
+	listen := flag.String("listen", envOr("GOMSG_LISTEN", ""),
+		"comma separated addresses the server listens on, overrides Listen in serverConfig.cfg [$GOMSG_LISTEN]");
+	configDir := flag.String("config", envOr("GOMSG_CONFIG_DIR", client.DefaultConfigDir()),
+		"directory containing clientConfig.cfg, serverConfig.cfg and the input history [$GOMSG_CONFIG_DIR]");
+	nickname := flag.String("nick", envOr("GOMSG_NICK", ""),
+		"nickname to use instead of DefaultName in clientConfig.cfg [$GOMSG_NICK]");
+	logLevelName := flag.String("log-level", envOr("GOMSG_LOG_LEVEL", "info"),
+		"how much to log: debug, info, warn or error [$GOMSG_LOG_LEVEL]");
+	logFile := flag.String("log-file", envOr("GOMSG_LOG_FILE", ""),
+		"file to log to instead of stderr, rotated once it reaches 10MB [$GOMSG_LOG_FILE]");
+	batch := flag.String("batch", envOr("GOMSG_BATCH", ""),
+		"run the commands and messages in this file, or stdin if it's -, instead of the interactive CLI [$GOMSG_BATCH]");
+	output := flag.String("output", envOr("GOMSG_OUTPUT", cli.OutputText),
+		"how the client prints what it sees: text, or json for one JSON object per line [$GOMSG_OUTPUT]");
+	uiMode := flag.String("ui", envOr("GOMSG_UI", cli.UIAuto),
+		"client interface: auto, full (full screen, Linux, macOS and the BSDs) or line (a line at a time, for dumb terminals "+
+		"and pipes) [$GOMSG_UI]");
+	flag.Parse();
+
+	level, err := common.ParseLogLevel(*logLevelName);
+	if (err != nil){
+		fmt.Fprintf(os.Stderr, "%s\n", err);
+		os.Exit(2);
+	}
+	logLevel := &slog.LevelVar{};
+	logLevel.Set(level);
+
+	ui, err := cli.ResolveUI(*uiMode);
+	if (err != nil){
+		fmt.Fprintf(os.Stderr, "%s\n", err);
+		os.Exit(2);
+	}
+	// stdout is only for the client's output so other programs can read it
+	var notices io.Writer = os.Stdout;
+	switch *output{
+	case cli.OutputText:
+	case cli.OutputJSON:{
+		ui = cli.UILine;
+		notices = os.Stderr;
+	}
+	default:{
+		fmt.Fprintf(os.Stderr, "Unknown output %q: expected %s or %s\n", *output, cli.OutputText, cli.OutputJSON);
+		os.Exit(2);
+	}
+	}
+
+	var logOutput io.Writer = os.Stderr;
+	if (*logFile != ""){
+		rotating, err := common.OpenRotatingFile(*logFile, common.LogFileMaxSize, common.LogFileBackups);
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Unable to open log file: %s\n", err);
+			os.Exit(1);
+		}
+		defer rotating.Close();
+		logOutput = rotating;
+	} else if ((ui == cli.UIFull) && (*mode != ModeHost) && (*batch == "")){
+		// Anything written to stderr would be drawn over the full screen
+		// interface, so without a log file there's nowhere to show the log
+		logOutput = io.Discard;
+	}
+	logger := common.NewLogger(logOutput, logLevel);
+
+	runServer := false;
+	runClient := false;
+	switch *mode{
+	case ModeBoth:{
+		runServer = true;
+		runClient = true;
+	}
+	case ModeHost:{
+		runServer = true;
+	}
+	case ModeClient:{
+		runClient = true;
+	}
+	default:{
+		fmt.Fprintf(os.Stderr, "Unknown mode %q: expected %s, %s or %s\n", *mode, ModeBoth, ModeHost, ModeClient);
+		os.Exit(2);
+	}
+	}
+
+	var room *server.ServerRoom;
+	if (runServer){
+		serverConfig := *configDir + string(os.PathSeparator) + "serverConfig.cfg";
+		_, err = os.Stat(serverConfig);
+		if (os.IsNotExist(err)){
+			logger.Info("no server config, using the defaults", "path", serverConfig);
+			serverConfig = "";
+		}
+		room, err = server.New(server.ServerOptions{
+			ConfigPath: serverConfig,
+			Listen: server.ParseListenAddrs(*listen),
+			Logger: logger.With("component", "server"),
+			LogLevel: logLevel,
+		});
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Unable to start server: %s\n", err);
+			os.Exit(1);
+		}
+		bound, err := server.Start(room);
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Unable to start server: %s\n", err);
+			os.Exit(1);
+		}
+		for _, addr := range bound{
+			fmt.Fprintf(notices, "Server listening on %s\n", addr);
+		}
+	}
+
+	exitCode := cli.ExitOK;
+	if (runClient){
+		session := client.NewSession(logger.With("component", "client"));
+		client.Init(session, *configDir, *nickname);
+		if (*batch != ""){
+			exitCode = runBatch(session, *batch, cli.CLIOptions{LogLevel: logLevel, Output: *output});
+		} else {
+			cli.Run(session, cli.CLIOptions{
+				LogLevel: logLevel,
+				UI: ui,
+				HistoryPath: *configDir + string(os.PathSeparator) + "history",
+				Output: *output,
+				AutoConnect: true,
+			});
+		}
+
+		// Shutdown the client by disconnecting from all servers
+		client.DisconnectAll(session);
+		client.StopDiscovery(session);
+		client.StopHooks(session);
+		err = client.WriteConfig(session, *configDir);
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Unable to save the client config: %s\n", err);
+		}
+	} else {
+		// Without a terminal to read from, run until we're told to stop
+		stop := make(chan os.Signal, 1);
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM);
+		<- stop;
+		logger.Info("shutting down");
+	}
+
+	if (runServer){
+		server.Stop(room);
+	}
+	if (exitCode != cli.ExitOK){
+		os.Exit(exitCode);
+	}
+}
+
+// runBatch runs the script at path, or stdin if path is -, and returns the
+// exit status
+func runBatch(session *client.ClientSession, path string, options cli.CLIOptions) (int){
+	var script io.Reader = os.Stdin;
+	if (path != "-"){
+		file, err := os.Open(path);
+		if (err != nil){
+			fmt.Fprintf(os.Stderr, "Unable to open script: %s\n", err);
+			return cli.ExitUsage;
+		}
+		defer file.Close();
+		script = file;
+	}
+	return cli.RunBatch(session, script, options);
+}
@@ -0,0 +1,234 @@
+package server
+
+// Lets the room host extend the server with bots that react to what happens
+// in the room and reply under their own nickname
+
+import (
+	"fmt"
+	"p2psystem/common"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// BotEventQueueSize is the number of events that can be waiting for the
+	// bots before new ones are dropped
+	BotEventQueueSize = 256;
+	// BotCommandPrefix starts every message that's a command for a bot
+	BotCommandPrefix = "!";
+	// HelpBotName is the nickname the built in !help replies under
+	HelpBotName = "help";
+)
+
+// RoomEventType identifies what happened in a RoomEvent
+type RoomEventType int;
+
+const (
+	// RoomJoin is sent when a client joins the room
+	RoomJoin RoomEventType = iota;
+	// RoomLeave is sent when a client leaves the room
+	RoomLeave;
+	// RoomMessage is sent for every chat message from a client on this server.
+	// Messages starting with BotCommandPrefix have Command and Args filled in
+	RoomMessage;
+	// RoomNicknameChange is sent when a client changes its nickname.
+	// Nickname is the old name and NewNickname is the new one
+	RoomNicknameChange;
+	// RoomDirectMessage is sent when a client sends a direct message to the
+	// bot called To. Command and Args are filled in as for RoomMessage
+	RoomDirectMessage;
+)
+
+// RoomEvent is something that happened in the room that bots are told about
+type RoomEvent struct{
+	Type RoomEventType;
+	Nickname string;
+	NewNickname string;
+	To string;			// The bot a RoomDirectMessage is for
+	Text string;
+	Command string;		// The command without its prefix, lowercase
+	Args []string;
+	Timestamp time.Time;
+}
+
+// BotCommand describes a command a bot answers to, listed by !help
+type BotCommand struct{
+	Name string;		// Without the prefix
+	Usage string;		// The arguments, e.g. "<sides>"
+	Description string;
+}
+
+// Bot is implemented by server extensions. HandleEvent is called for every
+// event in the room, one at a time, and can reply with SendAs, WhisperAs or
+// AnnounceMsg
+type Bot interface{
+	// Name is the nickname the bot sends messages under
+	Name() string;
+	// Commands returns the commands the bot answers to
+	Commands() []BotCommand;
+	HandleEvent(server *ServerRoom, event RoomEvent);
+}
+
+// helpBot is the built in bot that answers !help with every bot's commands
+type helpBot struct{}
+
+func (helpBot) Name() (string){
+	return HelpBotName;
+}
+
+func (helpBot) Commands() ([]BotCommand){
+	return []BotCommand{{Name: "help", Usage: "[command]", Description: "lists the commands bots answer to"}};
+}
+
+func (helpBot) HandleEvent(server *ServerRoom, event RoomEvent){
+	if (event.Command != "help"){
+		return;
+	}
+	// Answer the room, or whoever asked if it was asked directly
+	reply := func(text string){
+		SendAs(server, HelpBotName, text);
+	};
+	switch event.Type{
+	case RoomMessage:
+	case RoomDirectMessage:{
+		if (event.To != HelpBotName){
+			return;
+		}
+		reply = func(text string){
+			WhisperAs(server, HelpBotName, event.Nickname, text);
+		};
+	}
+	default:{
+		return;
+	}
+	}
+
+	commands := []BotCommand{};
+	for _, bot := range server.bots{
+		commands = append(commands, bot.Commands()...);
+	}
+	sort.Slice(commands, func(i int, j int) (bool){
+		return commands[i].Name < commands[j].Name;
+	});
+
+	if (len(event.Args) > 0){
+		name := strings.TrimPrefix(strings.ToLower(event.Args[0]), BotCommandPrefix);
+		for _, command := range commands{
+			if (command.Name == name){
+				reply(formatCommand(command));
+				return;
+			}
+		}
+		reply(fmt.Sprintf("No command called %s%s", BotCommandPrefix, name));
+		return;
+	}
+
+	lines := make([]string, 0, len(commands));
+	for _, command := range commands{
+		lines = append(lines, formatCommand(command));
+	}
+	reply("Commands: " + strings.Join(lines, ", "));
+}
+
+// formatCommand returns the command's usage and description on one line
+func formatCommand(command BotCommand) (string){
+	usage := BotCommandPrefix + command.Name;
+	if (command.Usage != ""){
+		usage += " " + command.Usage;
+	}
+	return fmt.Sprintf("%s - %s", usage, command.Description);
+}
+
+// SendAs sends text to the room as a chat message from nickname. It's relayed
+// to linked servers like any other message
+func SendAs(server *ServerRoom, nickname string, text string) (error){
+	if (len(nickname) > common.NicknameMaxSize){
+		return fmt.Errorf("serverBots.SendAs: nickname is too long");
+	}
+	pkt := common.MsgPacket{
+		PktType: common.PktMSG,
+		Timestamp: uint64(time.Now().Unix()),
+		SendNickname: nickname,
+	}
+	err := common.EncodeMessage(&pkt, text);
+	if (err != nil){
+		return fmt.Errorf("serverBots.SendAs: %s", err);
+	}
+	stampMessage(server, &pkt);
+	err = relayMessage(server, pkt, nil);
+	if (err != nil){
+		return fmt.Errorf("serverBots.SendAs: %s", err);
+	}
+	return nil;
+}
+
+// WhisperAs sends text as a direct message from nickname to the client called
+// to on this server
+func WhisperAs(server *ServerRoom, nickname string, to string, text string) (error){
+	if (len(nickname) > common.NicknameMaxSize){
+		return fmt.Errorf("serverBots.WhisperAs: nickname is too long");
+	}
+	err := deliverWhisper(server, nickname, common.Whisper{To: to, Text: text});
+	if (err != nil){
+		return fmt.Errorf("serverBots.WhisperAs: %s", err);
+	}
+	return nil;
+}
+
+// findBot returns the bot called nickname, or nil if there isn't one
+func findBot(server *ServerRoom, nickname string) (Bot){
+	for _, bot := range server.bots{
+		if (bot.Name() == nickname){
+			return bot;
+		}
+	}
+	return nil;
+}
+
+// botEvent queues an event for the bots without waiting for them
+func botEvent(server *ServerRoom, event RoomEvent){
+	event.Timestamp = time.Now();
+	if ((event.Type == RoomMessage) || (event.Type == RoomDirectMessage)){
+		fields := strings.Fields(event.Text);
+		if ((len(fields) > 0) && strings.HasPrefix(fields[0], BotCommandPrefix)){
+			event.Command = strings.ToLower(strings.TrimPrefix(fields[0], BotCommandPrefix));
+			event.Args = fields[1:];
+		}
+	}
+
+	select {
+	case server.botEvents <- event:
+	default:{
+		server.log.Warn("bots are falling behind, dropped an event", "type", int(event.Type));
+	}
+	}
+}
+
+// runBots passes every queued event to each bot until stop is closed
+func runBots(server *ServerRoom, stop chan bool){
+	for {
+		select {
+		case event := <- server.botEvents:{
+			for _, bot := range server.bots{
+				handleBotEvent(server, bot, event);
+			}
+		}
+		case <- stop:{
+			return;
+		}
+		}
+	}
+}
+
+// handleBotEvent passes event to bot, stopping a bot that panics from taking
+// the server down with it
+func handleBotEvent(server *ServerRoom, bot Bot, event RoomEvent){
+	defer func(){
+		recovered := recover();
+		if (recovered != nil){
+			server.log.Error("bot panicked", "bot", bot.Name(), "err", recovered);
+		}
+	}();
+	bot.HandleEvent(server, event);
+}
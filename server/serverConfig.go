@@ -0,0 +1,377 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"p2psystem/common"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Handles everything to do with loading, validating and reloading the server config
+
+// ServerConfig stores all the configuration values for a ServerRoom
+type ServerConfig struct {
+	// Listen is the list of addresses the server binds to, each in the format
+	// address:port, [ipv6]:port, unix:///path/to/socket or mem://name. Port 0
+	// binds any free port. A single address can be given as a plain string
+	// Changing this requires the server to be restarted
+	Listen ListenAddrs;
+
+	// MaxClients is the maximum number of clients that can be connected at once
+	MaxClients uint8;
+
+	// MOTD is the message of the day that's sent to every client that joins
+	// the room. Leaving it blank disables it
+	MOTD string;
+
+	// MaxMessageSize is the maximum number of characters in a single message.
+	// Messages larger than this are dropped by the server
+	MaxMessageSize int;
+
+	// HandshakeTimeout is the number of seconds the server waits for a client
+	// to finish the handshake before dropping it
+	HandshakeTimeout int;
+
+	// HistoryDepth is the number of recent messages that are replayed to a
+	// client when it joins the room. 0 disables history
+	HistoryDepth int;
+
+	// Peers is a list of other servers, in any format Listen accepts, that
+	// this server links to so that messages are shared between their rooms
+	Peers []string;
+
+	// MeshSecret is sent to the servers in Peers and has to be sent by any
+	// server linking to this one. Leaving it blank refuses every link from
+	// another server
+	MeshSecret string;
+
+	// Name is the name of the room shown to clients discovering it
+	Name string;
+
+	// Password must be sent by clients when they join if it isn't blank
+	Password string;
+
+	// Advertise enables announcing the room to clients on the local network
+	Advertise bool;
+
+	// DiscoveryAddr is the UDP broadcast or multicast address in the format
+	// address:port that the room is advertised to
+	DiscoveryAddr string;
+
+	// WebSocketListen is the address in the format address:port that serves
+	// the web page and the WebSocket endpoint browsers join the room through.
+	// Leaving it blank disables the gateway. Changing this requires a restart
+	WebSocketListen string;
+
+	// WebSocketOrigins are the sites, e.g. https://chat.example.com, whose
+	// pages can join through the gateway besides the page it serves itself
+	WebSocketOrigins []string;
+
+	// MetricsListen is the address in the format address:port that serves
+	// /metrics, /healthz and /readyz over HTTP. Leaving it blank disables
+	// the endpoint. Changing this requires a restart
+	MetricsListen string;
+
+	// LogLevel is one of debug, info, warn or error and sets how much the
+	// server logs. Leaving it blank keeps the level it was started with
+	LogLevel string;
+
+	// SendQueueSize is the number of chat messages that can be waiting to be
+	// sent to a single client before SendQueuePolicy is applied
+	SendQueueSize int;
+
+	// SendQueuePolicy is what happens to a client whose send queue is full:
+	// drop-oldest, drop-new or disconnect. Changes to it and to SendQueueSize
+	// only apply to clients that join afterwards
+	SendQueuePolicy string;
+
+	// Compression is the list of compression methods clients and linked
+	// servers can choose from, out of none, flate and dict, the most
+	// preferred first. Nodes that don't choose one get the padded flate
+	// older nodes use. Changes only apply to connections made afterwards
+	Compression []string;
+
+	// CompressionLevel is the flate level from 1 to 9 the server compresses
+	// with
+	CompressionLevel int;
+
+	// CompressionThreshold is the size in bytes below which payloads are sent
+	// uncompressed
+	CompressionThreshold int;
+}
+
+// ListenAddrs is a list of addresses that can be written in the config as
+// either a JSON list or a single string
+type ListenAddrs []string;
+
+func (addrs *ListenAddrs) UnmarshalJSON(data []byte) (error){
+	var single string;
+	err := json.Unmarshal(data, &single);
+	if (err == nil){
+		*addrs = ListenAddrs{single};
+		return nil;
+	}
+	var list []string;
+	err = json.Unmarshal(data, &list);
+	if (err != nil){
+		return fmt.Errorf("expected an address or a list of addresses");
+	}
+	*addrs = list;
+	return nil;
+}
+
+// ParseListenAddrs splits a comma separated list of addresses
+func ParseListenAddrs(list string) (ListenAddrs){
+	addrs := ListenAddrs{};
+	for _, addr := range strings.Split(list, ","){
+		addr = strings.TrimSpace(addr);
+		if (addr != ""){
+			addrs = append(addrs, addr);
+		}
+	}
+	return addrs;
+}
+
+const (
+	// MessageSizeLimit is the largest MaxMessageSize that a config can set
+	// since every message is encoded into a buffer of this size
+	MessageSizeLimit = 1024;
+	// HistoryDepthLimit is the largest HistoryDepth that a config can set
+	HistoryDepthLimit = 1000;
+	// SendQueueLimit is the largest SendQueueSize that a config can set
+	SendQueueLimit = 4096;
+
+	// QueueDropOldest drops the oldest queued message to make room for a new one
+	QueueDropOldest = "drop-oldest";
+	// QueueDropNew drops new messages until there's room in the queue
+	QueueDropNew = "drop-new";
+	// QueueDisconnect kicks the client once its queue is full
+	QueueDisconnect = "disconnect";
+)
+
+// DefaultServerConfig returns the config that's used for any values not
+// present in the config file
+func DefaultServerConfig() (ServerConfig){
+	return ServerConfig{
+		Listen: ListenAddrs{":9002"},
+		MaxClients: InitialMaxClients,
+		MOTD: "",
+		MaxMessageSize: MessageSizeLimit,
+		HandshakeTimeout: 4,
+		HistoryDepth: 0,
+		Peers: []string{},
+		MeshSecret: "",
+		Name: "",
+		Password: "",
+		Advertise: false,
+		DiscoveryAddr: common.DefaultDiscoveryAddr,
+		WebSocketListen: "",
+		WebSocketOrigins: []string{},
+		MetricsListen: "",
+		LogLevel: "",
+		SendQueueSize: 512,
+		SendQueuePolicy: QueueDropOldest,
+		Compression: slices.Clone(common.DefaultCompressionMethods),
+		CompressionLevel: common.DefaultCompressionLevel,
+		CompressionThreshold: common.DefaultCompressionThreshold,
+	};
+}
+
+// Validate checks that every value in the config is usable and returns an
+// error describing the first invalid value found
+func (cfg *ServerConfig) Validate() (error){
+	if (len(cfg.Listen) == 0){
+		return fmt.Errorf("Listen must contain at least one address");
+	}
+	var err error;
+	for _, addr := range cfg.Listen{
+		err = common.ValidateAddress(addr);
+		if (err != nil){
+			return fmt.Errorf("Listen: %s", err);
+		}
+	}
+	if (cfg.MaxClients == 0){
+		return fmt.Errorf("MaxClients must be between 1 and 255");
+	}
+	if ((cfg.MaxMessageSize < 1) || (cfg.MaxMessageSize > MessageSizeLimit)){
+		return fmt.Errorf("MaxMessageSize must be between 1 and %d, got %d", MessageSizeLimit, cfg.MaxMessageSize);
+	}
+	if (cfg.HandshakeTimeout < 1){
+		return fmt.Errorf("HandshakeTimeout must be at least 1 second, got %d", cfg.HandshakeTimeout);
+	}
+	if ((cfg.HistoryDepth < 0) || (cfg.HistoryDepth > HistoryDepthLimit)){
+		return fmt.Errorf("HistoryDepth must be between 0 and %d, got %d", HistoryDepthLimit, cfg.HistoryDepth);
+	}
+	_, _, err = net.SplitHostPort(cfg.DiscoveryAddr);
+	if (err != nil){
+		return fmt.Errorf("DiscoveryAddr %q is not in the format address:port: %s", cfg.DiscoveryAddr, err);
+	}
+	if (cfg.WebSocketListen != ""){
+		_, _, err = net.SplitHostPort(cfg.WebSocketListen);
+		if (err != nil){
+			return fmt.Errorf("WebSocketListen %q is not in the format address:port: %s", cfg.WebSocketListen, err);
+		}
+	}
+	for _, origin := range cfg.WebSocketOrigins{
+		parsed, err := url.Parse(origin);
+		if ((err != nil) || (parsed.Scheme == "") || (parsed.Host == "")){
+			return fmt.Errorf("WebSocketOrigins: %q is not in the format scheme://host[:port]", origin);
+		}
+	}
+	if (cfg.MetricsListen != ""){
+		_, _, err = net.SplitHostPort(cfg.MetricsListen);
+		if (err != nil){
+			return fmt.Errorf("MetricsListen %q is not in the format address:port: %s", cfg.MetricsListen, err);
+		}
+	}
+	if ((cfg.SendQueueSize < 1) || (cfg.SendQueueSize > SendQueueLimit)){
+		return fmt.Errorf("SendQueueSize must be between 1 and %d, got %d", SendQueueLimit, cfg.SendQueueSize);
+	}
+	switch cfg.SendQueuePolicy{
+	case QueueDropOldest, QueueDropNew, QueueDisconnect:
+	default:{
+		return fmt.Errorf("SendQueuePolicy must be %s, %s or %s, got %q", QueueDropOldest, QueueDropNew,
+			QueueDisconnect, cfg.SendQueuePolicy);
+	}
+	}
+	if (cfg.LogLevel != ""){
+		_, err = common.ParseLogLevel(cfg.LogLevel);
+		if (err != nil){
+			return err;
+		}
+	}
+	for _, peer := range cfg.Peers{
+		err = common.ValidateAddress(peer);
+		if (err != nil){
+			return fmt.Errorf("Peers: %s", err);
+		}
+	}
+	if ((len(cfg.Peers) > 0) && (cfg.MeshSecret == "")){
+		return fmt.Errorf("MeshSecret must be set to link to Peers");
+	}
+	err = common.ValidateCompression(cfg.Compression, cfg.CompressionLevel, cfg.CompressionThreshold);
+	if (err != nil){
+		return fmt.Errorf("Compression: %s", err);
+	}
+	return nil;
+}
+
+// ReadServerConfig parses the .cfg file at FilePath and returns the validated
+// config. Any values missing from the file are taken from DefaultServerConfig
+// The cfg file is formatted in JSON
+func ReadServerConfig(FilePath string) (ServerConfig, error){
+	cfg := DefaultServerConfig();
+
+	data, err := os.ReadFile(FilePath);
+	if (err != nil){
+		return cfg, fmt.Errorf("serverConfig: unable to read %s: %s", FilePath, err);
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data));
+	decoder.DisallowUnknownFields();
+	err = decoder.Decode(&cfg);
+	if (err != nil){
+		return cfg, fmt.Errorf("serverConfig: unable to parse %s: %s", FilePath, err);
+	}
+
+	err = cfg.Validate();
+	if (err != nil){
+		return cfg, fmt.Errorf("serverConfig: invalid value in %s: %s", FilePath, err);
+	}
+
+	return cfg, nil;
+}
+
+// GetConfig returns a copy of the config the server is currently running with
+func GetConfig(server *ServerRoom) (ServerConfig){
+	server.configLock.RLock();
+	defer server.configLock.RUnlock();
+	return server.config;
+}
+
+// ApplyConfig replaces the settings of the running server that can be changed
+// without dropping any connected clients. Settings that can't be changed are
+// left as they are and are reported in the returned error
+func ApplyConfig(server *ServerRoom, cfg ServerConfig) (error){
+	err := cfg.Validate();
+	if (err != nil){
+		return fmt.Errorf("serverConfig.ApplyConfig: %s", err);
+	}
+
+	server.configLock.Lock();
+	defer server.configLock.Unlock();
+
+	var retErr error;
+	if (!slices.Equal(cfg.Listen, server.config.Listen)){
+		retErr = fmt.Errorf("serverConfig.ApplyConfig: Listen cannot change from %q to %q without a restart", server.config.Listen, cfg.Listen);
+		cfg.Listen = server.config.Listen;
+	}
+	if (cfg.WebSocketListen != server.config.WebSocketListen){
+		retErr = fmt.Errorf("serverConfig.ApplyConfig: WebSocketListen cannot change from %q to %q without a restart",
+			server.config.WebSocketListen, cfg.WebSocketListen);
+		cfg.WebSocketListen = server.config.WebSocketListen;
+	}
+	if (cfg.MetricsListen != server.config.MetricsListen){
+		retErr = fmt.Errorf("serverConfig.ApplyConfig: MetricsListen cannot change from %q to %q without a restart",
+			server.config.MetricsListen, cfg.MetricsListen);
+		cfg.MetricsListen = server.config.MetricsListen;
+	}
+	server.config = cfg;
+	applyLogLevel(server, cfg);
+
+	return retErr;
+}
+
+// applyLogLevel changes the server's log level to the config's LogLevel
+func applyLogLevel(server *ServerRoom, cfg ServerConfig){
+	if ((server.logLevel == nil) || (cfg.LogLevel == "")){
+		return;
+	}
+	level, err := common.ParseLogLevel(cfg.LogLevel);
+	if (err == nil){
+		server.logLevel.Set(level);
+	}
+}
+
+// ReloadConfig re-reads the config at FilePath and applies it to the server
+func ReloadConfig(server *ServerRoom, FilePath string) (error){
+	cfg, err := ReadServerConfig(FilePath);
+	if (err != nil){
+		return err;
+	}
+	if (len(server.listenOverride) > 0){
+		cfg.Listen = server.listenOverride;
+	}
+	return ApplyConfig(server, cfg);
+}
+
+// watchReload reloads the server config from FilePath every time the process
+// receives SIGHUP until stop is closed
+func watchReload(server *ServerRoom, FilePath string, stop chan bool){
+	hangup := make(chan os.Signal, 1);
+	signal.Notify(hangup, syscall.SIGHUP);
+	defer signal.Stop(hangup);
+
+	for {
+		select {
+		case <- hangup:{
+			err := ReloadConfig(server, FilePath);
+			if (err != nil){
+				server.log.Warn("problem reloading config", "path", FilePath, "err", err);
+				continue;
+			}
+			server.log.Info("reloaded config", "path", FilePath);
+		}
+		case <- stop:{
+			return;
+		}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+// Advertises the server to clients on the local network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"p2psystem/common"
+	"time"
+)
+
+const (
+	// DiscoveryInterval is how often the server advertises itself
+	DiscoveryInterval = 2 * time.Second;
+)
+
+// countClients returns the number of live clients connected to the server,
+// not including links to other servers
+func countClients(server *ServerRoom) (int){
+	count := 0;
+	for _, conn := range liveConnections(server){
+		if (!conn.peer){
+			count ++;
+		}
+	}
+	return count;
+}
+
+// buildAdvertisement returns the announcement describing the server's room
+func buildAdvertisement(server *ServerRoom) (common.RoomAdvertisement, error){
+	cfg := GetConfig(server);
+
+	// Clients reach the room on the address the advert came from, so only the
+	// port of the first TCP listener is needed
+	portNum := 0;
+	for _, socket := range server.sockets{
+		tcpAddr, isTCP := socket.Addr().(*net.TCPAddr);
+		if (isTCP){
+			portNum = tcpAddr.Port;
+			break;
+		}
+	}
+	if (portNum == 0){
+		return common.RoomAdvertisement{}, fmt.Errorf("serverDiscovery: the server isn't listening on TCP");
+	}
+
+	return common.RoomAdvertisement{
+		Name: cfg.Name,
+		Port: portNum,
+		Users: countClients(server),
+		MaxUsers: int(cfg.MaxClients),
+		Password: (cfg.Password != ""),
+	}, nil;
+}
+
+// advertise periodically sends the server's advertisement to the config's
+// DiscoveryAddr while Advertise is enabled until stop is closed
+func advertise(server *ServerRoom, stop chan bool){
+	ticker := time.NewTicker(DiscoveryInterval);
+	defer ticker.Stop();
+
+	var socket *net.UDPConn;
+	var socketAddr string;
+	defer func(){
+		if (socket != nil){
+			socket.Close();
+		}
+	}();
+
+	for {
+		select {
+		case <- ticker.C:
+		case <- stop:{
+			return;
+		}
+		}
+
+		cfg := GetConfig(server);
+		if (!cfg.Advertise){
+			continue;
+		}
+
+		// Reopen the socket if the address was changed by a reload
+		if ((socket == nil) || (socketAddr != cfg.DiscoveryAddr)){
+			if (socket != nil){
+				socket.Close();
+				socket = nil;
+			}
+			udpAddr, err := net.ResolveUDPAddr("udp4", cfg.DiscoveryAddr);
+			if (err == nil){
+				socket, err = net.DialUDP("udp4", nil, udpAddr);
+			}
+			if (err != nil){
+				server.log.Warn("unable to advertise room", "addr", cfg.DiscoveryAddr, "err", err);
+				socket = nil;
+				continue;
+			}
+			socketAddr = cfg.DiscoveryAddr;
+		}
+
+		advert, err := buildAdvertisement(server);
+		if (err != nil){
+			continue;
+		}
+		data, err := json.Marshal(advert);
+		if (err != nil){
+			continue;
+		}
+		socket.Write(data);
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTCPRoom is startRoom with a TCP listener on a free port as well
+func startTCPRoom(t *testing.T, cfg ServerConfig) (*ServerRoom, string){
+	t.Helper();
+	memAddr := "mem://" + t.Name() + "/" + cfg.Name;
+	room, err := New(ServerOptions{
+		Config: &cfg,
+		Listen: ListenAddrs{memAddr, "127.0.0.1:0"},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	});
+	if (err != nil){
+		t.Fatalf("unable to create server: %s", err);
+	}
+	_, err = Start(room);
+	if (err != nil){
+		t.Fatalf("unable to start server: %s", err);
+	}
+	t.Cleanup(func(){
+		Stop(room);
+	});
+	return room, memAddr;
+}
+
+func TestBuildAdvertisement(t *testing.T){
+	cfg := DefaultServerConfig();
+	cfg.Name = "lobby";
+	cfg.MaxClients = 5;
+	room, memAddr := startTCPRoom(t, cfg);
+
+	// The port is the TCP listener's even though the mem:// one comes first
+	port := 0;
+	for _, socket := range room.sockets{
+		tcpAddr, isTCP := socket.Addr().(*net.TCPAddr);
+		if (isTCP){
+			port = tcpAddr.Port;
+		}
+	}
+	advert, err := buildAdvertisement(room);
+	if (err != nil){
+		t.Fatalf("unable to build an advertisement: %s", err);
+	}
+	if ((advert.Name != "lobby") || (advert.Port != port) || (advert.Users != 0) || (advert.MaxUsers != 5) || advert.Password){
+		t.Errorf("got %+v, expected lobby on port %d with 0 of 5 users and no password", advert, port);
+	}
+
+	dialRoom(t, memAddr, "alice");
+	deadline := time.Now().Add(testTimeout);
+	for (advert.Users != 1){
+		if (time.Now().After(deadline)){
+			t.Fatalf("advertised %d users after alice joined", advert.Users);
+		}
+		time.Sleep(10 * time.Millisecond);
+		advert, err = buildAdvertisement(room);
+		if (err != nil){
+			t.Fatalf("unable to build an advertisement: %s", err);
+		}
+	}
+
+	cfg.Name = "locked";
+	cfg.Password = "secret";
+	locked, _ := startTCPRoom(t, cfg);
+	advert, err = buildAdvertisement(locked);
+	if ((err != nil) || !advert.Password){
+		t.Errorf("got %+v and %v for a room with a password", advert, err);
+	}
+
+	memOnly, _ := startRoom(t, "memonly", cfg);
+	_, err = buildAdvertisement(memOnly);
+	if (err == nil){
+		t.Errorf("expected a room that isn't listening on TCP not to be advertised");
+	}
+}
@@ -3,22 +3,46 @@ package server
 // Contains all the private methods used to manage connections
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"p2psystem/common"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type serverConnection struct{
 	client net.Conn;
+	// nickname is read with getNickname and changed with setNickname once the
+	// connection is inserted, as other goroutines read it from then on
 	nickname string;
-	dead bool;	// true if the socket is closed
+	nameLock sync.RWMutex;
+	dead atomic.Bool;	// true if the socket is closed
 	instructions chan int8;
+	outbound chan []byte;	// Serialized chat packets waiting to be written
+	control chan []byte;	// Serialized control packets, written before any chat
+	policy string;			// The SendQueuePolicy applied when outbound is full
+	queueLock sync.Mutex;
+	overflowed atomic.Bool;	// true once the connection has been kicked for falling behind
+	stats queueStats;
+	closing chan bool;		// Closed when the writer should finish the queue and stop
+	writerDone chan bool;	// Closed once the writer has stopped
+	stopped chan bool;		// Closed once connectionMain has finished with the connection
+	peer bool;	// true if the connection is a link to another server
+	peerAddr string;	// The address dialled if this server created the link
+	// compression is how payloads are encoded before they're written. It's
+	// agreed in the handshake and the zero value is what older nodes use
+	compression common.Compression;
+	// compact is true if packets after the handshake are sent and received
+	// in compact frames, see common.WritePacket
+	compact bool;
 }
 
 // Forcibly closes the client and issues a KCK packet to the client
@@ -29,27 +53,136 @@ func kickClient(conn *serverConnection, reason string) (error){
 	return nil;
 }
 
+// sendKick sends a KCK packet with the given reason to the client without
+// closing the connection
+func sendKick(conn *serverConnection, reason string) (error){
+	pkt := common.MsgPacket{
+		PktType: common.PktKCK,
+	}
+	err := common.EncodeMessage(&pkt, reason);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendKick: %s", err);
+	}
+	data := make([]byte, common.PktBufferSize);
+	err = common.SerializePacket(&pkt, data);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendKick: %s", err);
+	}
+	data, err = common.CompressPacket(data, conn.compression);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendKick: %s", err);
+	}
+	err = common.WritePacket(conn.client, data, conn.compact);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendKick: %s", err);
+	}
+	return nil;
+}
+
 // changes the given client's nickname to the given new name and announces the
 // change to all clients
 func changeNickname(server *ServerRoom, conn *serverConnection, newName string) (error){
-	if ((conn == nil) || conn.dead){
+	if ((conn == nil) || conn.dead.Load()){
 		return fmt.Errorf("Client is already closed");
 	}
 
-	if (conn.nickname == newName){
+	oldNick := getNickname(conn);
+	if (oldNick == newName){
 		return nil
 	}
-	oldNick := conn.nickname;
-	conn.nickname = newName;
+	setNickname(conn, newName);
 
-	AnnounceMsg(server, fmt.Sprintf("%s has changed their name to %s", oldNick, conn.nickname));
+	AnnounceMsg(server, fmt.Sprintf("%s has changed their name to %s", oldNick, newName));
+	sendNicknameChange(server, oldNick, newName);
+	sendMemberList(server);
+	botEvent(server, RoomEvent{Type: RoomNicknameChange, Nickname: oldNick, NewNickname: newName});
 
 	return nil;
 }
 
+// sendNicknameChange tells every client in the room that a client changed its
+// nickname with an MDF packet from the old nickname
+func sendNicknameChange(server *ServerRoom, oldNick string, newNick string){
+	jsonBytes, err := json.Marshal(common.ClientModifcation{NewName: newNick});
+	if (err != nil){
+		server.log.Error("unable to encode MDF packet", "nickname", newNick, "err", err);
+		return;
+	}
+	pkt := common.MsgPacket{
+		PktType: common.PktMDF,
+		Timestamp: uint64(time.Now().Unix()),
+		SendNickname: oldNick,
+	}
+	err = common.EncodeMessage(&pkt, string(jsonBytes));
+	if (err != nil){
+		server.log.Error("unable to encode MDF packet", "nickname", newNick, "err", err);
+		return;
+	}
+	data := make([]byte, common.PktBufferSize);
+	err = common.SerializePacket(&pkt, data);
+	if (err != nil){
+		server.log.Error("unable to serialize MDF packet", "err", err);
+		return;
+	}
+
+	packet := newBroadcast(data);
+	for _, conn := range liveConnections(server){
+		if (!conn.peer){
+			queueBroadcast(server, conn, packet);
+		}
+	}
+}
+
+// sendMemberList sends every client the nicknames of the clients on this
+// server, each with their own nickname filled in
+func sendMemberList(server *ServerRoom){
+	clients := []*serverConnection{};
+	for _, conn := range liveConnections(server){
+		if (!conn.peer){
+			clients = append(clients, conn);
+		}
+	}
+	list := common.MemberList{Members: make([]string, 0, len(clients)), Total: len(clients)};
+	for _, conn := range clients{
+		list.Members = append(list.Members, getNickname(conn));
+	}
+	sort.Strings(list.Members);
+
+	for _, conn := range clients{
+		list.Nickname = getNickname(conn);
+		jsonBytes, err := json.Marshal(list);
+		// Leave out the last members until the list fits in a message
+		for ((err == nil) && (len(jsonBytes) > MessageSizeLimit) && (len(list.Members) > 0)){
+			list.Members = list.Members[:len(list.Members) - 1];
+			jsonBytes, err = json.Marshal(list);
+		}
+		if (err != nil){
+			server.log.Error("unable to encode MEM packet", "err", err);
+			return;
+		}
+
+		pkt := common.MsgPacket{
+			PktType: common.PktMEM,
+		}
+		err = common.EncodeMessage(&pkt, string(jsonBytes));
+		if (err != nil){
+			server.log.Error("unable to encode MEM packet", "err", err);
+			return;
+		}
+		data := make([]byte, common.PktBufferSize);
+		err = common.SerializePacket(&pkt, data);
+		if (err != nil){
+			server.log.Error("unable to serialize MEM packet", "err", err);
+			return;
+		}
+		queuePacket(server, conn, data);
+	}
+}
+
 func handleHandshake(session *ServerRoom,conn *serverConnection, allow bool) (bool, error){
 	var data []byte = make([]byte, common.PktBufferSize);
 
+	cfg := GetConfig(session);
 	var pkt common.MsgPacket;
 	if (allow){
 		pkt = common.MsgPacket{
@@ -60,34 +193,54 @@ func handleHandshake(session *ServerRoom,conn *serverConnection, allow bool) (bo
 			PktType: common.PktREF,
 		}
 	}
-	err := common.SerializePacket(&pkt, data);
+	// Tell the client which compression it can pick from. A full room still
+	// takes links from other servers so REF has it too. Older nodes don't read
+	// the payload so it's in the encoding they use
+	helloRaw, err := json.Marshal(common.ServerHello{Compression: cfg.Compression, Compact: true});
+	if (err != nil){
+		return false, fmt.Errorf("serverHandler.handleHandshake: %s", err);
+	}
+	err = common.EncodeMessageWith(&pkt, string(helloRaw), common.Compression{});
+	if (err != nil){
+		return false, fmt.Errorf("serverHandler.handleHandshake: %s", err);
+	}
+	err = common.SerializePacket(&pkt, data);
 	if (err != nil){
 		return false, fmt.Errorf("serverHandler.handleHandshake: %s", err);
 	}
 
+	// A client that doesn't read the ACP mustn't keep the handshake going
+	// either, so the whole exchange has to finish within the timeout
+	deadline := time.Now().Add(time.Duration(cfg.HandshakeTimeout) * time.Second);
+	conn.client.SetWriteDeadline(deadline);
+	defer conn.client.SetWriteDeadline(time.Time{});
 	_, err = conn.client.Write(data);
 	if (err != nil){
 		if (errors.Is(err, io.EOF)){
-			fmt.Printf("serverHandshake: server closed socket\n");
+			session.log.Debug("client closed socket during handshake", "remote", conn.client.RemoteAddr());
 			return false, nil;
 		}
 		return false, fmt.Errorf("serverHandshake: %s", err);
 	}
 
 	// Then read the ACK packet
-	conn.client.SetReadDeadline(time.Now().Add(4 * time.Second));
-	_, err = conn.client.Read(data);
+	conn.client.SetReadDeadline(deadline);
+	_, err = io.ReadFull(conn.client, data);
 	if (err != nil){
 		if (errors.Is(err, io.EOF)){
-			fmt.Printf("serverHandshake: server closed socket\n");
+			session.log.Debug("client closed socket during handshake", "remote", conn.client.RemoteAddr());
 			return false, nil;
 		}
 		return false, fmt.Errorf("serverHandshake: %s", err);
 	}
 
 	pkt = common.DeserializePacket(data);
+	if (pkt.PktType == common.PktPER){
+		return handlePeerHello(session, conn, &pkt);
+	}
 	if (pkt.PktType != common.PktACK){
-		fmt.Printf("serverHandshake: unrecognised packet type\n");
+		session.log.Warn("unrecognised packet type during handshake", "remote", conn.client.RemoteAddr(),
+			"packet", common.PacketName(pkt.PktType));
 		return false, nil;
 	}
 	// Decode the packet's payload too
@@ -97,47 +250,246 @@ func handleHandshake(session *ServerRoom,conn *serverConnection, allow bool) (bo
 
 	err = json.Unmarshal([]byte(jsonRaw), &clientMod);
 	if (err != nil){
-		fmt.Printf("serverHandshake: unable to unpack ACK packet: %s", err);
+		session.log.Warn("unable to unpack ACK packet", "remote", conn.client.RemoteAddr(), "err", err);
 		return false, fmt.Errorf("serverHandshake: %s", err);
 	}
+	// The client reads compact frames as soon as it's sent the ACK, so even
+	// a kick for the wrong password has to be sent in one
+	conn.compact = clientMod.Compact;
+	password := cfg.Password;
+	if ((password != "") && (clientMod.Password != password)){
+		session.log.Info("client sent an incorrect password", "remote", conn.client.RemoteAddr());
+		sendKick(conn, "incorrect password");
+		return false, nil;
+	}
 	// TODO: Check if the server has already labelled this client
+	conn.compression = agreeCompression(cfg, clientMod.Compression);
 
+	// Whether the name is taken is checked when the client joins, since
+	// other handshakes can finish in the meantime
 	conn.nickname = clientMod.NewName;
-	// Also check if there's a collision in names
-	for _, otherConn := range session.clients{
-		if ((otherConn == nil) || otherConn.dead){
-			continue;
+
+	session.log.Debug("accepted ACK packet", "remote", conn.client.RemoteAddr(), "nickname", conn.nickname,
+		"compression", conn.compression.Method);
+
+	return true, nil;
+}
+
+// handlePeerHello finishes the handshake for a connection that sent PktPER
+// instead of PktACK and marks it as a link to another server
+func handlePeerHello(session *ServerRoom, conn *serverConnection, pkt *common.MsgPacket) (bool, error){
+	jsonRaw, err := common.DecodeMessage(pkt);
+	if (err != nil){
+		return false, fmt.Errorf("serverHandshake: %s", err);
+	}
+	var hello common.PeerHello;
+	err = json.Unmarshal([]byte(strings.Trim(jsonRaw, "\x00")), &hello);
+	if (err != nil){
+		session.log.Warn("unable to unpack PER packet", "remote", conn.client.RemoteAddr(), "err", err);
+		return false, fmt.Errorf("serverHandshake: %s", err);
+	}
+	conn.compact = hello.Compact;
+	if (hello.NodeID == session.nodeID){
+		session.log.Warn("refusing to link to itself", "remote", conn.client.RemoteAddr());
+		return false, nil;
+	}
+	// A link can post as anyone, so only servers that know the mesh's secret
+	// and the room's password are let in
+	cfg := GetConfig(session);
+	if ((cfg.MeshSecret == "") || (subtle.ConstantTimeCompare([]byte(hello.Secret), []byte(cfg.MeshSecret)) != 1)){
+		session.log.Warn("peer sent the wrong mesh secret", "remote", conn.client.RemoteAddr());
+		sendKick(conn, "incorrect mesh secret");
+		return false, nil;
+	}
+	password := cfg.Password;
+	if ((password != "") && (hello.Password != password)){
+		session.log.Warn("peer sent an incorrect password", "remote", conn.client.RemoteAddr());
+		sendKick(conn, "incorrect password");
+		return false, nil;
+	}
+
+	conn.peer = true;
+	conn.nickname = fmt.Sprintf("peer-%016x", hello.NodeID);
+	conn.compression = agreeCompression(cfg, hello.Compression);
+	return true, nil;
+}
+
+// agreeCompression returns the compression for a connection that chose
+// method, or the encoding older nodes use if the config doesn't accept it
+func agreeCompression(cfg ServerConfig, method string) (common.Compression){
+	if (!slices.Contains(cfg.Compression, method)){
+		method = common.CompressionLegacy;
+	}
+	return common.Compression{
+		Method: method,
+		Level: cfg.CompressionLevel,
+		Threshold: cfg.CompressionThreshold,
+	};
+}
+
+// relayMessage delivers the given message to every client on this server and
+// relays it to every linked server other than the one it came from
+func relayMessage(server *ServerRoom, pkt common.MsgPacket, from *serverConnection) (error){
+	// The queues hold onto these until they're written so they can't be reused
+	clientData := make([]byte, common.PktBufferSize);
+	peerData := make([]byte, common.PktBufferSize);
+
+	pkt.PktType = common.PktMSG;
+	err := common.SerializePacket(&pkt, clientData);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.relayMessage: %s", err);
+	}
+	pkt.PktType = common.PktRLY;
+	err = common.SerializePacket(&pkt, peerData);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.relayMessage: %s", err);
+	}
+	addHistory(server, clientData);
+	server.metrics.messagesRelayed.Add(1);
+
+	// Sling it to every other client
+	toClients := newBroadcast(clientData);
+	toPeers := newBroadcast(peerData);
+	for _, conn := range liveConnections(server){
+		if (conn.peer && (conn == from)){continue;}
+
+		packet := toClients;
+		if (conn.peer){
+			packet = toPeers;
 		}
-		if (otherConn.nickname == conn.nickname){
-			conn.nickname = "";
+		queueBroadcast(server, conn, packet);
+	}
+	return nil;
+}
+
+// sendNotice sends an announcement to one client only
+func sendNotice(server *ServerRoom, conn *serverConnection, msg string) (error){
+	pkt := common.MsgPacket{
+		PktType: common.PktANC,
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	err := common.EncodeMessage(&pkt, msg);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendNotice: %s", err);
+	}
+	data := make([]byte, common.PktBufferSize);
+	err = common.SerializePacket(&pkt, data);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendNotice: %s", err);
+	}
+	queuePacket(server, conn, data);
+	return nil;
+}
+
+// sendWhisper passes a direct message from a client on to the client or bot
+// on this server it's addressed to. Whispers aren't relayed to linked servers,
+// so the sender is told if no one here has that nickname or it couldn't be
+// delivered
+func sendWhisper(server *ServerRoom, from *serverConnection, pkt *common.MsgPacket){
+	raw, err := common.DecodeMessage(pkt);
+	if (err != nil){
+		server.log.Warn("unable to decode packet", "remote", from.client.RemoteAddr(),
+			"nickname", getNickname(from), "packet", common.PacketName(pkt.PktType), "err", err);
+		return;
+	}
+	var whisper common.Whisper;
+	err = json.Unmarshal([]byte(strings.TrimRight(raw, "\x00")), &whisper);
+	if (err != nil){
+		server.log.Warn("unable to decode WSP payload", "remote", from.client.RemoteAddr(),
+			"nickname", getNickname(from), "err", err);
+		return;
+	}
+	if (len(whisper.Text) > GetConfig(server).MaxMessageSize){
+		sendNotice(server, from, fmt.Sprintf("Your message to %s is too long", whisper.To));
+		return;
+	}
+
+	if (findBot(server, whisper.To) != nil){
+		botEvent(server, RoomEvent{Type: RoomDirectMessage, Nickname: getNickname(from), To: whisper.To,
+			Text: whisper.Text});
+		return;
+	}
+	err = deliverWhisper(server, getNickname(from), whisper);
+	if (err != nil){
+		sendNotice(server, from, err.Error());
+	}
+}
+
+// deliverWhisper queues a direct message from the nickname from to the client
+// on this server it's addressed to, and returns an error saying why it
+// couldn't be delivered if it can't
+func deliverWhisper(server *ServerRoom, from string, whisper common.Whisper) (error){
+	var target *serverConnection;
+	for _, conn := range liveConnections(server){
+		if (!conn.peer && (getNickname(conn) == whisper.To)){
+			target = conn;
 			break;
 		}
 	}
+	if (target == nil){
+		return fmt.Errorf("No one called %s is on this server", whisper.To);
+	}
 
-	//fmt.Printf("serverHandshake: accepted ACK packet\n");
-
-	return true, nil;
+	raw, err := json.Marshal(whisper);
+	if (err != nil){
+		return fmt.Errorf("Unable to send your message to %s", whisper.To);
+	}
+	out := common.MsgPacket{
+		PktType: common.PktWSP,
+		Timestamp: uint64(time.Now().Unix()),
+		SendNickname: from,
+	}
+	err = common.EncodeMessage(&out, string(raw));
+	if (err != nil){
+		server.log.Error("unable to encode WSP packet", "err", err);
+		return fmt.Errorf("Unable to send your message to %s", whisper.To);
+	}
+	data := make([]byte, common.PktBufferSize);
+	err = common.SerializePacket(&out, data);
+	if (err != nil){
+		server.log.Error("unable to serialize WSP packet", "err", err);
+		return fmt.Errorf("Unable to send your message to %s", whisper.To);
+	}
+	if (!queuePacket(server, target, data)){
+		return fmt.Errorf("Your message to %s was dropped because they're falling behind", whisper.To);
+	}
+	return nil;
 }
 
 func connectionMain(connection *serverConnection, server *ServerRoom) (error){
-	inbound := make(chan bool);
-	var data [common.PktBufferSize]byte;
+	inbound := make(chan *common.MsgPacket);
+	reader := sync.WaitGroup{};
 
 	connection.client.SetReadDeadline(time.Time{});
 
+	reader.Add(1);
 	go func(){
+		defer reader.Done();
+		// Each packet is read into its own buffer so the next read can't
+		// overwrite it while it's being handled
+		var readBuffer [common.PktBufferSize]byte;
 		for {
-			_, err := connection.client.Read(data[:]);
-			//fmt.Printf("connectionMain: Read data from %s\n", connection.client.RemoteAddr());
+			var pkt *common.MsgPacket;
+			err := common.ReadPacket(connection.client, readBuffer[:], connection.compact);
 			if (err != nil){
-				if (!errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed)){
-					fmt.Printf("serverMain: Unable to read from client: %s\n", err);
+				if (!errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !server.stopped.Load()){
+					server.log.Warn("unable to read from client", "remote", connection.client.RemoteAddr(),
+						"nickname", getNickname(connection), "err", err);
 				}
-				inbound <- false;
-				return;
+			} else {
+				deserialized := common.DeserializePacket(readBuffer[:]);
+				pkt = &deserialized;
 			}
 
-			inbound <- true;
+			select {
+			case inbound <- pkt:
+			case <- connection.stopped:{
+				return;
+			}
+			}
+			if (pkt == nil){
+				return;
+			}
 		}
 	}()
 
@@ -147,45 +499,59 @@ func connectionMain(connection *serverConnection, server *ServerRoom) (error){
 	for {
 		if (brk){break;}
 		select {
-		case active := <- inbound:{
-			if (!active){
+		case inboundPKT := <- inbound:{
+			if (inboundPKT == nil){
 				brk = true;
 				continue;
 			}
 
-			//fmt.Printf("serverMain: received packet\n");
-			var readPKT common.MsgPacket = common.DeserializePacket(data[:]);
-			readPKT.SendNickname = connection.nickname;
+			var readPKT common.MsgPacket = *inboundPKT;
+			server.log.Debug("received packet", "remote", connection.client.RemoteAddr(), "nickname", getNickname(connection),
+				"packet", common.PacketName(readPKT.PktType));
 			
 			switch readPKT.PktType{
 			case common.PktMSG:{
-				err := common.SerializePacket(&readPKT, data[:]);
+				if (connection.peer){continue;}
+				readPKT.SendNickname = getNickname(connection);
+
+				msg, err := common.DecodeMessage(&readPKT);
+				if (err != nil){
+					server.log.Warn("unable to decode packet", "remote", connection.client.RemoteAddr(),
+						"nickname", getNickname(connection), "packet", common.PacketName(readPKT.PktType), "err", err);
+					continue;
+				}
+				if (len(strings.TrimRight(msg, "\x00")) > GetConfig(server).MaxMessageSize){
+					// Drop anything over the limit rather than relaying it
+					continue;
+				}
+
+				stampMessage(server, &readPKT);
+				err = relayMessage(server, readPKT, connection);
 				if (err != nil){
-					fmt.Printf("serverMain: unable to seralize MSG pkt: %s\n", err);
-					err = fmt.Errorf("serverMain: %s", err);
 					brk = true;
 					continue;
 				}
-				// Sling it to every other client
-				for _, conn := range server.clients{
-					if ((conn == nil) || conn.dead){continue;}
-					_, err = conn.client.Write(data[:]);
-					if (err != nil){
-						// Kill any closed sockets and continue
-						if (errors.Is(err, io.EOF)){
-							conn.dead = true;
-							conn.client.Close();
-							continue;
-						}
-						fmt.Printf("serverMain: unable to send MSG pkt: %s\n", err);
-						err = fmt.Errorf("serverMain: %s", err);
-						brk = true;
-						continue;
-					}
+				// Only messages from this server's clients go to its bots so
+				// that a command isn't answered by every server in the mesh
+				botEvent(server, RoomEvent{Type: RoomMessage, Nickname: getNickname(connection),
+					Text: strings.TrimRight(msg, "\x00")});
+			}
+			case common.PktRLY:{
+				// Only linked servers can relay messages and anything that's
+				// already been through this server is dropped to stop loops
+				if (!connection.peer || !markSeen(server, &readPKT)){continue;}
+
+				err = relayMessage(server, readPKT, connection);
+				if (err != nil){
+					brk = true;
+					continue;
 				}
 			}
+			case common.PktWSP:{
+				if (connection.peer){continue;}
+				sendWhisper(server, connection, &readPKT);
+			}
 			case common.PktDCN:{
-				//fmt.Printf("%s disconnected\n", connection.client.LocalAddr().String());
 				brk = true;
 				continue;
 			}
@@ -193,7 +559,8 @@ func connectionMain(connection *serverConnection, server *ServerRoom) (error){
 				// Decode the message
 				jsonRaw, err := common.DecodeMessage(&readPKT);
 				if (err != nil){
-					fmt.Printf("serverHandler.connectionMain: Unable to decode PktMDF packet: %s", err);
+					server.log.Warn("unable to decode packet", "remote", connection.client.RemoteAddr(),
+						"nickname", getNickname(connection), "packet", common.PacketName(readPKT.PktType), "err", err);
 					err = fmt.Errorf("serverHandler.conncetionMain: %s", err);
 					brk = true;
 					continue;
@@ -204,7 +571,8 @@ func connectionMain(connection *serverConnection, server *ServerRoom) (error){
 				var jsonPkt common.ClientModifcation;
 				err = json.Unmarshal(asBytes, &jsonPkt);
 				if (err != nil){
-					fmt.Printf("serverHandler.connectionMain: Unable to decode PktMDF payload: %s", err);
+					server.log.Warn("unable to decode MDF payload", "remote", connection.client.RemoteAddr(),
+						"nickname", getNickname(connection), "err", err);
 					err = fmt.Errorf("serverHandler.conncetionMain: %s", err);
 					brk = true;
 					continue;
@@ -216,7 +584,12 @@ func connectionMain(connection *serverConnection, server *ServerRoom) (error){
 		}
 		case CurrentIns := <- connection.instructions:{
 			if (CurrentIns == ServerStop) {
-				fmt.Printf("Shutting down connection\n");
+				server.log.Debug("shutting down connection", "remote", connection.client.RemoteAddr(),
+					"nickname", getNickname(connection));
+				brk = true;
+				continue;
+			}
+			if (CurrentIns == ClientOverflow){
 				brk = true;
 				continue;
 			}
@@ -224,11 +597,28 @@ func connectionMain(connection *serverConnection, server *ServerRoom) (error){
 		}
 	}
 
-	AnnounceMsg(server, fmt.Sprintf("%s disconnected from the room", connection.nickname));
-	connection.dead = true;
-	connection.client.Close();
+	// Mark it dead first so nothing else is queued, then let the writer finish
+	// what's already queued before the socket is closed
+	connection.dead.Store(true);
+	stopWriter(connection);
+	close(connection.stopped);
+	reader.Wait();
+	if (connection.peer){
+		server.metrics.linkedPeers.Add(-1);
+		if (connection.peerAddr != ""){
+			unlinkPeer(server, connection.peerAddr);
+		}
+	} else {
+		server.metrics.connectedClients.Add(-1);
+		// Everyone is leaving when the server shuts down so there's no one to tell
+		if (!server.stopped.Load()){
+			AnnounceMsg(server, fmt.Sprintf("%s disconnected from the room", getNickname(connection)));
+			sendMemberList(server);
+			botEvent(server, RoomEvent{Type: RoomLeave, Nickname: getNickname(connection)});
+		}
+	}
 	server.childThreads.Done();
-	fmt.Printf("connectionHandler done\n");
+	server.log.Debug("connection closed", "remote", connection.client.RemoteAddr(), "nickname", getNickname(connection));
 	return err;
 }
 
@@ -236,116 +626,277 @@ func connectionMain(connection *serverConnection, server *ServerRoom) (error){
 // connectionMain to serve it
 func serverMain(server *ServerRoom){
 	defer server.mainThread.Done();
-	
-	inbound := make(chan net.Conn);
 
 	subThreads := sync.WaitGroup{};
 
-	subThreads.Add(1);
-	go func(){
-		defer subThreads.Done();
+	// Accept on every listener, only no longer accepting once they've all closed
+	var accepting atomic.Int32;
+	accepting.Store(int32(len(server.sockets)));
+	server.metrics.accepting.Store(true);
+	for _, socket := range server.sockets{
+		subThreads.Add(1);
+		go func(socket net.Listener){
+			defer subThreads.Done();
+			defer func(){
+				if (accepting.Add(-1) == 0){
+					server.metrics.accepting.Store(false);
+				}
+			}();
 
-		for {
-			var conn net.Conn;
-			conn, err := server.socket.Accept();
-			if (err != nil){
-				if !(errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)){
-					fmt.Printf("serverMain: unable to accept connection: %s\n",err);
+			for {
+				var conn net.Conn;
+				conn, err := socket.Accept();
+				if (err != nil){
+					if !(errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)){
+						server.log.Error("unable to accept connection", "addr", socket.Addr(), "err", err);
+					}
+					break;
 				}
-				break;
-			}
 
-			inbound <- conn;
-		}
-	}()
+				select {
+				case server.inbound <- conn:
+				case <- server.stop:{
+					conn.Close();
+					return;
+				}
+				}
+			}
+		}(socket);
+	}
 
 	brk := false;
 	for {
 		if (brk) {break;}
 		select {
-		case newConnection := <- inbound:{
-			createConnection(&serv, newConnection);
+		case newConnection := <- server.inbound:{
+			// A client that never answers mustn't hold up everyone else, so
+			// each handshake runs on its own and only joining is serialised
+			server.handshakes.Add(1);
+			go func(){
+				defer server.handshakes.Done();
+				createConnection(server, newConnection);
+			}();
+		}
+		case link := <- server.peerLinks:{
+			link.client = &countingConn{Conn: link.client, metrics: &server.metrics};
+			insertConnection(server, link);
+			startWriter(server, link);
+			server.metrics.linkedPeers.Add(1);
+			server.log.Info("linked to peer", "peer", link.peerAddr);
+			server.childThreads.Add(1);
+			go connectionMain(link, server);
 		}
 		case currentInstruction := <- server.instructions:{
+			// Shutdown closes the connections once nothing new can be added
 			if (currentInstruction == ServerStop){
-				// Close any non-dead connections
-				for _, conn := range serv.clients{
-					if ((conn == nil) || conn.dead){
-						continue;
-					}
-					conn.instructions <- ServerStop;
-				}
 				brk = true;
 				continue;
 			}
 		}
 		}
 	}
-	serv.socket.Close();
-	serv.childThreads.Wait();
-
+	closeSockets(server);
 	subThreads.Wait();
 }
 
 //
 func createConnection(server *ServerRoom, inboundConnection net.Conn) (error){
-	newConn := serverConnection{
-		client: inboundConnection,
-		instructions: make(chan int8, 1),
-		dead: false,
-	}
-	
-	var accept bool;
-	var index int16 = -1;
-	// Manually count the connections since we need to account for dead connections
-	{
-		count := 0;
-		for ind, val := range server.clients {
-			if (val.dead){
-				index = int16(ind);
-				// We don't need to go further because we've already found
-				// a slot to place the connection into
-				break;
-			} else {
-				count ++;
-			}
-		}
-		if (count < int(serv.maxClients)){
-			accept = true;
-		} else {
-			accept = false;
-		}
-	}
-
-	//fmt.Printf("serverHandler: beginning handshake with %s\n", newConn.client.RemoteAddr());
-	result, err := handleHandshake(server, &newConn, accept);
+	newConn := newServerConnection(&countingConn{Conn: inboundConnection, metrics: &server.metrics}, GetConfig(server));
+	// Shutdown closes the connection if the handshake outlasts its deadline
+	server.joinLock.Lock();
+	server.handshaking[newConn] = true;
+	server.joinLock.Unlock();
+	defer func(){
+		server.joinLock.Lock();
+		delete(server.handshaking, newConn);
+		server.joinLock.Unlock();
+	}();
+
+	// Links to other servers don't count towards the limit, but it isn't known
+	// whether this is one until it answers the ACP or REF, so a full room
+	// still reads the answer and only turns away clients
+	accept := (countClients(server) < int(GetConfig(server).MaxClients));
+
+	server.log.Debug("beginning handshake", "remote", newConn.client.RemoteAddr());
+	result, err := handleHandshake(server, newConn, accept);
 	if (err != nil){
+		server.metrics.handshakesRefused.Add(1);
+		newConn.client.Close();
 		return fmt.Errorf("createConnection: %s", err);
 	}
 	if (!result){
-		fmt.Printf("serverHandler: Could not finish handshake\n");
+		server.metrics.handshakesRefused.Add(1);
+		server.log.Info("could not finish handshake", "remote", newConn.client.RemoteAddr());
+		newConn.client.Close();
+		return nil;
+	}
+	if (!accept && !newConn.peer){
+		// The client was told it was refused so don't keep the connection
+		server.metrics.handshakesRefused.Add(1);
+		newConn.client.Close();
 		return nil;
 	}
-	//fmt.Printf("serverHandler: completed handshake with %s\n", newConn.client.RemoteAddr());
 
-	if (index != -1){
-		server.clients[index] = &newConn;
-	} else {
-		// Otherwise append it onto the server
-		server.clients = append(server.clients, &newConn);
-		// reuse index here for assigning guest nicknames
-		index = int16(len(server.clients));
+	if (!newConn.peer){
+		// The writer hasn't started yet so the welcome is written straight to
+		// the socket, ahead of anything else the room sends
+		err = sendWelcome(server, newConn);
+		if (err != nil){
+			server.log.Info("unable to welcome client", "remote", newConn.client.RemoteAddr(), "err", err);
+			newConn.client.Close();
+			return fmt.Errorf("createConnection: %s", err);
+		}
 	}
 
+	reason := joinRoom(server, newConn);
+	if (reason != ""){
+		server.metrics.handshakesRefused.Add(1);
+		server.log.Info("turned away client after its handshake", "remote", newConn.client.RemoteAddr(), "reason", reason);
+		newConn.client.SetWriteDeadline(time.Now().Add(time.Duration(GetConfig(server).HandshakeTimeout) * time.Second));
+		sendKick(newConn, reason);
+		newConn.client.Close();
+	}
+	return nil;
+}
+
+// joinRoom adds a connection that's finished its handshake to the room and
+// starts serving it. Handshakes run at the same time, so joining is
+// serialised and whether the room is full or the nickname is taken is checked
+// again here. Returns why the connection was turned away, or blank if it joined
+func joinRoom(server *ServerRoom, newConn *serverConnection) (string){
+	server.joinLock.Lock();
+	defer server.joinLock.Unlock();
+
+	// Shutdown only tells the connections that joined before it started
+	if (server.stopped.Load()){
+		return "server shutdown";
+	}
+	if (!newConn.peer){
+		if (countClients(server) >= int(GetConfig(server).MaxClients)){
+			return "room is full";
+		}
+		for _, otherConn := range liveConnections(server){
+			if (!otherConn.peer && (getNickname(otherConn) == newConn.nickname)){
+				newConn.nickname = "";
+				break;
+			}
+		}
+	}
+	server.metrics.handshakesAccepted.Add(1);
+	server.log.Debug("completed handshake", "remote", newConn.client.RemoteAddr(), "nickname", newConn.nickname);
+
+	// Other goroutines can read the nickname once it's inserted
+	nickname := newConn.nickname;
+	index := insertConnection(server, newConn);
+	startWriter(server, newConn);
+	if (newConn.peer){
+		server.metrics.linkedPeers.Add(1);
+		server.childThreads.Add(1);
+		go connectionMain(newConn, server);
+		return "";
+	}
+	server.metrics.connectedClients.Add(1);
+
 	// Assign the client a temp nickname
-	if (newConn.nickname == ""){
-		newConn.nickname = fmt.Sprintf("guest%d", index);
+	if (nickname == ""){
+		nickname = fmt.Sprintf("guest%d", index);
+		setNickname(newConn, nickname);
 	}
-	AnnounceMsg(server, fmt.Sprintf("%s has joined the room", newConn.nickname));	
+	AnnounceMsg(server, fmt.Sprintf("%s has joined the room", nickname));	
+	sendMemberList(server);
+	botEvent(server, RoomEvent{Type: RoomJoin, Nickname: nickname});
 
 	// And fork a new connectionHandler to serve it
 	server.childThreads.Add(1);
-	go connectionMain(&newConn, server);
+	go connectionMain(newConn, server);
+
+	return "";
+}
+
+// insertConnection adds the given connection to the server's client list,
+// reusing the slot of a dead connection if there is one, and returns the slot
+// number used for guest nicknames
+func insertConnection(server *ServerRoom, conn *serverConnection) (int16){
+	server.clientsLock.Lock();
+	defer server.clientsLock.Unlock();
+
+	for ind, val := range server.clients{
+		if (val.dead.Load()){
+			server.clients[ind] = conn;
+			return int16(ind);
+		}
+	}
+	server.clients = append(server.clients, conn);
+	return int16(len(server.clients));
+}
 
+// addHistory stores a copy of the given serialized MSG packet so that it can be
+// replayed to clients that join later. Only the most recent HistoryDepth
+// packets are kept
+func addHistory(server *ServerRoom, pkt []byte){
+	depth := GetConfig(server).HistoryDepth;
+
+	server.historyLock.Lock();
+	defer server.historyLock.Unlock();
+
+	if (depth == 0){
+		server.history = server.history[:0];
+		return;
+	}
+	server.history = append(server.history, append([]byte(nil), pkt...));
+	if (len(server.history) > depth){
+		server.history = server.history[len(server.history) - depth:];
+	}
+}
+
+// sendWelcome replays the room's recent history and the MOTD to a client that
+// has just joined, before its writer has started
+func sendWelcome(server *ServerRoom, conn *serverConnection) (error){
+	cfg := GetConfig(server);
+	conn.client.SetWriteDeadline(time.Now().Add(time.Duration(cfg.HandshakeTimeout) * time.Second));
+	defer conn.client.SetWriteDeadline(time.Time{});
+
+	server.historyLock.Lock();
+	history := append([][]byte(nil), server.history...);
+	server.historyLock.Unlock();
+
+	if (len(history) > cfg.HistoryDepth){
+		history = history[len(history) - cfg.HistoryDepth:];
+	}
+	for _, pkt := range history{
+		pkt, err := common.CompressPacket(pkt, conn.compression);
+		if (err != nil){
+			return fmt.Errorf("serverHandler.sendWelcome: %s", err);
+		}
+		err = common.WritePacket(conn.client, pkt, conn.compact);
+		if (err != nil){
+			return fmt.Errorf("serverHandler.sendWelcome: %s", err);
+		}
+	}
+
+	if (cfg.MOTD == ""){
+		return nil;
+	}
+
+	pkt := common.MsgPacket{
+		PktType: common.PktANC,
+	}
+	err := common.EncodeMessage(&pkt, cfg.MOTD);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendWelcome: %s", err);
+	}
+	data := make([]byte, common.PktBufferSize);
+	err = common.SerializePacket(&pkt, data);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendWelcome: %s", err);
+	}
+	data, err = common.CompressPacket(data, conn.compression);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendWelcome: %s", err);
+	}
+	err = common.WritePacket(conn.client, data, conn.compact);
+	if (err != nil){
+		return fmt.Errorf("serverHandler.sendWelcome: %s", err);
+	}
 	return nil;
-}
\ No newline at end of file
+}
@@ -1,43 +1,140 @@
 package server
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"io"
 	"net"
+	"log/slog"
+	"net/http"
+	"os"
 	"p2psystem/common"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // The server struct keeps track of which clients are connected to it
 type ServerRoom struct {
-	socket net.Listener;
+	sockets []net.Listener;			// One for every address in the config's Listen
+	gateway *http.Server;			// Serves browsers if the WebSocket gateway is enabled
+	metricsEndpoint *http.Server;	// Serves metrics if the endpoint is enabled
+	metrics serverMetrics;
+	log *slog.Logger;				// Diagnostics go here and never to stdout
+	logLevel *slog.LevelVar;		// Set from the config's LogLevel if not nil
+	inbound chan net.Conn;			// New connections waiting for a handshake
 	instructions chan uint8;
 	clients []*serverConnection;
-	maxClients uint8;
+	history [][]byte;				// The most recent serialized MSG packets
+	historyLock sync.Mutex;
+	config ServerConfig;
+	configLock sync.RWMutex;
+	clientsLock sync.RWMutex;		// Held while clients is read or changed
+
+	nodeID uint64;					// Identifies this server in the mesh
+	sequence atomic.Uint64;			// Counter for messages originating here
+	peerLinks chan *serverConnection;	// Outbound links waiting to be added
+	linkedPeers map[string]bool;	// Addresses of peers with an outbound link
+	seen map[messageID]bool;		// Messages that have already been relayed
+	seenOrder []messageID;
+	meshLock sync.Mutex;
+
+	bots []Bot;						// Set when the server is created and never changed
+	botEvents chan RoomEvent;		// Events waiting to be handled by the bots
+
+	configPath string;				// Reloaded on SIGHUP if it isn't blank
+	stop chan bool;					// Closed to stop the background goroutines
+	stopped atomic.Bool;
+	listenOverride ListenAddrs;		// Replaces the Listen value of any config loaded
 	mainThread sync.WaitGroup;		// Tracks the goroutine running serverMain
+	handshakes sync.WaitGroup;		// Tracks the goroutines running a handshake
+	joinLock sync.Mutex;			// Held while a connection that's finished its handshake joins the room
+	handshaking map[*serverConnection]bool;	// Connections part way through a handshake, guarded by joinLock
+	background sync.WaitGroup;		// Tracks the goroutines that run until stop is closed
 	childThreads sync.WaitGroup;	// Tracks the goroutines running connectionMain
 }
 
 const (
-	// InitialMaxClients is the initial max clients each ServerRoom is set to
+	// InitialMaxClients is the max clients a ServerRoom uses if its config doesn't set it
 	InitialMaxClients = 10;
-	// ConnType is the protocol to use when creating new sockets
-	ConnType = "tcp";
 	// ServerStop indicates the server should stop listening for new connections and closes all existing ones
 	ServerStop = 127; 
+	// ClientOverflow indicates a connection fell too far behind and is being dropped
+	ClientOverflow = 126;
+	// ShutdownTimeout is how long Stop waits for connections to finish before closing them
+	ShutdownTimeout = 5 * time.Second;
 )
 
-// For now we're just keeping it as one client has one server
-var serv ServerRoom = ServerRoom{
-	socket: nil,
-	maxClients: InitialMaxClients,
-	instructions: make(chan uint8, 1),
-	clients: make([]*serverConnection, 0, InitialMaxClients),
+// ServerOptions are the settings a ServerRoom is created with
+type ServerOptions struct{
+	// ConfigPath is the config file the server loads. Sending the process
+	// SIGHUP reloads it. If it's blank Config is used instead
+	ConfigPath string;
+	// Config is used when ConfigPath is blank. If it's nil the server runs
+	// with DefaultServerConfig
+	Config *ServerConfig;
+	// Listen is used instead of the config's Listen value if it isn't empty
+	Listen ListenAddrs;
+	// Logger receives the server's diagnostics. If it's nil they're written
+	// to stderr
+	Logger *slog.Logger;
+	// LogLevel is changed to the LogLevel of any config loaded if it isn't nil
+	LogLevel *slog.LevelVar;
+	// Bots are told about everything that happens in the room. The built in
+	// !help is always added
+	Bots []Bot;
+}
 
-	mainThread: sync.WaitGroup{},
-	childThreads: sync.WaitGroup{},
-};
+// New loads the config described by options and returns a server that's
+// ready to be started. Every server is independent so any number of them can
+// run in the same process as long as they listen on different addresses
+func New(options ServerOptions) (*ServerRoom, error){
+	cfg := DefaultServerConfig();
+	var err error;
+	if (options.ConfigPath != ""){
+		cfg, err = ReadServerConfig(options.ConfigPath);
+		if (err != nil){
+			return nil, fmt.Errorf("serverMain: %s", err);
+		}
+	} else if (options.Config != nil){
+		cfg = *options.Config;
+	}
+	if (len(options.Listen) > 0){
+		cfg.Listen = options.Listen;
+	}
+	err = cfg.Validate();
+	if (err != nil){
+		return nil, fmt.Errorf("serverMain: %s", err);
+	}
+
+	logger := options.Logger;
+	if (logger == nil){
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil));
+	}
+	nodeID, err := newNodeID();
+	if (err != nil){
+		return nil, fmt.Errorf("serverMain: %s", err);
+	}
+
+	server := &ServerRoom{
+		config: cfg,
+		configPath: options.ConfigPath,
+		listenOverride: options.Listen,
+		instructions: make(chan uint8, 1),
+		clients: make([]*serverConnection, 0, cfg.MaxClients),
+		inbound: make(chan net.Conn),
+		log: logger,
+		logLevel: options.LogLevel,
+		nodeID: nodeID,
+		peerLinks: make(chan *serverConnection),
+		linkedPeers: map[string]bool{},
+		seen: map[messageID]bool{},
+		handshaking: map[*serverConnection]bool{},
+		bots: append([]Bot{helpBot{}}, options.Bots...),
+		botEvents: make(chan RoomEvent, BotEventQueueSize),
+	};
+	applyLogLevel(server, cfg);
+	return server, nil;
+}
 
 // AnnounceMsg sends an ANC packet to all connected clients with the given message
 func AnnounceMsg(server *ServerRoom, msg string) (error){
@@ -46,74 +143,248 @@ func AnnounceMsg(server *ServerRoom, msg string) (error){
 	}
 	err := common.EncodeMessage(&pkt, msg);
 	if (err != nil){
-		fmt.Printf("AnnounceMsg: Unable to encode message: %s\n", err);
+		server.log.Error("unable to encode announcement", "err", err);
 		return fmt.Errorf("AnnounceMsg: %s", err);
 	}
 
 	var dataBuffer []byte = make([]byte, common.PktBufferSize);
 	err = common.SerializePacket(&pkt, dataBuffer);
 	if (err != nil){
-		fmt.Printf("AnnounceMsg: Unable to serialize message: %s\n", err);
+		server.log.Error("unable to serialize announcement", "err", err);
 		return fmt.Errorf("AnnounceMsg: %s", err);
 	}
 
-	for ind, conn := range server.clients{
-		if ((conn == nil) || conn.dead){
+	packet := newBroadcast(dataBuffer);
+	for _, conn := range liveConnections(server){
+		// Announcements stay within this server
+		if (conn.peer){
 			continue;
 		}
-
-		_, err = conn.client.Write(dataBuffer);
-		if (err != nil){
-			if (errors.Is(err, io.EOF)){
-				server.clients[ind].dead = true;
-				server.clients[ind].client.Close();
-				continue;
-			}
-			fmt.Printf("AnnounceMsg: Unable to send announcment to client at index %d: %s\n", ind, err);
-			return fmt.Errorf("AnnounceMsg: %s", err);
-		}
+		queueBroadcast(server, conn, packet);
 	}
+	server.metrics.announcementsSent.Add(1);
 	return nil;
 }
 
-// GetServerRoom returns the given server room
-func GetServerRoom()(*ServerRoom){
-	return &serv;
+// SetLogger replaces the logger the server writes its diagnostics to. If
+// level isn't nil it's changed to the LogLevel of any config the server loads
+func SetLogger(server *ServerRoom, logger *slog.Logger, level *slog.LevelVar){
+	server.log = logger;
+	server.logLevel = level;
+}
+
+// ShutdownSummary describes what happened to the connections when a server
+// was shut down
+type ShutdownSummary struct{
+	Notified int;		// Clients that were sent the shutdown notice
+	NotifyFailed int;	// Clients the notice couldn't be sent to
+	Peers int;			// Links to other servers that were closed
+	Drained int;		// Connections that finished on their own before the deadline
+	ForceClosed int;	// Connections, including ones still in their handshake, closed when the deadline passed
+	Duration time.Duration;
 }
 
-// Shutdown will close the given serverRoom and disconnect the connected clients
-func Shutdown(server *ServerRoom) (error){
+// Shutdown stops accepting connections, sends every client a kick notice and
+// waits for the connections to finish what they're sending until ctx is done,
+// after which any that are left, including ones still in their handshake,
+// are closed. Returns once every goroutine the
+// server started has exited. A server that's been shut down can't be started
+// again
+func Shutdown(server *ServerRoom, ctx context.Context) (ShutdownSummary, error){
+	summary := ShutdownSummary{};
+	if ((server.stop == nil) || server.stopped.Swap(true)){
+		return summary, nil;
+	}
+	started := time.Now();
+
 	// Prepare a packet
 	pkt := common.MsgPacket{
 		PktType: common.PktKCK,
+		Timestamp: uint64(started.Unix()),
 	}
 	data := make([]byte, common.PktBufferSize);
 
 	err := common.EncodeMessage(&pkt, "server shutdown");
-	err = common.SerializePacket(&pkt, data);
+	if (err == nil){
+		err = common.SerializePacket(&pkt, data);
+	}
 	if (err != nil){
-		fmt.Printf("serverMain.Shutdown: unable to send packet to clients: %s", err);
-		return fmt.Errorf("serverMain.Shutdown: %s", err);
+		server.log.Error("unable to prepare shutdown packet", "err", err);
+		data = nil;
 	}
-	server.instructions <- uint8(ServerStop);
 
+	// Stop everything that could add a new connection first
+	close(server.stop);
+	closeSockets(server);
+	if (server.gateway != nil){
+		server.gateway.Shutdown(ctx);
+		server.gateway.Close();
+	}
+	if (server.metricsEndpoint != nil){
+		server.metricsEndpoint.Shutdown(ctx);
+		server.metricsEndpoint.Close();
+	}
+	server.instructions <- uint8(ServerStop);
 	server.mainThread.Wait();
+	// Wait for any connection part way through joining. Ones that finish
+	// their handshake after this are turned away, so live is everyone
+	server.joinLock.Lock();
+	server.joinLock.Unlock();
 
-	return nil;
+	// Then tell every connection to finish up
+	live := liveConnections(server);
+	notice := newBroadcast(data);
+	for _, conn := range live{
+		if (conn.peer){
+			summary.Peers ++;
+		} else if (data != nil){
+			if (queueBroadcast(server, conn, notice)){
+				summary.Notified ++;
+			} else {
+				summary.NotifyFailed ++;
+			}
+		}
+		select {
+		case conn.instructions <- ServerStop:
+		default:
+		}
+	}
+	total := len(live);
+
+	drained := make(chan bool);
+	go func(){
+		server.handshakes.Wait();
+		server.childThreads.Wait();
+		close(drained);
+	}();
+	abandoned := 0;
+	select {
+	case <- drained:
+	case <- ctx.Done():{
+		for _, conn := range live{
+			select {
+			case <- conn.stopped:
+			default:{
+				summary.ForceClosed ++;
+				conn.client.Close();
+			}
+			}
+		}
+		server.joinLock.Lock();
+		for conn := range server.handshaking{
+			abandoned ++;
+			conn.client.Close();
+		}
+		server.joinLock.Unlock();
+		server.log.Warn("closed connections that didn't finish before the deadline", "count", summary.ForceClosed,
+			"handshaking", abandoned);
+		<- drained;
+	}
+	}
+	summary.Drained = total - summary.ForceClosed;
+	summary.ForceClosed += abandoned;
+	server.background.Wait();
+
+	summary.Duration = time.Since(started);
+	server.log.Info("server shut down", "notified", summary.Notified, "peers", summary.Peers,
+		"drained", summary.Drained, "force_closed", summary.ForceClosed, "duration", summary.Duration);
+	return summary, nil;
 }
 
-func Init(IP string, port int16) (error){
-	fmt.Print("serverMain: Initialised server component\n");
+// Stop shuts the server down, giving connections ShutdownTimeout to finish
+func Stop(server *ServerRoom) (error){
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout);
+	defer cancel();
+	_, err := Shutdown(server, ctx);
+	return err;
+}
 
-	connection, err := net.Listen(ConnType, ":9002"); // TODO: replace with value
-	if (err != nil){
-		return fmt.Errorf("serverMain: %s", err);
+// BoundAddrs returns the addresses the server is actually listening on, with
+// any port 0 replaced by the port that was picked
+func BoundAddrs(server *ServerRoom) ([]string){
+	addrs := make([]string, 0, len(server.sockets));
+	for _, socket := range server.sockets{
+		addrs = append(addrs, common.FormatAddress(socket.Addr()));
+	}
+	return addrs;
+}
+
+// closeSockets closes every listener the server has bound
+func closeSockets(server *ServerRoom){
+	for _, socket := range server.sockets{
+		socket.Close();
 	}
+}
 
-	serv.socket = connection;
+// Start binds every address in the server's Listen config and starts
+// accepting clients. Returns the addresses that were bound
+func Start(server *ServerRoom) ([]string, error){
+	if (server.stop != nil){
+		return nil, fmt.Errorf("serverMain.Start: the server has already been started");
+	}
+	cfg := GetConfig(server);
 
-	serv.mainThread.Add(1);
-	go serverMain(&serv);
-	return nil;
-	
-}
\ No newline at end of file
+	server.sockets = make([]net.Listener, 0, len(cfg.Listen));
+	for _, addr := range cfg.Listen{
+		transport, listenAddr, err := common.ResolveAddress(addr);
+		if (err != nil){
+			closeSockets(server);
+			return nil, fmt.Errorf("serverMain.Start: %s", err);
+		}
+		socket, err := transport.Listen(listenAddr);
+		if (err != nil){
+			closeSockets(server);
+			return nil, fmt.Errorf("serverMain.Start: %s", err);
+		}
+		server.sockets = append(server.sockets, socket);
+	}
+
+	var err error;
+	if (cfg.MetricsListen != ""){
+		server.metricsEndpoint, err = startMetrics(server, cfg.MetricsListen);
+		if (err != nil){
+			closeSockets(server);
+			return nil, fmt.Errorf("serverMain.Start: %s", err);
+		}
+		server.log.Info("serving metrics", "addr", cfg.MetricsListen);
+	}
+	if (cfg.WebSocketListen != ""){
+		server.gateway, err = startGateway(server, cfg.WebSocketListen);
+		if (err != nil){
+			closeSockets(server);
+			if (server.metricsEndpoint != nil){
+				server.metricsEndpoint.Close();
+			}
+			return nil, fmt.Errorf("serverMain.Start: %s", err);
+		}
+		server.log.Info("serving browsers", "addr", cfg.WebSocketListen);
+	}
+	server.stop = make(chan bool);
+	if (server.configPath != ""){
+		server.background.Add(1);
+		go func(){
+			defer server.background.Done();
+			watchReload(server, server.configPath, server.stop);
+		}();
+	}
+	server.background.Add(3);
+	go func(){
+		defer server.background.Done();
+		maintainPeers(server, server.stop);
+	}();
+	go func(){
+		defer server.background.Done();
+		advertise(server, server.stop);
+	}();
+	go func(){
+		defer server.background.Done();
+		runBots(server, server.stop);
+	}();
+
+	server.mainThread.Add(1);
+	go serverMain(server);
+
+	bound := BoundAddrs(server);
+	server.log.Info("initialised server component", "addrs", bound);
+	return bound, nil;
+}
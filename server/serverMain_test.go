@@ -0,0 +1,547 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"p2psystem/common"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTimeout is how long a test waits for something to arrive before failing
+const testTimeout = 5 * time.Second;
+
+// testClient is a raw connection to a room that speaks the protocol itself so
+// tests can control exactly when packets are read
+type testClient struct{
+	conn net.Conn;
+	packets chan common.MsgPacket;	// Filled once readPackets is called
+}
+
+// startRoom starts a server with cfg listening on a mem:// address named
+// after the test and returns it with the address. It's shut down when the
+// test finishes if the test hasn't already
+func startRoom(t *testing.T, name string, cfg ServerConfig) (*ServerRoom, string){
+	t.Helper();
+	addr := "mem://" + t.Name() + "/" + name;
+	server, err := New(ServerOptions{
+		Config: &cfg,
+		Listen: ListenAddrs{addr},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	});
+	if (err != nil){
+		t.Fatalf("unable to create server: %s", err);
+	}
+	_, err = Start(server);
+	if (err != nil){
+		t.Fatalf("unable to start server: %s", err);
+	}
+	t.Cleanup(func(){
+		Stop(server);
+	});
+	return server, addr;
+}
+
+// dialRoom joins the room at addr as nickname. Nothing is read from the room
+// until readPackets is called
+func dialRoom(t *testing.T, addr string, nickname string) (*testClient){
+	t.Helper();
+	transport, dialAddr, err := common.ResolveAddress(addr);
+	if (err != nil){
+		t.Fatalf("unable to resolve %s: %s", addr, err);
+	}
+	conn, err := transport.Dial(dialAddr, testTimeout);
+	if (err != nil){
+		t.Fatalf("unable to dial %s: %s", addr, err);
+	}
+	t.Cleanup(func(){
+		conn.Close();
+	});
+
+	data := make([]byte, common.PktBufferSize);
+	conn.SetReadDeadline(time.Now().Add(testTimeout));
+	_, err = io.ReadFull(conn, data);
+	if (err != nil){
+		t.Fatalf("unable to read ACP: %s", err);
+	}
+	conn.SetReadDeadline(time.Time{});
+	pkt := common.DeserializePacket(data);
+	if (pkt.PktType != common.PktACP){
+		t.Fatalf("expected ACP, got %s", common.PacketName(pkt.PktType));
+	}
+
+	ackRaw, err := json.Marshal(common.ClientModifcation{NewName: nickname, Compression: common.CompressionNone});
+	if (err != nil){
+		t.Fatalf("unable to encode ACK: %s", err);
+	}
+	pkt = common.MsgPacket{
+		PktType: common.PktACK,
+	}
+	err = common.EncodeMessageWith(&pkt, string(ackRaw), common.Compression{});
+	if (err != nil){
+		t.Fatalf("unable to encode ACK: %s", err);
+	}
+	writePacket(t, conn, &pkt);
+	return &testClient{conn: conn, packets: make(chan common.MsgPacket, 4096)};
+}
+
+// readPackets starts reading everything the room sends to client into its
+// packets channel, which is closed once the connection is
+func readPackets(client *testClient){
+	go func(){
+		defer close(client.packets);
+		data := make([]byte, common.PktBufferSize);
+		for {
+			_, err := io.ReadFull(client.conn, data);
+			if (err != nil){
+				return;
+			}
+			client.packets <- common.DeserializePacket(data);
+		}
+	}();
+}
+
+// writePacket serializes pkt and writes it to conn
+func writePacket(t *testing.T, conn net.Conn, pkt *common.MsgPacket){
+	t.Helper();
+	data := make([]byte, common.PktBufferSize);
+	err := common.SerializePacket(pkt, data);
+	if (err != nil){
+		t.Fatalf("unable to serialize %s: %s", common.PacketName(pkt.PktType), err);
+	}
+	_, err = conn.Write(data);
+	if (err != nil){
+		t.Fatalf("unable to write %s: %s", common.PacketName(pkt.PktType), err);
+	}
+}
+
+// chatPacket returns a serialized chat message containing text
+func chatPacket(t *testing.T, text string) ([]byte){
+	t.Helper();
+	pkt := common.MsgPacket{
+		PktType: common.PktMSG,
+	}
+	err := common.EncodeMessage(&pkt, text);
+	if (err != nil){
+		t.Fatalf("unable to encode message: %s", err);
+	}
+	data := make([]byte, common.PktBufferSize);
+	err = common.SerializePacket(&pkt, data);
+	if (err != nil){
+		t.Fatalf("unable to serialize message: %s", err);
+	}
+	return data;
+}
+
+// sendChat sends text to the room as a chat message
+func sendChat(t *testing.T, client *testClient, text string){
+	t.Helper();
+	_, err := client.conn.Write(chatPacket(t, text));
+	if (err != nil){
+		t.Fatalf("unable to send message: %s", err);
+	}
+}
+
+// sendBurst sends every message in burst from its own goroutine per client,
+// so the room gets them all at once. It returns once they've all been written
+func sendBurst(t *testing.T, clients []*testClient, burst [][][]byte){
+	t.Helper();
+	errs := make(chan error, len(clients));
+	for i, client := range clients{
+		go func(){
+			for _, data := range burst[i]{
+				_, err := client.conn.Write(data);
+				if (err != nil){
+					errs <- err;
+					return;
+				}
+			}
+			errs <- nil;
+		}();
+	}
+	for range clients{
+		err := <- errs;
+		if (err != nil){
+			t.Fatalf("unable to send message: %s", err);
+		}
+	}
+}
+
+// waitForChat returns the next count chat messages sent to client, skipping
+// anything else
+func waitForChat(t *testing.T, client *testClient, count int) ([]string){
+	t.Helper();
+	chat := []string{};
+	timeout := time.After(testTimeout);
+	for (len(chat) < count){
+		select {
+		case pkt, open := <- client.packets:{
+			if (!open){
+				t.Fatalf("connection closed after %d of %d messages", len(chat), count);
+			}
+			if (pkt.PktType == common.PktMSG){
+				chat = append(chat, packetText(t, pkt));
+			}
+		}
+		case <- timeout:{
+			t.Fatalf("timed out after %d of %d messages", len(chat), count);
+		}
+		}
+	}
+	return chat;
+}
+
+// sendDirect sends text to the client called to as a direct message
+func sendDirect(t *testing.T, client *testClient, to string, text string){
+	t.Helper();
+	raw, err := json.Marshal(common.Whisper{To: to, Text: text});
+	if (err != nil){
+		t.Fatalf("unable to encode direct message: %s", err);
+	}
+	pkt := common.MsgPacket{
+		PktType: common.PktWSP,
+	}
+	err = common.EncodeMessage(&pkt, string(raw));
+	if (err != nil){
+		t.Fatalf("unable to encode direct message: %s", err);
+	}
+	writePacket(t, client.conn, &pkt);
+}
+
+// packetText returns the text in pkt's payload
+func packetText(t *testing.T, pkt common.MsgPacket) (string){
+	t.Helper();
+	text, err := common.DecodeMessage(&pkt);
+	if (err != nil){
+		t.Fatalf("unable to decode %s: %s", common.PacketName(pkt.PktType), err);
+	}
+	return strings.TrimRight(text, "\x00");
+}
+
+// waitForPacket returns the first packet of type pktType with text containing
+// contains, skipping anything before it. chat is every chat message skipped
+func waitForPacket(t *testing.T, client *testClient, pktType uint8, contains string) (common.MsgPacket, []string){
+	t.Helper();
+	chat := []string{};
+	timeout := time.After(testTimeout);
+	for {
+		select {
+		case pkt, open := <- client.packets:{
+			if (!open){
+				t.Fatalf("connection closed waiting for %s %q", common.PacketName(pktType), contains);
+			}
+			text := packetText(t, pkt);
+			if ((pkt.PktType == pktType) && strings.Contains(text, contains)){
+				return pkt, chat;
+			}
+			if (pkt.PktType == common.PktMSG){
+				chat = append(chat, text);
+			}
+		}
+		case <- timeout:{
+			t.Fatalf("timed out waiting for %s %q", common.PacketName(pktType), contains);
+		}
+		}
+	}
+}
+
+// readUntilClosed reads everything sent to client until the room closes the
+// connection and returns whether it was kicked and every chat message
+func readUntilClosed(t *testing.T, client *testClient) (bool, []string){
+	t.Helper();
+	kicked := false;
+	chat := []string{};
+	timeout := time.After(testTimeout);
+	for {
+		select {
+		case pkt, open := <- client.packets:{
+			if (!open){
+				return kicked, chat;
+			}
+			switch pkt.PktType{
+			case common.PktKCK:{
+				kicked = true;
+			}
+			case common.PktMSG:{
+				chat = append(chat, packetText(t, pkt));
+			}
+			}
+		}
+		case <- timeout:{
+			t.Fatalf("timed out waiting for the connection to close");
+		}
+		}
+	}
+}
+
+// waitForGoroutines fails the test if the number of goroutines doesn't drop
+// back to baseline. Goroutines can take a moment to exit after what they
+// were waiting on has closed
+func waitForGoroutines(t *testing.T, baseline int){
+	t.Helper();
+	deadline := time.Now().Add(testTimeout);
+	for (runtime.NumGoroutine() > baseline){
+		if (time.Now().After(deadline)){
+			buf := make([]byte, 1 << 16);
+			t.Fatalf("%d goroutines left running, expected %d:\n%s", runtime.NumGoroutine(), baseline,
+				buf[:runtime.Stack(buf, true)]);
+		}
+		time.Sleep(10 * time.Millisecond);
+	}
+}
+
+// closeClients closes every client's connection and waits for their readers
+// to notice
+func closeClients(clients []*testClient){
+	for _, client := range clients{
+		client.conn.Close();
+		for range client.packets{
+		}
+	}
+}
+
+func TestRoomsRunIndependently(t *testing.T){
+	_, firstAddr := startRoom(t, "first", DefaultServerConfig());
+	second, secondAddr := startRoom(t, "second", DefaultServerConfig());
+
+	first1 := dialRoom(t, firstAddr, "alice");
+	first2 := dialRoom(t, firstAddr, "bob");
+	other := dialRoom(t, secondAddr, "carol");
+	for _, client := range []*testClient{first1, first2, other}{
+		readPackets(client);
+	}
+	waitForPacket(t, first1, common.PktANC, "bob has joined");
+
+	sendChat(t, first1, "only for the first room");
+	sendChat(t, other, "only for the second room");
+	chat := waitForChat(t, first2, 1);
+	if (chat[0] != "only for the first room"){
+		t.Errorf("first room got %q", chat[0]);
+	}
+	chat = waitForChat(t, other, 1);
+	if (chat[0] != "only for the second room"){
+		t.Errorf("second room got %q", chat[0]);
+	}
+
+	// Stopping one room leaves the other running
+	err := Stop(second);
+	if (err != nil){
+		t.Fatalf("unable to stop the second room: %s", err);
+	}
+	waitForPacket(t, other, common.PktKCK, "server shutdown");
+	sendChat(t, first2, "still here");
+	chat = waitForChat(t, first1, 2);
+	if (chat[1] != "still here"){
+		t.Errorf("first room got %q after the second stopped", chat[1]);
+	}
+}
+
+func TestShutdownNotifiesEveryClient(t *testing.T){
+	baseline := runtime.NumGoroutine();
+	cfg := DefaultServerConfig();
+	server, addr := startRoom(t, "room", cfg);
+	const members = 4;
+	const sent = 50;
+
+	// The last client doesn't read until the room is shutting down, so the
+	// burst is still waiting to be written to it
+	clients := []*testClient{};
+	for i := range members{
+		client := dialRoom(t, addr, fmt.Sprintf("user%d", i));
+		if (i < members - 1){
+			readPackets(client);
+		}
+		clients = append(clients, client);
+	}
+	waitForPacket(t, clients[0], common.PktANC, fmt.Sprintf("user%d has joined", members - 1));
+	for i := range sent{
+		sendChat(t, clients[0], fmt.Sprintf("message %d", i));
+	}
+	// A connection's packets are handled in order, so once the answer to this
+	// arrives the burst has been queued for everyone
+	sendDirect(t, clients[0], "nobody", "are you there?");
+	waitForPacket(t, clients[0], common.PktANC, "No one called nobody");
+	readPackets(clients[members - 1]);
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout);
+	defer cancel();
+	summary, err := Shutdown(server, ctx);
+	if (err != nil){
+		t.Fatalf("unable to shut down: %s", err);
+	}
+	if ((summary.Notified != members) || (summary.NotifyFailed != 0)){
+		t.Errorf("notified %d and failed %d, expected all %d notified", summary.Notified, summary.NotifyFailed, members);
+	}
+	if ((summary.Drained != members) || (summary.ForceClosed != 0)){
+		t.Errorf("drained %d and force closed %d, expected all %d drained", summary.Drained, summary.ForceClosed, members);
+	}
+	// The notice is written ahead of any chat still waiting, which is then
+	// written before the connection closes
+	for _, client := range clients[1:]{
+		kicked, chat := readUntilClosed(t, client);
+		if (!kicked){
+			t.Errorf("wasn't sent the shutdown notice");
+		}
+		if (len(chat) != sent){
+			t.Errorf("received %d of %d messages before the connection closed", len(chat), sent);
+		}
+	}
+
+	closeClients(clients);
+	waitForGoroutines(t, baseline);
+}
+
+func TestShutdownForceClosesStragglers(t *testing.T){
+	baseline := runtime.NumGoroutine();
+	cfg := DefaultServerConfig();
+	cfg.HandshakeTimeout = 60;
+	server, addr := startRoom(t, "room", cfg);
+
+	// stuck never reads, so its writer can't finish. The transport is a
+	// pipe so nothing is buffered for it
+	stuck := dialRoom(t, addr, "stuck");
+	reader := dialRoom(t, addr, "reader");
+	readPackets(reader);
+	sendChat(t, reader, "hello");
+	waitForChat(t, reader, 1);
+
+	// halfway reads the ACP and then never answers it
+	transport, dialAddr, err := common.ResolveAddress(addr);
+	if (err != nil){
+		t.Fatalf("unable to resolve %s: %s", addr, err);
+	}
+	halfway, err := transport.Dial(dialAddr, testTimeout);
+	if (err != nil){
+		t.Fatalf("unable to dial %s: %s", addr, err);
+	}
+	defer halfway.Close();
+	halfway.SetReadDeadline(time.Now().Add(testTimeout));
+	_, err = io.ReadFull(halfway, make([]byte, common.PktBufferSize));
+	if (err != nil){
+		t.Fatalf("unable to read ACP: %s", err);
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond);
+	defer cancel();
+	summary, err := Shutdown(server, ctx);
+	if (err != nil){
+		t.Fatalf("unable to shut down: %s", err);
+	}
+	if ((summary.ForceClosed != 2) || (summary.Drained != 1)){
+		t.Errorf("drained %d and force closed %d, expected 1 drained and 2 force closed", summary.Drained, summary.ForceClosed);
+	}
+	if (summary.Notified != 2){
+		t.Errorf("notified %d, expected 2", summary.Notified);
+	}
+	// The handshake is given up on at the deadline, not once it times out
+	if (summary.Duration > testTimeout){
+		t.Errorf("took %s to shut down", summary.Duration);
+	}
+	_, err = halfway.Read(make([]byte, 1));
+	if (err == nil){
+		t.Errorf("expected the connection still in its handshake to be closed");
+	}
+
+	readPackets(stuck);
+	closeClients([]*testClient{stuck, reader});
+	halfway.Close();
+	waitForGoroutines(t, baseline);
+}
+
+func TestConcurrentSendersWhileMembersChange(t *testing.T){
+	_, addr := startRoom(t, "room", DefaultServerConfig());
+	const senders = 8;
+	const perSender = 25;
+
+	watcher := dialRoom(t, addr, "watcher");
+	readPackets(watcher);
+	clients := []*testClient{};
+	for i := range senders{
+		client := dialRoom(t, addr, fmt.Sprintf("user%d", i));
+		readPackets(client);
+		clients = append(clients, client);
+	}
+	waitForPacket(t, watcher, common.PktANC, fmt.Sprintf("user%d has joined", senders - 1));
+
+	burst := make([][][]byte, senders);
+	for i := range senders{
+		for j := range perSender{
+			burst[i] = append(burst[i], chatPacket(t, fmt.Sprintf("message %d from user%d", j, i)));
+		}
+	}
+	// Others join, rename themselves and leave while the burst is sent
+	churned := make(chan bool);
+	go func(){
+		defer close(churned);
+		for i := range 10{
+			transport, dialAddr, err := common.ResolveAddress(addr);
+			if (err != nil){
+				return;
+			}
+			conn, err := transport.Dial(dialAddr, testTimeout);
+			if (err != nil){
+				return;
+			}
+			go io.Copy(io.Discard, conn);
+			ackRaw, _ := json.Marshal(common.ClientModifcation{NewName: fmt.Sprintf("visitor%d", i), Compression: common.CompressionNone});
+			pkt := common.MsgPacket{PktType: common.PktACK};
+			common.EncodeMessageWith(&pkt, string(ackRaw), common.Compression{});
+			data := make([]byte, common.PktBufferSize);
+			common.SerializePacket(&pkt, data);
+			conn.Write(data);
+
+			modRaw, _ := json.Marshal(common.ClientModifcation{NewName: fmt.Sprintf("renamed%d", i)});
+			pkt = common.MsgPacket{PktType: common.PktMDF};
+			common.EncodeMessage(&pkt, string(modRaw));
+			common.SerializePacket(&pkt, data);
+			conn.Write(data);
+			conn.Close();
+		}
+	}();
+	sendBurst(t, clients, burst);
+	<- churned;
+
+	// Messages from each sender arrive in the order they were sent
+	next := make([]int, senders);
+	for _, text := range waitForChat(t, watcher, senders * perSender){
+		var message, sender int;
+		_, err := fmt.Sscanf(text, "message %d from user%d", &message, &sender);
+		if (err != nil){
+			t.Fatalf("unexpected message %q", text);
+		}
+		if (message != next[sender]){
+			t.Errorf("got message %d from user%d, expected %d", message, sender, next[sender]);
+		}
+		next[sender] = message + 1;
+	}
+}
+
+func TestIdleHandshakeDoesNotBlockJoins(t *testing.T){
+	cfg := DefaultServerConfig();
+	cfg.HandshakeTimeout = 60;
+	_, addr := startRoom(t, "room", cfg);
+
+	// idle connects and then never reads or sends anything
+	transport, dialAddr, err := common.ResolveAddress(addr);
+	if (err != nil){
+		t.Fatalf("unable to resolve %s: %s", addr, err);
+	}
+	idle, err := transport.Dial(dialAddr, testTimeout);
+	if (err != nil){
+		t.Fatalf("unable to dial %s: %s", addr, err);
+	}
+	t.Cleanup(func(){
+		idle.Close();
+	});
+
+	// dialRoom fails if it isn't answered well before HandshakeTimeout
+	client := dialRoom(t, addr, "alice");
+	readPackets(client);
+	waitForPacket(t, client, common.PktANC, "alice has joined");
+}
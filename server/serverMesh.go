@@ -0,0 +1,206 @@
+package server
+
+// Contains everything to do with linking servers together so that clients
+// connected to different servers share one room
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"p2psystem/common"
+	"strings"
+	"time"
+)
+
+const (
+	// PeerRetryInterval is how long the server waits between attempts to
+	// link to configured peers that it isn't linked to
+	PeerRetryInterval = 5 * time.Second;
+	// SeenMessagesSize is the number of relayed message IDs each server
+	// remembers to drop duplicates
+	SeenMessagesSize = 4096;
+)
+
+// messageID uniquely identifies a message across the mesh
+type messageID struct{
+	origin uint64;
+	sequence uint64;
+}
+
+// newNodeID returns a random ID used to identify this server in the mesh
+func newNodeID() (uint64, error){
+	var buffer [8]byte;
+	_, err := io.ReadFull(rand.Reader, buffer[:]);
+	if (err != nil){
+		return 0, fmt.Errorf("serverMesh: unable to generate node ID: %s", err);
+	}
+	return binary.BigEndian.Uint64(buffer[:]), nil;
+}
+
+// stampMessage marks the given packet as originating from this server so
+// it can be identified by every other server in the mesh
+func stampMessage(server *ServerRoom, pkt *common.MsgPacket){
+	pkt.Origin = server.nodeID;
+	pkt.Sequence = server.sequence.Add(1);
+	markSeen(server, pkt);
+}
+
+// markSeen records the ID of the given packet and returns false if it's
+// already been seen, meaning it shouldn't be delivered or relayed again
+func markSeen(server *ServerRoom, pkt *common.MsgPacket) (bool){
+	id := messageID{origin: pkt.Origin, sequence: pkt.Sequence};
+
+	server.meshLock.Lock();
+	defer server.meshLock.Unlock();
+
+	_, exists := server.seen[id];
+	if (exists){
+		return false;
+	}
+	server.seen[id] = true;
+	server.seenOrder = append(server.seenOrder, id);
+	// Forget the oldest IDs once the limit's reached
+	if (len(server.seenOrder) > SeenMessagesSize){
+		delete(server.seen, server.seenOrder[0]);
+		server.seenOrder = server.seenOrder[1:];
+	}
+	return true;
+}
+
+// LinkPeer connects to the server at addr and links it into this server's
+// mesh so that messages are relayed between the two
+func LinkPeer(server *ServerRoom, addr string) (error){
+	transport, dialAddr, err := common.ResolveAddress(addr);
+	if (err != nil){
+		return fmt.Errorf("serverMesh.LinkPeer: %s", err);
+	}
+	conn, err := transport.Dial(dialAddr, 4 * time.Second);
+	if (err != nil){
+		return fmt.Errorf("serverMesh.LinkPeer: %s", err);
+	}
+
+	data := make([]byte, common.PktBufferSize);
+	conn.SetReadDeadline(time.Now().Add(4 * time.Second));
+	_, err = io.ReadFull(conn, data);
+	if (err != nil){
+		conn.Close();
+		return fmt.Errorf("serverMesh.LinkPeer: %s", err);
+	}
+	pkt := common.DeserializePacket(data);
+	// A full room refuses clients with REF but still takes links
+	if ((pkt.PktType != common.PktACP) && (pkt.PktType != common.PktREF)){
+		conn.Close();
+		return fmt.Errorf("serverMesh.LinkPeer: %s refused the link", addr);
+	}
+
+	// Older servers send the ACP without a ServerHello, in which case both
+	// ends use the encoding they know
+	var serverHello common.ServerHello;
+	if (pkt.PayloadSize > 0){
+		helloRaw, err := common.DecodeMessage(&pkt);
+		if (err == nil){
+			err = json.Unmarshal([]byte(strings.TrimRight(helloRaw, "\x00")), &serverHello);
+		}
+		if (err != nil){
+			server.log.Warn("unable to unpack ACP packet", "remote", addr, "err", err);
+		}
+	}
+	cfg := GetConfig(server);
+	method := common.ChooseCompression(cfg.Compression, serverHello.Compression);
+
+	// Every server in the mesh is the same room so they share its password
+	helloRaw, err := json.Marshal(common.PeerHello{NodeID: server.nodeID, Secret: cfg.MeshSecret, Password: cfg.Password,
+		Compression: method, Compact: serverHello.Compact});
+	if (err != nil){
+		conn.Close();
+		return fmt.Errorf("serverMesh.LinkPeer: %s", err);
+	}
+	pkt = common.MsgPacket{
+		PktType: common.PktPER,
+	}
+	err = common.EncodeMessageWith(&pkt, string(helloRaw), common.Compression{});
+	if (err != nil){
+		conn.Close();
+		return fmt.Errorf("serverMesh.LinkPeer: %s", err);
+	}
+	err = common.SerializePacket(&pkt, data);
+	if (err != nil){
+		conn.Close();
+		return fmt.Errorf("serverMesh.LinkPeer: %s", err);
+	}
+	_, err = conn.Write(data);
+	if (err != nil){
+		conn.Close();
+		return fmt.Errorf("serverMesh.LinkPeer: %s", err);
+	}
+
+	link := newServerConnection(conn, cfg);
+	link.nickname = fmt.Sprintf("peer-%s", addr);
+	link.peer = true;
+	link.peerAddr = addr;
+	link.compression = agreeCompression(cfg, method);
+	link.compact = serverHello.Compact;
+
+	server.meshLock.Lock();
+	server.linkedPeers[addr] = true;
+	server.meshLock.Unlock();
+
+	// serverMain owns the client list so hand it over to be added
+	select {
+	case server.peerLinks <- link:
+	case <- server.stop:{
+		conn.Close();
+		unlinkPeer(server, addr);
+		return fmt.Errorf("serverMesh.LinkPeer: server is shutting down");
+	}
+	}
+	return nil;
+}
+
+// unlinkPeer forgets that the outbound link to addr exists so that
+// maintainPeers tries to link to it again
+func unlinkPeer(server *ServerRoom, addr string){
+	server.meshLock.Lock();
+	delete(server.linkedPeers, addr);
+	server.meshLock.Unlock();
+}
+
+// maintainPeers links to every peer in the server's config that it isn't
+// already linked to, retrying every PeerRetryInterval until stop is closed
+func maintainPeers(server *ServerRoom, stop chan bool){
+	ticker := time.NewTicker(PeerRetryInterval);
+	defer ticker.Stop();
+
+	// Only the first failure for each peer is reported to avoid repeating it
+	// every retry
+	failing := map[string]bool{};
+	for {
+		for _, addr := range GetConfig(server).Peers{
+			server.meshLock.Lock();
+			linked := server.linkedPeers[addr];
+			server.meshLock.Unlock();
+			if (linked){
+				continue;
+			}
+
+			err := LinkPeer(server, addr);
+			if (err != nil){
+				if (!failing[addr]){
+					server.log.Warn("unable to link to peer", "peer", addr, "err", err);
+				}
+				failing[addr] = true;
+				continue;
+			}
+			delete(failing, addr);
+		}
+
+		select {
+		case <- ticker.C:
+		case <- stop:{
+			return;
+		}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+// Contains the counters the server keeps about itself and the HTTP endpoint
+// that exposes them
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"p2psystem/common"
+	"sync/atomic"
+)
+
+// serverMetrics holds every counter and gauge exposed on the metrics endpoint
+type serverMetrics struct{
+	connectedClients atomic.Int64;
+	linkedPeers atomic.Int64;
+	handshakesAccepted atomic.Uint64;
+	handshakesRefused atomic.Uint64;
+	messagesRelayed atomic.Uint64;
+	bytesIn atomic.Uint64;
+	bytesOut atomic.Uint64;
+	broadcastErrors atomic.Uint64;
+	announcementsSent atomic.Uint64;
+	queueDropped atomic.Uint64;
+	slowDisconnects atomic.Uint64;
+
+	accepting atomic.Bool;	// true while serverMain is accepting connections
+}
+
+// countingConn counts every byte read from and written to the connection
+type countingConn struct{
+	net.Conn;
+	metrics *serverMetrics;
+}
+
+func (conn *countingConn) Read(b []byte) (int, error){
+	size, err := conn.Conn.Read(b);
+	conn.metrics.bytesIn.Add(uint64(size));
+	return size, err;
+}
+
+func (conn *countingConn) Write(b []byte) (int, error){
+	size, err := conn.Conn.Write(b);
+	conn.metrics.bytesOut.Add(uint64(size));
+	return size, err;
+}
+
+// writeMetric writes a single metric in the Prometheus text format
+func writeMetric(writer http.ResponseWriter, name string, kind string, help string, value any){
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value);
+}
+
+// startMetrics serves the metrics and health endpoints on addr
+func startMetrics(server *ServerRoom, addr string) (*http.Server, error){
+	listener, err := common.TCPTransport{}.Listen(addr);
+	if (err != nil){
+		return nil, fmt.Errorf("serverMetrics: %s", err);
+	}
+	metrics := &server.metrics;
+
+	mux := http.NewServeMux();
+	mux.HandleFunc("/metrics", func(writer http.ResponseWriter, request *http.Request){
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4");
+		writeMetric(writer, "gomsg_connected_clients", "gauge",
+			"Number of clients connected to the room", metrics.connectedClients.Load());
+		writeMetric(writer, "gomsg_linked_peers", "gauge",
+			"Number of servers linked to this one", metrics.linkedPeers.Load());
+		writeMetric(writer, "gomsg_max_clients", "gauge",
+			"Maximum number of clients the room accepts", GetConfig(server).MaxClients);
+		writeMetric(writer, "gomsg_handshakes_accepted_total", "counter",
+			"Handshakes that were accepted", metrics.handshakesAccepted.Load());
+		writeMetric(writer, "gomsg_handshakes_refused_total", "counter",
+			"Handshakes that were refused or failed", metrics.handshakesRefused.Load());
+		writeMetric(writer, "gomsg_messages_relayed_total", "counter",
+			"Chat messages relayed to the room", metrics.messagesRelayed.Load());
+		writeMetric(writer, "gomsg_bytes_in_total", "counter",
+			"Bytes read from clients and peers", metrics.bytesIn.Load());
+		writeMetric(writer, "gomsg_bytes_out_total", "counter",
+			"Bytes written to clients and peers", metrics.bytesOut.Load());
+		writeMetric(writer, "gomsg_broadcast_write_errors_total", "counter",
+			"Writes that failed while broadcasting to the room", metrics.broadcastErrors.Load());
+		writeMetric(writer, "gomsg_announcements_sent_total", "counter",
+			"Server announcements sent to the room", metrics.announcementsSent.Load());
+		writeMetric(writer, "gomsg_queue_dropped_total", "counter",
+			"Chat messages dropped because a client's send queue was full", metrics.queueDropped.Load());
+		writeMetric(writer, "gomsg_slow_client_disconnects_total", "counter",
+			"Clients disconnected for falling too far behind", metrics.slowDisconnects.Load());
+	});
+	// The send queue of every connection
+	mux.HandleFunc("/clients", func(writer http.ResponseWriter, request *http.Request){
+		writer.Header().Set("Content-Type", "application/json");
+		json.NewEncoder(writer).Encode(GetClientStats(server));
+	});
+	// The process is alive if it can answer at all
+	mux.HandleFunc("/healthz", func(writer http.ResponseWriter, request *http.Request){
+		fmt.Fprint(writer, "ok\n");
+	});
+	// But it's only ready while it's still accepting connections
+	mux.HandleFunc("/readyz", func(writer http.ResponseWriter, request *http.Request){
+		if (!metrics.accepting.Load()){
+			http.Error(writer, "not accepting connections", http.StatusServiceUnavailable);
+			return;
+		}
+		fmt.Fprint(writer, "ok\n");
+	});
+
+	endpoint := &http.Server{Handler: mux};
+	server.background.Add(1);
+	go func(){
+		defer server.background.Done();
+		endpoint.Serve(listener);
+	}();
+	return endpoint, nil;
+}
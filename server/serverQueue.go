@@ -0,0 +1,367 @@
+package server
+
+// Every connection has its own queues of outbound packets that are written by
+// a single goroutine, so packets sent from different goroutines can't
+// interleave on the socket and a slow client never holds up the rest of the
+// room. Control packets (kicks, announcements and nickname changes) have their
+// own queue that's always written before any chat
+
+import (
+	"fmt"
+	"net"
+	"p2psystem/common"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ControlQueueSize is the number of control packets that can be waiting
+	// to be written to a connection. A client that falls this far behind is
+	// disconnected whatever the SendQueuePolicy
+	ControlQueueSize = 64;
+	// WriteDrainTimeout is how long a closing connection has to write the
+	// packets still in its queue
+	WriteDrainTimeout = 2 * time.Second;
+)
+
+// queueStats are the counters kept about a connection's send queue
+type queueStats struct{
+	sent atomic.Uint64;		// Packets written to the socket
+	dropped atomic.Uint64;	// Chat packets dropped because the queue was full
+	unreported atomic.Uint64;	// Dropped packets the client hasn't been told about yet
+	highWater atomic.Int64;	// The most chat packets that have been waiting at once
+}
+
+// ClientStats describes the send queue of a single connection
+type ClientStats struct{
+	Nickname string;
+	Remote string;
+	Peer bool;
+	Queued int;			// Chat packets waiting to be written
+	QueuedControl int;	// Control packets waiting to be written
+	Sent uint64;
+	Dropped uint64;
+	HighWater int64;
+}
+
+// newServerConnection returns a connection for conn that's ready to be
+// inserted, with a send queue using the config's size and policy
+func newServerConnection(conn net.Conn, cfg ServerConfig) (*serverConnection){
+	return &serverConnection{
+		client: conn,
+		instructions: make(chan int8, 1),
+		outbound: make(chan []byte, cfg.SendQueueSize),
+		control: make(chan []byte, ControlQueueSize),
+		policy: cfg.SendQueuePolicy,
+		closing: make(chan bool),
+		writerDone: make(chan bool),
+		stopped: make(chan bool),
+	};
+}
+
+// getNickname returns the connection's nickname. Use this from any goroutine
+// other than the connection's own
+func getNickname(conn *serverConnection) (string){
+	conn.nameLock.RLock();
+	defer conn.nameLock.RUnlock();
+	return conn.nickname;
+}
+
+// setNickname changes the connection's nickname
+func setNickname(conn *serverConnection, nickname string){
+	conn.nameLock.Lock();
+	defer conn.nameLock.Unlock();
+	conn.nickname = nickname;
+}
+
+// liveConnections returns every connection in the room that hasn't closed
+func liveConnections(server *ServerRoom) ([]*serverConnection){
+	server.clientsLock.RLock();
+	defer server.clientsLock.RUnlock();
+
+	live := make([]*serverConnection, 0, len(server.clients));
+	for _, conn := range server.clients{
+		if ((conn == nil) || conn.dead.Load()){
+			continue;
+		}
+		live = append(live, conn);
+	}
+	return live;
+}
+
+// GetClientStats returns the send queue stats of every connection in the room
+func GetClientStats(server *ServerRoom) ([]ClientStats){
+	live := liveConnections(server);
+	stats := make([]ClientStats, 0, len(live));
+	for _, conn := range live{
+		stats = append(stats, ClientStats{
+			Nickname: getNickname(conn),
+			Remote: conn.client.RemoteAddr().String(),
+			Peer: conn.peer,
+			Queued: len(conn.outbound),
+			QueuedControl: len(conn.control),
+			Sent: conn.stats.sent.Load(),
+			Dropped: conn.stats.dropped.Load(),
+			HighWater: conn.stats.highWater.Load(),
+		});
+	}
+	return stats;
+}
+
+// isControlPacket returns true for packets that are written before any chat
+func isControlPacket(data []byte) (bool){
+	switch data[0]{
+	case common.PktMSG, common.PktRLY, common.PktWSP:{
+		return false;
+	}
+	}
+	return true;
+}
+
+// broadcastPacket is a serialized packet being queued for several
+// connections. It's compressed once for each compression they use rather than
+// once for every connection
+type broadcastPacket struct{
+	data []byte;
+	encoded map[common.Compression][]byte;
+}
+
+// newBroadcast returns data ready to be queued with queueBroadcast. data must
+// not be changed afterwards
+func newBroadcast(data []byte) (*broadcastPacket){
+	return &broadcastPacket{data: data, encoded: map[common.Compression][]byte{}};
+}
+
+// queuePacket adds the serialized packet to one of the connection's queues,
+// compressed the way the connection agreed. data must not be changed
+// afterwards. Returns false if the packet was dropped
+func queuePacket(server *ServerRoom, conn *serverConnection, data []byte) (bool){
+	return queueBroadcast(server, conn, newBroadcast(data));
+}
+
+// queueBroadcast is queuePacket for a packet that's being sent to more than
+// one connection. It must only be used from one goroutine at a time
+func queueBroadcast(server *ServerRoom, conn *serverConnection, packet *broadcastPacket) (bool){
+	select {
+	case <- conn.writerDone:{
+		return false;
+	}
+	default:
+	}
+
+	data, ok := packet.encoded[conn.compression];
+	if (!ok){
+		var err error;
+		data, err = common.CompressPacket(packet.data, conn.compression);
+		if (err != nil){
+			server.log.Error("unable to compress packet", "remote", conn.client.RemoteAddr(),
+				"nickname", getNickname(conn), "err", err);
+			return false;
+		}
+		packet.encoded[conn.compression] = data;
+	}
+
+	if (isControlPacket(data)){
+		select {
+		case conn.control <- data:{
+			return true;
+		}
+		default:{
+			overflowConnection(server, conn);
+			return false;
+		}
+		}
+	}
+
+	// Only one sender at a time can decide what to do with a full queue
+	conn.queueLock.Lock();
+	defer conn.queueLock.Unlock();
+
+	select {
+	case conn.outbound <- data:{
+		depth := int64(len(conn.outbound));
+		if (depth > conn.stats.highWater.Load()){
+			conn.stats.highWater.Store(depth);
+		}
+		return true;
+	}
+	default:
+	}
+
+	server.metrics.queueDropped.Add(1);
+	conn.stats.dropped.Add(1);
+	conn.stats.unreported.Add(1);
+	switch conn.policy{
+	case QueueDropOldest:{
+		// Only the writer can take from the queue while the lock is held, so
+		// there's always room once one packet is removed
+		select {
+		case <- conn.outbound:
+		default:
+		}
+		select {
+		case conn.outbound <- data:{
+			return true;
+		}
+		default:
+		}
+	}
+	case QueueDisconnect:{
+		overflowConnection(server, conn);
+	}
+	}
+	return false;
+}
+
+// overflowConnection kicks a connection that's fallen too far behind
+func overflowConnection(server *ServerRoom, conn *serverConnection){
+	if (conn.overflowed.Swap(true)){
+		return;
+	}
+	server.metrics.slowDisconnects.Add(1);
+	server.log.Info("disconnecting client that can't keep up", "remote", conn.client.RemoteAddr(),
+		"nickname", getNickname(conn), "dropped", conn.stats.dropped.Load());
+
+	pkt := common.MsgPacket{
+		PktType: common.PktKCK,
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	data := make([]byte, common.PktBufferSize);
+	err := common.EncodeMessage(&pkt, "too many messages waiting to be sent");
+	if (err == nil){
+		err = common.SerializePacket(&pkt, data);
+	}
+	if (err == nil){
+		data, err = common.CompressPacket(data, conn.compression);
+	}
+	if (err == nil){
+		// The control queue may be the one that's full, in which case the
+		// client just doesn't get told why
+		select {
+		case conn.control <- data:
+		default:
+		}
+	}
+	select {
+	case conn.instructions <- ClientOverflow:
+	default:
+	}
+}
+
+// droppedNotice returns an announcement telling a client that count chat
+// messages were dropped from its queue, compressed for the connection, or nil
+// if it can't be made
+func droppedNotice(conn *serverConnection, count uint64) ([]byte){
+	pkt := common.MsgPacket{
+		PktType: common.PktANC,
+	}
+	err := common.EncodeMessage(&pkt, fmt.Sprintf("%d messages weren't sent to you because they arrived faster than you could receive them", count));
+	if (err != nil){
+		return nil;
+	}
+	data := make([]byte, common.PktBufferSize);
+	err = common.SerializePacket(&pkt, data);
+	if (err != nil){
+		return nil;
+	}
+	data, err = common.CompressPacket(data, conn.compression);
+	if (err != nil){
+		return nil;
+	}
+	return data;
+}
+
+// connectionWriter writes the connection's queued packets, control packets
+// first, until it's closing and then writes whatever is left
+func connectionWriter(server *ServerRoom, conn *serverConnection){
+	defer close(conn.writerDone);
+
+	// Everything queued is already compressed for this connection
+	write := func(data []byte) (bool){
+		err := common.WritePacket(conn.client, data, conn.compact);
+		if (err != nil){
+			server.metrics.broadcastErrors.Add(1);
+			server.log.Debug("unable to write to connection", "remote", conn.client.RemoteAddr(),
+				"nickname", getNickname(conn), "err", err);
+			// Closing the socket stops the reader too
+			conn.dead.Store(true);
+			conn.client.Close();
+			return false;
+		}
+		conn.stats.sent.Add(1);
+		return true;
+	};
+
+	for {
+		select {
+		case data := <- conn.control:{
+			if (!write(data)){
+				return;
+			}
+			continue;
+		}
+		default:
+		}
+
+		select {
+		case data := <- conn.control:{
+			if (!write(data)){
+				return;
+			}
+		}
+		case data := <- conn.outbound:{
+			if (!write(data)){
+				return;
+			}
+			// Once it's caught up tell the client what it missed
+			if ((len(conn.outbound) == 0) && (conn.stats.unreported.Load() > 0)){
+				notice := droppedNotice(conn, conn.stats.unreported.Swap(0));
+				if ((notice != nil) && !write(notice)){
+					return;
+				}
+			}
+		}
+		case <- conn.closing:{
+			conn.client.SetWriteDeadline(time.Now().Add(WriteDrainTimeout));
+			for {
+				select {
+				case data := <- conn.control:{
+					if (!write(data)){
+						return;
+					}
+					continue;
+				}
+				default:
+				}
+				// A client that overflowed isn't waiting for the rest of the chat
+				if (conn.overflowed.Load()){
+					return;
+				}
+				select {
+				case data := <- conn.outbound:{
+					if (!write(data)){
+						return;
+					}
+				}
+				default:{
+					return;
+				}
+				}
+			}
+		}
+		}
+	}
+}
+
+// startWriter starts the goroutine that writes the connection's queues
+func startWriter(server *ServerRoom, conn *serverConnection){
+	go connectionWriter(server, conn);
+}
+
+// stopWriter waits for the connection's queues to be written and closes the
+// socket
+func stopWriter(conn *serverConnection){
+	close(conn.closing);
+	<- conn.writerDone;
+	conn.client.Close();
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"p2psystem/common"
+	"testing"
+)
+
+func TestBurstFitsInDefaultQueue(t *testing.T){
+	_, addr := startRoom(t, "room", DefaultServerConfig());
+	const senders = 5;
+	const perSender = 20;
+
+	clients := []*testClient{};
+	for i := range senders{
+		client := dialRoom(t, addr, fmt.Sprintf("user%d", i));
+		readPackets(client);
+		clients = append(clients, client);
+	}
+	// Everyone has joined once the last one is announced to the first
+	waitForPacket(t, clients[0], common.PktANC, fmt.Sprintf("user%d has joined", senders - 1));
+
+	burst := make([][][]byte, senders);
+	for i := range senders{
+		for j := range perSender{
+			burst[i] = append(burst[i], chatPacket(t, fmt.Sprintf("message %d from user%d", j, i)));
+		}
+	}
+	sendBurst(t, clients, burst);
+
+	for _, client := range clients{
+		// waitForChat fails if any of them are missing
+		waitForChat(t, client, senders * perSender);
+	}
+}
+
+func TestSlowClientIsToldAboutDroppedChat(t *testing.T){
+	cfg := DefaultServerConfig();
+	cfg.SendQueueSize = 4;
+	_, addr := startRoom(t, "room", cfg);
+	const sent = 20;
+
+	// slow doesn't read anything until the burst is over
+	slow := dialRoom(t, addr, "slow");
+	fast := dialRoom(t, addr, "fast");
+	readPackets(fast);
+	for i := range sent{
+		sendChat(t, fast, fmt.Sprintf("message %d", i));
+	}
+	waitForPacket(t, fast, common.PktMSG, fmt.Sprintf("message %d", sent - 1));
+
+	readPackets(slow);
+	notice, chat := waitForPacket(t, slow, common.PktANC, "weren't sent to you");
+	var dropped int;
+	_, err := fmt.Sscanf(packetText(t, notice), "%d messages", &dropped);
+	if (err != nil){
+		t.Fatalf("unable to read the notice %q: %s", packetText(t, notice), err);
+	}
+	if (dropped == 0){
+		t.Errorf("expected some messages to be dropped");
+	}
+	if (len(chat) + dropped != sent){
+		t.Errorf("received %d messages and was told %d were dropped, expected %d in total", len(chat), dropped, sent);
+	}
+}
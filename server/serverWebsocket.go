@@ -0,0 +1,505 @@
+package server
+
+// Contains the WebSocket gateway that lets browsers join the room. Each
+// WebSocket is wrapped in a net.Conn that translates between JSON messages and
+// packets so it's handled exactly like any other client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"p2psystem/common"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed web/index.html
+var webPage []byte;
+
+const (
+	// wsGUID is appended to the client's key to create the accept key
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11";
+	// WSMaxFrameSize is the largest frame the gateway accepts from a browser
+	WSMaxFrameSize = 64 * 1024;
+
+	wsOpContinuation = 0x0;
+	wsOpText = 0x1;
+	wsOpBinary = 0x2;
+	wsOpClose = 0x8;
+	wsOpPing = 0x9;
+	wsOpPong = 0xA;
+)
+
+// WSMessage is the JSON format sent over the WebSocket in both directions.
+// Type is one of hello, accept, refused, message, direct, announcement, kick,
+// nickname, members or disconnect
+type WSMessage struct{
+	Type string `json:"type"`;
+	Nickname string `json:"nickname,omitempty"`;
+	Password string `json:"password,omitempty"`;
+	Text string `json:"text,omitempty"`;
+	Timestamp uint64 `json:"timestamp,omitempty"`;
+	To string `json:"to,omitempty"`;				// Who a direct message from the browser is for
+	Members []string `json:"members,omitempty"`;	// The room's members, in a members message
+}
+
+// wsConn wraps a WebSocket connection so that it can be read from and written
+// to with serialized packets
+type wsConn struct{
+	conn net.Conn;
+	reader *bufio.Reader;
+
+	pending bytes.Buffer;	// Serialized packets waiting to be read
+	outbound []byte;		// Part of a serialized packet waiting to be sent
+	writeLock sync.Mutex;
+	closed bool;
+}
+
+// startGateway serves the web page and the WebSocket endpoint on addr
+func startGateway(server *ServerRoom, addr string) (*http.Server, error){
+	listener, err := common.TCPTransport{}.Listen(addr);
+	if (err != nil){
+		return nil, fmt.Errorf("serverWebsocket: %s", err);
+	}
+
+	mux := http.NewServeMux();
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request){
+		if (request.URL.Path != "/"){
+			http.NotFound(writer, request);
+			return;
+		}
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8");
+		writer.Write(webPage);
+	});
+	mux.HandleFunc("/ws", func(writer http.ResponseWriter, request *http.Request){
+		if (!allowedOrigin(request, GetConfig(server).WebSocketOrigins)){
+			server.log.Warn("refusing WebSocket from another site", "remote", request.RemoteAddr,
+				"origin", request.Header.Get("Origin"));
+			http.Error(writer, "origin not allowed", http.StatusForbidden);
+			return;
+		}
+		conn, err := upgradeWebsocket(writer, request);
+		if (err != nil){
+			server.log.Warn("unable to upgrade WebSocket", "remote", request.RemoteAddr, "err", err);
+			return;
+		}
+
+		// Hand it to serverMain the same as any other new connection
+		select {
+		case server.inbound <- conn:
+		case <- server.stop:{
+			conn.Close();
+		}
+		}
+	});
+
+	gateway := &http.Server{Handler: mux};
+	server.background.Add(1);
+	go func(){
+		defer server.background.Done();
+		gateway.Serve(listener);
+	}();
+	return gateway, nil;
+}
+
+// allowedOrigin returns true if the page a WebSocket request came from can
+// join the room. Pages served by the gateway itself and the origins in allowed
+// can, and so can programs that aren't browsers since they don't send an
+// Origin. Otherwise any site the user visits could join for them
+func allowedOrigin(request *http.Request, allowed []string) (bool){
+	origin := request.Header.Get("Origin");
+	if (origin == ""){
+		return true;
+	}
+	for _, allow := range allowed{
+		if (strings.EqualFold(strings.TrimRight(allow, "/"), origin)){
+			return true;
+		}
+	}
+	parsed, err := url.Parse(origin);
+	if (err != nil){
+		return false;
+	}
+	return strings.EqualFold(parsed.Host, request.Host);
+}
+
+// upgradeWebsocket completes the WebSocket opening handshake and takes over
+// the underlying connection
+func upgradeWebsocket(writer http.ResponseWriter, request *http.Request) (*wsConn, error){
+	if (!strings.EqualFold(request.Header.Get("Upgrade"), "websocket")){
+		http.Error(writer, "expected a WebSocket upgrade", http.StatusBadRequest);
+		return nil, fmt.Errorf("missing Upgrade header");
+	}
+	key := request.Header.Get("Sec-WebSocket-Key");
+	if (key == ""){
+		http.Error(writer, "missing Sec-WebSocket-Key", http.StatusBadRequest);
+		return nil, fmt.Errorf("missing Sec-WebSocket-Key header");
+	}
+
+	hijacker, ok := writer.(http.Hijacker);
+	if (!ok){
+		http.Error(writer, "unable to upgrade", http.StatusInternalServerError);
+		return nil, fmt.Errorf("connection can't be hijacked");
+	}
+	conn, buffered, err := hijacker.Hijack();
+	if (err != nil){
+		return nil, err;
+	}
+
+	hash := sha1.Sum([]byte(key + wsGUID));
+	accept := base64.StdEncoding.EncodeToString(hash[:]);
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept);
+	if (err != nil){
+		conn.Close();
+		return nil, err;
+	}
+
+	return &wsConn{conn: conn, reader: buffered.Reader}, nil;
+}
+
+// readFrame reads a single frame from the browser and returns its opcode,
+// whether it's the final frame of a message and its unmasked payload
+func (ws *wsConn) readFrame() (byte, bool, []byte, error){
+	var header [2]byte;
+	_, err := io.ReadFull(ws.reader, header[:]);
+	if (err != nil){
+		return 0, false, nil, err;
+	}
+
+	final := (header[0] & 0x80) != 0;
+	opcode := header[0] & 0x0F;
+	masked := (header[1] & 0x80) != 0;
+	size := uint64(header[1] & 0x7F);
+
+	switch size{
+	case 126:{
+		var extended [2]byte;
+		_, err = io.ReadFull(ws.reader, extended[:]);
+		size = uint64(binary.BigEndian.Uint16(extended[:]));
+	}
+	case 127:{
+		var extended [8]byte;
+		_, err = io.ReadFull(ws.reader, extended[:]);
+		size = binary.BigEndian.Uint64(extended[:]);
+	}
+	}
+	if (err != nil){
+		return 0, false, nil, err;
+	}
+	if (size > WSMaxFrameSize){
+		return 0, false, nil, fmt.Errorf("frame of %d bytes is too large", size);
+	}
+	if (!masked){
+		return 0, false, nil, fmt.Errorf("browser sent an unmasked frame");
+	}
+
+	var mask [4]byte;
+	_, err = io.ReadFull(ws.reader, mask[:]);
+	if (err != nil){
+		return 0, false, nil, err;
+	}
+	payload := make([]byte, size);
+	_, err = io.ReadFull(ws.reader, payload);
+	if (err != nil){
+		return 0, false, nil, err;
+	}
+	for ind := range payload{
+		payload[ind] ^= mask[ind % 4];
+	}
+
+	return opcode, final, payload, nil;
+}
+
+// writeFrame sends a single unfragmented frame to the browser
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) (error){
+	ws.writeLock.Lock();
+	defer ws.writeLock.Unlock();
+
+	header := []byte{0x80 | opcode};
+	switch {
+	case len(payload) < 126:{
+		header = append(header, byte(len(payload)));
+	}
+	case len(payload) <= 0xFFFF:{
+		header = append(header, 126, 0, 0);
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)));
+	}
+	default:{
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0);
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)));
+	}
+	}
+
+	_, err := ws.conn.Write(append(header, payload...));
+	return err;
+}
+
+// readMessage reads frames until a whole text message has arrived, answering
+// any control frames along the way
+func (ws *wsConn) readMessage() ([]byte, error){
+	var message []byte;
+	for {
+		opcode, final, payload, err := ws.readFrame();
+		if (err != nil){
+			return nil, err;
+		}
+
+		switch opcode{
+		case wsOpPing:{
+			ws.writeFrame(wsOpPong, payload);
+			continue;
+		}
+		case wsOpPong:{
+			continue;
+		}
+		case wsOpClose:{
+			ws.writeFrame(wsOpClose, nil);
+			return nil, io.EOF;
+		}
+		case wsOpText, wsOpBinary, wsOpContinuation:{
+			message = append(message, payload...);
+			if (len(message) > WSMaxFrameSize){
+				return nil, fmt.Errorf("message is too large");
+			}
+		}
+		}
+
+		if (final){
+			return message, nil;
+		}
+	}
+}
+
+// toPacket converts a message from the browser into the packet a TCP client
+// would have sent
+func toPacket(msg *WSMessage) (common.MsgPacket, error){
+	var pkt common.MsgPacket;
+	var content string;
+
+	switch msg.Type{
+	case "hello":{
+		pkt.PktType = common.PktACK;
+		// Packets for the browser are decoded here so there's no point
+		// compressing them
+		raw, err := json.Marshal(common.ClientModifcation{NewName: msg.Nickname, Password: msg.Password,
+			Compression: common.CompressionNone});
+		if (err != nil){
+			return pkt, err;
+		}
+		content = string(raw);
+	}
+	case "message":{
+		pkt.PktType = common.PktMSG;
+		content = msg.Text;
+	}
+	case "direct":{
+		pkt.PktType = common.PktWSP;
+		raw, err := json.Marshal(common.Whisper{To: msg.To, Text: msg.Text});
+		if (err != nil){
+			return pkt, err;
+		}
+		content = string(raw);
+	}
+	case "nickname":{
+		pkt.PktType = common.PktMDF;
+		raw, err := json.Marshal(common.ClientModifcation{NewName: msg.Nickname});
+		if (err != nil){
+			return pkt, err;
+		}
+		content = string(raw);
+	}
+	case "disconnect":{
+		pkt.PktType = common.PktDCN;
+		return pkt, nil;
+	}
+	default:{
+		return pkt, fmt.Errorf("unknown message type %q", msg.Type);
+	}
+	}
+
+	err := common.EncodeMessage(&pkt, content);
+	return pkt, err;
+}
+
+// fromPacket converts a packet the server sent into the message the browser
+// expects. Packets browsers don't need return false
+func fromPacket(pkt *common.MsgPacket) (WSMessage, bool){
+	msg := WSMessage{Timestamp: pkt.Timestamp};
+
+	switch pkt.PktType{
+	case common.PktACP:{
+		msg.Type = "accept";
+		return msg, true;
+	}
+	case common.PktREF:{
+		msg.Type = "refused";
+		return msg, true;
+	}
+	case common.PktMSG:{
+		msg.Type = "message";
+		msg.Nickname = strings.TrimRight(pkt.SendNickname, "\x00");
+	}
+	case common.PktANC:{
+		msg.Type = "announcement";
+	}
+	case common.PktKCK:{
+		msg.Type = "kick";
+	}
+	case common.PktWSP:{
+		msg.Type = "direct";
+		msg.Nickname = strings.TrimRight(pkt.SendNickname, "\x00");
+	}
+	case common.PktMDF:{
+		msg.Type = "nickname";
+		msg.Nickname = strings.TrimRight(pkt.SendNickname, "\x00");
+	}
+	case common.PktMEM:{
+		msg.Type = "members";
+	}
+	default:{
+		return msg, false;
+	}
+	}
+
+	text, err := common.DecodeMessage(pkt);
+	if (err != nil){
+		return msg, false;
+	}
+	text = strings.TrimRight(text, "\x00");
+
+	// These have JSON payloads that are unpacked for the browser
+	switch pkt.PktType{
+	case common.PktWSP:{
+		var whisper common.Whisper;
+		err = json.Unmarshal([]byte(text), &whisper);
+		text = whisper.Text;
+	}
+	case common.PktMDF:{
+		var change common.ClientModifcation;
+		err = json.Unmarshal([]byte(text), &change);
+		text = change.NewName;
+	}
+	case common.PktMEM:{
+		var members common.MemberList;
+		err = json.Unmarshal([]byte(text), &members);
+		msg.Members = members.Members;
+		msg.Nickname = members.Nickname;
+		text = "";
+	}
+	}
+	if (err != nil){
+		return msg, false;
+	}
+	msg.Text = text;
+	return msg, true;
+}
+
+// Read fills b with serialized packets converted from the browser's messages
+func (ws *wsConn) Read(b []byte) (int, error){
+	for (ws.pending.Len() == 0){
+		raw, err := ws.readMessage();
+		if (err != nil){
+			return 0, err;
+		}
+
+		var msg WSMessage;
+		err = json.Unmarshal(raw, &msg);
+		if (err != nil){
+			// Ignore anything that isn't understood rather than dropping the client
+			continue;
+		}
+		pkt, err := toPacket(&msg);
+		if (err != nil){
+			continue;
+		}
+
+		data := make([]byte, common.PktBufferSize);
+		err = common.SerializePacket(&pkt, data);
+		if (err != nil){
+			return 0, err;
+		}
+		ws.pending.Write(data);
+	}
+
+	return ws.pending.Read(b);
+}
+
+// Write takes serialized packets and sends each one to the browser as a
+// JSON message
+func (ws *wsConn) Write(b []byte) (int, error){
+	ws.writeLock.Lock();
+	ws.outbound = append(ws.outbound, b...);
+	var packets [][]byte;
+	for (len(ws.outbound) >= common.PktBufferSize){
+		packets = append(packets, ws.outbound[:common.PktBufferSize]);
+		ws.outbound = ws.outbound[common.PktBufferSize:];
+	}
+	ws.writeLock.Unlock();
+
+	for _, data := range packets{
+		pkt := common.DeserializePacket(data);
+		msg, ok := fromPacket(&pkt);
+		if (!ok){
+			continue;
+		}
+		raw, err := json.Marshal(msg);
+		if (err != nil){
+			return 0, err;
+		}
+		err = ws.writeFrame(wsOpText, raw);
+		if (err != nil){
+			return 0, err;
+		}
+	}
+	return len(b), nil;
+}
+
+// Close sends a close frame and closes the underlying connection
+func (ws *wsConn) Close() (error){
+	ws.writeLock.Lock();
+	alreadyClosed := ws.closed;
+	ws.closed = true;
+	ws.writeLock.Unlock();
+	if (alreadyClosed){
+		return net.ErrClosed;
+	}
+
+	ws.writeFrame(wsOpClose, nil);
+	err := ws.conn.Close();
+	if (errors.Is(err, net.ErrClosed)){
+		return nil;
+	}
+	return err;
+}
+
+func (ws *wsConn) LocalAddr() (net.Addr){
+	return ws.conn.LocalAddr();
+}
+
+func (ws *wsConn) RemoteAddr() (net.Addr){
+	return ws.conn.RemoteAddr();
+}
+
+func (ws *wsConn) SetDeadline(t time.Time) (error){
+	return ws.conn.SetDeadline(t);
+}
+
+func (ws *wsConn) SetReadDeadline(t time.Time) (error){
+	return ws.conn.SetReadDeadline(t);
+}
+
+func (ws *wsConn) SetWriteDeadline(t time.Time) (error){
+	return ws.conn.SetWriteDeadline(t);
+}